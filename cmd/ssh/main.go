@@ -1,6 +1,9 @@
 package main
 
-import "github.com/titan-data/remote-sdk-go/remote"
+import (
+	"github.com/titan-data/remote-sdk-go/remote"
+	_ "github.com/titan-data/ssh-remote-go/ssh"
+)
 
 func main() {
 	remote.Serve("ssh")
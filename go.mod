@@ -1,9 +1,11 @@
 module github.com/titan-data/ssh-remote-go
 
 require (
-	github.com/stretchr/testify v1.5.1
+	github.com/klauspost/compress v1.11.13
+	github.com/pkg/sftp v1.12.0
+	github.com/stretchr/testify v1.6.1
 	github.com/titan-data/remote-sdk-go v0.2.1
-	golang.org/x/crypto v0.0.0-20191227163750-53104e6ec876
+	golang.org/x/crypto v0.0.0-20201221181555-eec23a3978ad
 )
 
 go 1.13
@@ -0,0 +1,52 @@
+/*
+ * Copyright The Titan Project Contributors.
+ */
+package ssh
+
+import (
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"io"
+	"net"
+	"os"
+)
+
+/*
+ * Connect to the ssh-agent listening on SSH_AUTH_SOCK. This works with OpenSSH's agent as well as hardware-backed
+ * agents that speak the same protocol.
+ */
+func defaultDialAgent() (net.Conn, error) {
+	sock := os.Getenv("SSH_AUTH_SOCK")
+	if sock == "" {
+		return nil, errors.New("SSH_AUTH_SOCK is not set, cannot use ssh-agent authentication")
+	}
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to ssh-agent at %s: %w", sock, err)
+	}
+	return conn, nil
+}
+
+var dialAgent = defaultDialAgent
+
+/*
+ * Returns true if the remote is configured to authenticate through ssh-agent.
+ */
+func useAgent(properties map[string]interface{}) bool {
+	useAgent, _ := properties["agent"].(bool)
+	return useAgent
+}
+
+/*
+ * Returns an authentication method that signs with the keys held by ssh-agent. The agent connection must remain
+ * open until authentication has completed, after which the caller is responsible for closing it.
+ */
+func getAgentAuth() (ssh.AuthMethod, io.Closer, error) {
+	conn, err := dialAgent()
+	if err != nil {
+		return nil, nil, err
+	}
+	return ssh.PublicKeysCallback(agent.NewClient(conn).Signers), conn, nil
+}
@@ -0,0 +1,154 @@
+/*
+ * Copyright The Titan Project Contributors.
+ */
+package ssh
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+const (
+	compressionNone = "none"
+	compressionGzip = "gzip"
+	compressionZstd = "zstd"
+)
+
+/*
+ * The zstd codecs are safe for concurrent use, and are created on first use since they start goroutines of their own.
+ */
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+	zstdErr     error
+)
+
+func zstdCodecs() (*zstd.Encoder, *zstd.Decoder, error) {
+	zstdOnce.Do(func() {
+		if zstdEncoder, zstdErr = zstd.NewWriter(nil); zstdErr == nil {
+			zstdDecoder, zstdErr = zstd.NewReader(nil)
+		}
+	})
+	return zstdEncoder, zstdDecoder, zstdErr
+}
+
+/*
+ * Returns the configured 'compression' property, defaulting to no compression.
+ */
+func getCompression(properties map[string]interface{}) string {
+	if compression, ok := properties["compression"].(string); ok && compression != "" {
+		return compression
+	}
+	return compressionNone
+}
+
+/*
+ * Validate the 'compression' property. In the objects layout, chunks are stored compressed, so they are compressed in
+ * transit over every transport as well as at rest. The files layout stores plain files, and only compresses the file
+ * data sent over the shell transport, which the remote host decompresses with gzip. Hosts cannot be relied on to have
+ * zstd, so zstd is refused for the files layout rather than silently replaced.
+ */
+func validateCompression(compression string, layout string) error {
+	if compression != compressionNone && compression != compressionGzip && compression != compressionZstd {
+		return fmt.Errorf("invalid compression '%s', must be one of '%s', '%s' or '%s'", compression, compressionNone,
+			compressionGzip, compressionZstd)
+	}
+	if compression == compressionZstd && layout != layoutObjects {
+		return fmt.Errorf("'%s' compression requires the '%s' layout, use '%s' for the '%s' layout", compressionZstd,
+			layoutObjects, compressionGzip, layoutFiles)
+	}
+	return nil
+}
+
+/*
+ * Returns the compression of the streams of file data sent and received by the shell transport. In the objects
+ * layout, chunks are compressed where they are stored instead, so the streams are left alone.
+ */
+func streamCompression(properties map[string]interface{}) string {
+	if getLayout(properties) == layoutObjects {
+		return compressionNone
+	}
+	return getCompression(properties)
+}
+
+/*
+ * Validate the 'sshCompression' property. The SSH client only implements the 'none' compression method, so transport
+ * compression cannot be negotiated with the server, and enabling it is refused rather than silently ignored.
+ */
+func validateSSHCompression(enabled bool) error {
+	if enabled {
+		return errors.New("SSH transport compression is not supported, as the SSH client only implements the 'none' " +
+			"method, use the 'compression' property to compress commit data instead")
+	}
+	return nil
+}
+
+/*
+ * Compress a chunk before it is stored. The output only depends on the input, so that identical chunks are stored as
+ * identical objects.
+ */
+func compressChunk(chunk []byte, compression string) ([]byte, error) {
+	switch compression {
+	case compressionGzip:
+		var b bytes.Buffer
+		w := gzip.NewWriter(&b)
+		if _, err := w.Write(chunk); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return b.Bytes(), nil
+	case compressionZstd:
+		encoder, _, err := zstdCodecs()
+		if err != nil {
+			return nil, err
+		}
+		return encoder.EncodeAll(chunk, nil), nil
+	}
+	return chunk, nil
+}
+
+func decompressChunk(data []byte, compression string) ([]byte, error) {
+	switch compression {
+	case "", compressionNone:
+		return data, nil
+	case compressionGzip:
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.ReadAll(r)
+	case compressionZstd:
+		_, decoder, err := zstdCodecs()
+		if err != nil {
+			return nil, err
+		}
+		return decoder.DecodeAll(data, nil)
+	}
+	return nil, fmt.Errorf("unsupported compression '%s'", compression)
+}
+
+/*
+ * Returns a reader of the gzip-compressed contents of r. The reader must be closed, which stops the compression if the
+ * stream was not read in full.
+ */
+func compressStream(r io.Reader) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		w := gzip.NewWriter(pw)
+		_, err := io.Copy(w, r)
+		if err == nil {
+			err = w.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr
+}
@@ -0,0 +1,185 @@
+/*
+ * Copyright The Titan Project Contributors.
+ */
+package ssh
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/titan-data/remote-sdk-go/remote"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCompressChunk(t *testing.T) {
+	chunk := bytes.Repeat([]byte("compressible "), 1000)
+	for _, compression := range []string{compressionGzip, compressionZstd} {
+		compressed, err := compressChunk(chunk, compression)
+		if assert.NoError(t, err, compression) {
+			assert.True(t, len(compressed) < len(chunk), compression)
+			again, _ := compressChunk(chunk, compression)
+			assert.Equal(t, compressed, again, compression)
+			data, err := decompressChunk(compressed, compression)
+			if assert.NoError(t, err, compression) {
+				assert.Equal(t, chunk, data, compression)
+			}
+		}
+		_, err = decompressChunk(chunk, compression)
+		assert.Error(t, err, compression)
+	}
+	data, err := compressChunk(chunk, compressionNone)
+	if assert.NoError(t, err) {
+		assert.Equal(t, chunk, data)
+	}
+	_, err = decompressChunk(chunk, "lz4")
+	assert.Error(t, err)
+}
+
+func TestCompressedObjects(t *testing.T) {
+	scryptCost = 1 << 10
+	for _, encryption := range []string{"none", "aes-gcm"} {
+		for _, compression := range []string{compressionGzip, compressionZstd} {
+			name := encryption + "/" + compression
+			repo := writeRepository(t, map[string]string{})
+			dir, source := writeSourceData(t)
+			local := writeRepository(t, map[string]string{})
+			large := bytes.Repeat([]byte("abc"), 100000)
+			assert.NoError(t, ioutil.WriteFile(filepath.Join(source, "large"), large, 0644))
+
+			mockSFTPDial()
+			props := pushProperties(repo)
+			props["layout"] = "objects"
+			props["encryption"] = encryption
+			props["compression"] = compression
+			params := map[string]interface{}{"password": "password", "encryptionPassphrase": "secret"}
+			assert.NoError(t, sshRemote{}.PushCommit(props, params, remote.Commit{Id: "id"}, source, ""), name)
+
+			var stored int64
+			filepath.Walk(filepath.Join(repo, objectsDir), func(file string, info os.FileInfo, err error) error {
+				if err == nil && info.Mode().IsRegular() {
+					stored += info.Size()
+				}
+				return nil
+			})
+			assert.True(t, stored < 10000, name)
+			if encryption == "none" {
+				content, _ := ioutil.ReadFile(filepath.Join(repo, "id", "manifest.json"))
+				m := &manifest{}
+				if assert.NoError(t, json.Unmarshal(content, m)) {
+					assert.Equal(t, compression, m.Compression)
+				}
+			}
+
+			_, err := sshRemote{}.PullCommit(props, params, "id", filepath.Join(local, "dest"), "")
+			if assert.NoError(t, err, name) {
+				checkCommitData(t, filepath.Join(local, "dest"))
+				content, _ := ioutil.ReadFile(filepath.Join(local, "dest", "large"))
+				assert.Len(t, content, 300000)
+			}
+			_, err = sshRemote{}.VerifyCommit(props, params, "id")
+			assert.NoError(t, err, name)
+
+			resetSFTPDial()
+			os.RemoveAll(repo)
+			os.RemoveAll(dir)
+			os.RemoveAll(local)
+		}
+	}
+}
+
+func TestCompressedStream(t *testing.T) {
+	repo := writeRepository(t, map[string]string{})
+	defer os.RemoveAll(repo)
+	dir, source := writeSourceData(t)
+	defer os.RemoveAll(dir)
+	local := writeRepository(t, map[string]string{})
+	defer os.RemoveAll(local)
+
+	mockSFTPDial()
+	run = runLocal
+	stream = streamLocal
+	var commands []string
+	runInput = func(conn *ssh.Client, command string, input io.Reader) ([]byte, error) {
+		commands = append(commands, command)
+		return runLocalInput(conn, command, input)
+	}
+	props := pushProperties(repo)
+	props["transport"] = "shell"
+	props["compression"] = "gzip"
+	params := map[string]interface{}{"password": "password"}
+	assert.NoError(t, sshRemote{}.PushCommit(props, params, remote.Commit{Id: "id"}, source, ""))
+	assert.Contains(t, strings.Join(commands, "\n"), "gzip -dc > ")
+	content, err := ioutil.ReadFile(filepath.Join(repo, "id", "dir", "file"))
+	if assert.NoError(t, err) {
+		assert.Equal(t, "content", string(content))
+	}
+
+	_, err = sshRemote{}.PullCommit(props, params, "id", filepath.Join(local, "dest"), "")
+	if assert.NoError(t, err) {
+		checkCommitData(t, filepath.Join(local, "dest"))
+	}
+
+	run = runCommand
+	runInput = runCommandInput
+	stream = streamCommand
+	resetSFTPDial()
+}
+
+func TestCompressionProperty(t *testing.T) {
+	r := remote.Get("ssh")
+	props, err := r.FromURL("ssh://user@host/path", map[string]string{"compression": "zstd", "layout": "objects",
+		"sshCompression": "false"})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "zstd", props["compression"])
+		assert.NoError(t, r.ValidateRemote(props))
+		_, extra, err := r.ToURL(props)
+		if assert.NoError(t, err) {
+			assert.Equal(t, "zstd", extra["compression"])
+		}
+	}
+	props, err = r.FromURL("ssh://user@host/path", map[string]string{"compression": "gzip"})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "gzip", props["compression"])
+		assert.NoError(t, r.ValidateRemote(props))
+		assert.Equal(t, compressionGzip, streamCompression(props))
+	}
+	_, err = r.FromURL("ssh://user@host/path", map[string]string{"compression": "none"})
+	assert.NoError(t, err)
+	assert.NoError(t, r.ValidateRemote(map[string]interface{}{"username": "username", "address": "host",
+		"path": "/path", "sshCompression": false}))
+	assert.Equal(t, compressionNone, streamCompression(map[string]interface{}{"compression": "gzip",
+		"layout": "objects"}))
+}
+
+func TestCompressionBadProperty(t *testing.T) {
+	r := remote.Get("ssh")
+	_, err := r.FromURL("ssh://user@host/path", map[string]string{"compression": "lz4", "layout": "objects"})
+	assert.Error(t, err)
+	_, err = r.FromURL("ssh://user@host/path", map[string]string{"compression": "zstd"})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "requires the 'objects' layout")
+	}
+	err = r.ValidateRemote(map[string]interface{}{"username": "username", "address": "host", "path": "/path",
+		"layout": "files", "compression": "zstd"})
+	assert.Error(t, err)
+	_, err = r.FromURL("ssh://user@host/path", map[string]string{"sshCompression": "true"})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "SSH transport compression is not supported")
+	}
+	_, err = r.FromURL("ssh://user@host/path", map[string]string{"sshCompression": "maybe"})
+	assert.Error(t, err)
+	err = r.ValidateRemote(map[string]interface{}{"username": "username", "address": "host", "path": "/path",
+		"sshCompression": true})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "SSH transport compression is not supported")
+	}
+	err = r.ValidateRemote(map[string]interface{}{"username": "username", "address": "host", "path": "/path",
+		"sshCompression": "yes"})
+	assert.Error(t, err)
+}
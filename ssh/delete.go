@@ -0,0 +1,51 @@
+/*
+ * Copyright The Titan Project Contributors.
+ */
+package ssh
+
+import (
+	"fmt"
+)
+
+/*
+ * Delete a commit from <path>/<commitId>/. The metadata.json is removed first, so that the commit disappears from
+ * listings before any of its data is touched, and the rest of the directory is removed afterwards. If the data can
+ * only be partially removed, the error names what was left behind; deleting the commit again resumes the cleanup.
+ * The repository lock is held while deleting. For commits in the objects layout, only the manifest is removed, and
+ * the objects it referenced are left for CollectGarbage() to remove once no other commit needs them.
+ */
+func (s sshRemote) DeleteCommit(properties map[string]interface{}, parameters map[string]interface{}, commitId string) error {
+	if err := validateCommitId(commitId); err != nil {
+		return err
+	}
+
+	store, release, err := connectStore(properties, parameters)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	return withLock(store, properties, func() error {
+		return deleteCommit(store, properties, commitId)
+	})
+}
+
+func deleteCommit(store remoteStore, properties map[string]interface{}, commitId string) error {
+	dir := fmt.Sprintf("%s/%s", properties["path"], commitId)
+	entries, err := store.listDir(dir)
+	if err != nil {
+		return fmt.Errorf("no such commit %s: %w", commitId, err)
+	}
+	for _, e := range entries {
+		if e == "metadata.json" {
+			if err := store.remove(dir + "/metadata.json"); err != nil {
+				return fmt.Errorf("failed to delete commit %s: %w", commitId, err)
+			}
+		}
+	}
+
+	if err := store.removeAll(dir); err != nil {
+		return fmt.Errorf("commit %s was deleted, but some of its data could not be removed: %w", commitId, err)
+	}
+	return nil
+}
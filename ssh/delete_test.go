@@ -0,0 +1,81 @@
+/*
+ * Copyright The Titan Project Contributors.
+ */
+package ssh
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/titan-data/remote-sdk-go/remote"
+	"golang.org/x/crypto/ssh"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDeleteCommit(t *testing.T) {
+	repo := writeCommitData(t)
+	defer os.RemoveAll(repo)
+
+	mockSFTPDial()
+	params := map[string]interface{}{"password": "password"}
+	err := sshRemote{}.DeleteCommit(pushProperties(repo), params, "id")
+	if assert.NoError(t, err) {
+		_, err = os.Lstat(filepath.Join(repo, "id"))
+		assert.True(t, os.IsNotExist(err))
+		commits, err := sshRemote{}.ListCommits(pushProperties(repo), params, []remote.Tag{})
+		if assert.NoError(t, err) {
+			assert.Empty(t, commits)
+		}
+	}
+	resetSFTPDial()
+}
+
+func TestDeleteCommitMissing(t *testing.T) {
+	repo := writeRepository(t, map[string]string{})
+	defer os.RemoveAll(repo)
+
+	mockSFTPDial()
+	err := sshRemote{}.DeleteCommit(pushProperties(repo), map[string]interface{}{"password": "password"}, "id")
+	assert.Error(t, err)
+	resetSFTPDial()
+}
+
+func TestDeleteCommitBadId(t *testing.T) {
+	for _, id := range []string{"..", "../other", "a/b", "", ".objects", ".lock"} {
+		err := sshRemote{}.DeleteCommit(pushProperties("/path"), map[string]interface{}{"password": "password"}, id)
+		assert.Error(t, err)
+	}
+}
+
+func TestDeleteCommitPartial(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("no POSIX shell available")
+	}
+	repo := writeCommitData(t)
+	defer os.RemoveAll(repo)
+
+	mockSFTPDial()
+	run = func(conn *ssh.Client, command string) ([]byte, error) {
+		if strings.HasPrefix(command, "rm -rf") && strings.HasSuffix(command, "/id") {
+			return nil, errors.New("rm: cannot remove 'dir/file': Permission denied")
+		}
+		return runLocal(conn, command)
+	}
+	runInput = runLocalInput
+	props := pushProperties(repo)
+	props["transport"] = "shell"
+	err := sshRemote{}.DeleteCommit(props, map[string]interface{}{"password": "password"}, "id")
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "dir/file")
+	}
+	_, err = os.Stat(filepath.Join(repo, "id", "metadata.json"))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(repo, "id", "dir", "file"))
+	assert.NoError(t, err)
+	run = runCommand
+	runInput = runCommandInput
+	resetSFTPDial()
+}
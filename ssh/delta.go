@@ -0,0 +1,352 @@
+/*
+ * Copyright The Titan Project Contributors.
+ */
+package ssh
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/titan-data/remote-sdk-go/remote"
+	"io"
+	"os"
+)
+
+const (
+	transferCopy  = "copy"
+	transferDelta = "delta"
+)
+
+/*
+ * Size of the blocks that delta transfers match against the basis. This is the largest block size used by rsync,
+ * and keeps the block signatures in the manifest at under 1/1000th of the size of the data.
+ */
+const deltaBlockSize = 128 * 1024
+
+/*
+ * Largest run of new data sent as a single literal.
+ */
+const maxLiteralSize = 1024 * 1024
+
+var errNoDelta = errors.New("delta transfers require the shell transport and GNU head on the remote host")
+
+var errDeltaMismatch = errors.New("delta patched file does not match its hash")
+
+func getTransferMode(properties map[string]interface{}) string {
+	if mode, ok := properties["transferMode"].(string); ok && mode != "" {
+		return mode
+	}
+	return transferCopy
+}
+
+/*
+ * Validate the 'transferMode' property. Deltas are applied by running commands on the remote host, so they cannot
+ * be combined with the SFTP transport.
+ */
+func validateTransferMode(mode string, transport string) error {
+	if mode != transferCopy && mode != transferDelta {
+		return fmt.Errorf("invalid transfer mode '%s', must be one of '%s' or '%s'", mode, transferCopy,
+			transferDelta)
+	}
+	if mode == transferDelta && transport == transportSFTP {
+		return fmt.Errorf("transfer mode '%s' cannot be used with the '%s' transport", transferDelta, transportSFTP)
+	}
+	return nil
+}
+
+/*
+ * The rsync rolling checksum, which can be updated in constant time as a window slides over the data one byte at a
+ * time.
+ */
+type rollingSum struct {
+	a, b uint32
+	n    uint32
+}
+
+func newRollingSum(p []byte) rollingSum {
+	r := rollingSum{n: uint32(len(p))}
+	for i, c := range p {
+		r.a += uint32(c)
+		r.b += (r.n - uint32(i)) * uint32(c)
+	}
+	return r
+}
+
+/*
+ * Slide the window by one byte, removing out from the front and adding in at the end.
+ */
+func (r *rollingSum) roll(out byte, in byte) {
+	r.a += uint32(in) - uint32(out)
+	r.b += r.a - r.n*uint32(out)
+}
+
+func (r rollingSum) sum() uint32 {
+	return r.a&0xffff | r.b<<16
+}
+
+/*
+ * The commit that a delta push uses as its basis: the remote directory of the commit, and the signatures of the
+ * blocks of each of its files.
+ */
+type deltaBasis struct {
+	dir       string
+	blockSize int
+	files     map[string]manifestFile
+}
+
+/*
+ * Find the basis for a delta push of the given commit: the most recent other commit with block signatures in its
+ * manifest. Returns nil if there is no such commit.
+ */
+func findDeltaBasis(store remoteStore, properties map[string]interface{}, commitId string) (*deltaBasis, error) {
+	commits, err := listCommits(store, properties, nil, []remote.Tag{})
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range commits {
+		if c.Id == commitId {
+			continue
+		}
+		dir := fmt.Sprintf("%s/%s", properties["path"], c.Id)
+		m, err := readManifest(store, dir)
+		if err != nil || m == nil || m.BlockSize == 0 {
+			continue
+		}
+		basis := &deltaBasis{dir: dir, blockSize: m.BlockSize, files: map[string]manifestFile{}}
+		for _, f := range m.Files {
+			basis.files[f.Name] = f
+		}
+		return basis, nil
+	}
+	return nil, nil
+}
+
+/*
+ * Encodes a file as a delta against the blocks of a basis file, using the rsync algorithm: a window the size of a
+ * block slides over the file, and wherever its rolling checksum and then its SHA-256 match a block of the basis, the
+ * block is copied from the basis rather than sent. Everything else is sent as literal data. The output is a sequence
+ * of commands for the shell script built by deltaScript():
+ *
+ *	C <block> <count>\n		copy count blocks of the basis, starting at block
+ *	L <length>\n<data>		write length bytes of literal data
+ *	E\n				end of file
+ */
+type deltaEncoder struct {
+	w         io.Writer
+	r         io.Reader
+	blockSize int
+	blocks    map[uint32][]int
+	strong    []string
+	buf       []byte
+	pos       int
+	lit       int
+	eof       bool
+	copyStart int
+	copyCount int
+}
+
+func writeDelta(w io.Writer, r io.Reader, blockSize int, basis []manifestBlock) error {
+	d := &deltaEncoder{w: w, r: r, blockSize: blockSize, blocks: map[uint32][]int{}}
+	for i, b := range basis {
+		d.blocks[b.Weak] = append(d.blocks[b.Weak], i)
+		d.strong = append(d.strong, b.Strong)
+	}
+	return d.encode()
+}
+
+/*
+ * Read until there are at least n bytes after the current position, or the end of the file is reached. Data before
+ * the pending literal is discarded to bound memory use, and overly long literals are flushed.
+ */
+func (d *deltaEncoder) fill(n int) error {
+	for len(d.buf)-d.pos < n && !d.eof {
+		if d.pos-d.lit >= maxLiteralSize {
+			if err := d.flushLiteral(); err != nil {
+				return err
+			}
+		}
+		if d.lit > 0 {
+			copy(d.buf, d.buf[d.lit:])
+			d.buf = d.buf[:len(d.buf)-d.lit]
+			d.pos -= d.lit
+			d.lit = 0
+		}
+		chunk := make([]byte, d.blockSize)
+		read, err := io.ReadFull(d.r, chunk)
+		d.buf = append(d.buf, chunk[:read]...)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			d.eof = true
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *deltaEncoder) match(weak uint32, window []byte) (int, bool) {
+	candidates, ok := d.blocks[weak]
+	if !ok {
+		return 0, false
+	}
+	sum := sha256.Sum256(window)
+	strong := hex.EncodeToString(sum[:])
+	for _, i := range candidates {
+		if d.strong[i] == strong {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+func (d *deltaEncoder) encode() error {
+	var weak rollingSum
+	valid := false
+	for {
+		if err := d.fill(d.blockSize + 1); err != nil {
+			return err
+		}
+		if len(d.buf)-d.pos < d.blockSize {
+			break
+		}
+		window := d.buf[d.pos : d.pos+d.blockSize]
+		if !valid {
+			weak = newRollingSum(window)
+			valid = true
+		}
+
+		if block, ok := d.match(weak.sum(), window); ok {
+			if err := d.flushLiteral(); err != nil {
+				return err
+			}
+			if err := d.copyBlock(block); err != nil {
+				return err
+			}
+			d.pos += d.blockSize
+			d.lit = d.pos
+			valid = false
+			continue
+		}
+
+		if len(d.buf)-d.pos == d.blockSize {
+			break
+		}
+		weak.roll(d.buf[d.pos], d.buf[d.pos+d.blockSize])
+		d.pos++
+	}
+
+	d.pos = len(d.buf)
+	if err := d.flushLiteral(); err != nil {
+		return err
+	}
+	if err := d.flushCopy(); err != nil {
+		return err
+	}
+	_, err := io.WriteString(d.w, "E\n")
+	return err
+}
+
+func (d *deltaEncoder) copyBlock(block int) error {
+	if d.copyCount != 0 && d.copyStart+d.copyCount == block {
+		d.copyCount++
+		return nil
+	}
+	if err := d.flushCopy(); err != nil {
+		return err
+	}
+	d.copyStart, d.copyCount = block, 1
+	return nil
+}
+
+func (d *deltaEncoder) flushCopy() error {
+	if d.copyCount == 0 {
+		return nil
+	}
+	_, err := fmt.Fprintf(d.w, "C %d %d\n", d.copyStart, d.copyCount)
+	d.copyCount = 0
+	return err
+}
+
+func (d *deltaEncoder) flushLiteral() error {
+	if d.pos == d.lit {
+		return nil
+	}
+	if err := d.flushCopy(); err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(d.w, "L %d\n", d.pos-d.lit); err != nil {
+		return err
+	}
+	if _, err := d.w.Write(d.buf[d.lit:d.pos]); err != nil {
+		return err
+	}
+	d.lit = d.pos
+	return nil
+}
+
+/*
+ * Build the shell script that applies a delta read from its standard input. The shell's read builtin consumes input
+ * one line at a time, and head -c exactly the length of each literal, so commands and data can share the stream.
+ * Reading no further than asked from a shared stdin is GNU head behaviour; BusyBox and BSD head read ahead in
+ * blocks and would swallow the commands that follow a literal, so the script is only run where head is GNU.
+ */
+func deltaScript(basis string, target string, blockSize int, mode os.FileMode) string {
+	return "exec 3>" + shellQuote(target) + " || exit 1\n" +
+		"while read -r op a b; do\n" +
+		"  case \"$op\" in\n" +
+		"    C) dd if=" + shellQuote(basis) + fmt.Sprintf(" bs=%d", blockSize) +
+		" skip=\"$a\" count=\"$b\" 2>/dev/null >&3 || exit 1 ;;\n" +
+		"    L) head -c \"$a\" >&3 || exit 1 ;;\n" +
+		"    E) exec 3>&-; " + shellCommand(fmt.Sprintf("chmod %o --", mode.Perm()), target) + "; exit $? ;;\n" +
+		"    *) exit 1 ;;\n" +
+		"  esac\n" +
+		"done\n" +
+		"exit 1\n"
+}
+
+/*
+ * Upload a file as a delta against a file of the basis commit. Returns errNoDelta if the store cannot apply deltas,
+ * and errDeltaMismatch if the patched file does not have the size and SHA-256 of the local file. The blocks copied
+ * from the basis are only as good as the basis file on the remote host, which may have been changed since its
+ * manifest was written. In both cases the caller uploads the whole file instead.
+ */
+func uploadDelta(store remoteStore, file string, target string, basisFile string, blockSize int,
+	blocks []manifestBlock, mode os.FileMode) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	counter := &countingWriter{}
+	r, w := io.Pipe()
+	written := make(chan struct{})
+	go func() {
+		w.CloseWithError(writeDelta(w, io.TeeReader(f, io.MultiWriter(h, counter)), blockSize, blocks))
+		close(written)
+	}()
+	err = store.patchFile(basisFile, target, r, blockSize, mode)
+	r.CloseWithError(errors.New("delta aborted"))
+	<-written
+	if err != nil {
+		return err
+	}
+
+	if size, err := store.fileSize(target); err != nil || size != counter.n {
+		return errDeltaMismatch
+	}
+	if sum, err := store.hashRange(target, 0, counter.n); err != nil || sum != hex.EncodeToString(h.Sum(nil)) {
+		return errDeltaMismatch
+	}
+	return nil
+}
+
+type countingWriter struct {
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	c.n += int64(len(p))
+	return len(p), nil
+}
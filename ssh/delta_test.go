@@ -0,0 +1,292 @@
+/*
+ * Copyright The Titan Project Contributors.
+ */
+package ssh
+
+import (
+	"bufio"
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"github.com/titan-data/remote-sdk-go/remote"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func randomData(size int, seed int64) []byte {
+	b := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(b)
+	return b
+}
+
+/*
+ * Returns the number of literal bytes in a delta.
+ */
+func literalBytes(t *testing.T, delta []byte) int {
+	r := bufio.NewReader(bytes.NewReader(delta))
+	total := 0
+	for {
+		line, err := r.ReadString('\n')
+		if !assert.NoError(t, err) {
+			return total
+		}
+		fields := strings.Fields(line)
+		switch fields[0] {
+		case "L":
+			n, _ := strconv.Atoi(fields[1])
+			r.Discard(n)
+			total += n
+		case "E":
+			return total
+		}
+	}
+}
+
+func TestRollingSum(t *testing.T) {
+	data := randomData(100, 1)
+	r := newRollingSum(data[:16])
+	for i := 1; i+16 <= len(data); i++ {
+		r.roll(data[i-1], data[i+15])
+		assert.Equal(t, newRollingSum(data[i:i+16]).sum(), r.sum())
+	}
+}
+
+func TestDeltaRoundTrip(t *testing.T) {
+	if _, err := exec.LookPath("dd"); err != nil {
+		t.Skip("no dd available")
+	}
+	dir := writeRepository(t, map[string]string{})
+	defer os.RemoveAll(dir)
+	basis := randomData(64*20+10, 2)
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "basis"), basis, 0644))
+	_, _, blocks, err := hashFileBlocks(bytes.NewReader(basis), 64)
+	assert.NoError(t, err)
+
+	var modified []byte
+	modified = append(modified, basis[:200]...)
+	modified = append(modified, []byte("inserted")...)
+	modified = append(modified, basis[200:700]...)
+	modified = append(modified, randomData(64, 3)...)
+	modified = append(modified, basis[764:]...)
+	modified = append(modified, []byte("appended")...)
+
+	for _, content := range [][]byte{modified, basis, {}, []byte("short"), randomData(5000, 4)} {
+		var delta bytes.Buffer
+		assert.NoError(t, writeDelta(&delta, bytes.NewReader(content), 64, blocks))
+
+		run = runLocal
+		runInput = runLocalInput
+		target := filepath.Join(dir, "target")
+		err = (&shellStore{}).patchFile(filepath.Join(dir, "basis"), target, bytes.NewReader(delta.Bytes()), 64, 0600)
+		if assert.NoError(t, err) {
+			actual, _ := ioutil.ReadFile(target)
+			assert.Equal(t, content, actual)
+			info, _ := os.Stat(target)
+			assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+		}
+		run = runCommand
+		runInput = runCommandInput
+	}
+
+	var delta bytes.Buffer
+	assert.NoError(t, writeDelta(&delta, bytes.NewReader(modified), 64, blocks))
+	assert.True(t, literalBytes(t, delta.Bytes()) < 300)
+}
+
+func TestDeltaInvalidScript(t *testing.T) {
+	dir := writeRepository(t, map[string]string{"basis": "basis"})
+	defer os.RemoveAll(dir)
+	run = runLocal
+	runInput = runLocalInput
+	err := (&shellStore{}).patchFile(filepath.Join(dir, "basis"), filepath.Join(dir, "target"),
+		strings.NewReader("L 5\nabc"), 64, 0644)
+	if assert.Error(t, err) {
+		assert.NotEqual(t, errNoDelta, err)
+	}
+	run = runCommand
+	runInput = runCommandInput
+}
+
+func TestPushDelta(t *testing.T) {
+	if _, err := exec.LookPath("dd"); err != nil {
+		t.Skip("no dd available")
+	}
+	repo := writeRepository(t, map[string]string{})
+	defer os.RemoveAll(repo)
+	source := writeRepository(t, map[string]string{"small": "small"})
+	defer os.RemoveAll(source)
+	data := randomData(4*deltaBlockSize, 5)
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(source, "data"), data, 0644))
+
+	mockSFTPDial()
+	run = runLocal
+	var sent int
+	runInput = func(conn *ssh.Client, command string, input io.Reader) ([]byte, error) {
+		if strings.HasPrefix(command, "exec 3>") {
+			var delta bytes.Buffer
+			input = io.TeeReader(input, &delta)
+			defer func() { sent += literalBytes(t, delta.Bytes()) }()
+		}
+		return runLocalInput(conn, command, input)
+	}
+	props := pushProperties(repo)
+	props["transport"] = "auto"
+	props["transferMode"] = "delta"
+	params := map[string]interface{}{"password": "password"}
+	err := sshRemote{}.PushCommit(props, params, remote.Commit{Id: "one",
+		Properties: map[string]interface{}{"timestamp": "2019-09-20T13:45:36Z"}}, source, "")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, sent)
+
+	data[deltaBlockSize+10] ^= 0xff
+	data = append(data, []byte("appended")...)
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(source, "data"), data, 0644))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(source, "small"), []byte("changed"), 0644))
+	err = sshRemote{}.PushCommit(props, params, remote.Commit{Id: "two",
+		Properties: map[string]interface{}{"timestamp": "2019-09-20T13:45:37Z"}}, source, "")
+	if assert.NoError(t, err) {
+		content, _ := ioutil.ReadFile(filepath.Join(repo, "two", "data"))
+		assert.Equal(t, data, content)
+		content, _ = ioutil.ReadFile(filepath.Join(repo, "two", "small"))
+		assert.Equal(t, "changed", string(content))
+		assert.True(t, sent > 0 && sent < deltaBlockSize+100)
+	}
+
+	run = runCommand
+	runInput = runCommandInput
+	resetSFTPDial()
+}
+
+func TestPushDeltaChangedBasis(t *testing.T) {
+	if _, err := exec.LookPath("dd"); err != nil {
+		t.Skip("no dd available")
+	}
+	repo := writeRepository(t, map[string]string{})
+	defer os.RemoveAll(repo)
+	source := writeRepository(t, map[string]string{})
+	defer os.RemoveAll(source)
+	data := randomData(4*deltaBlockSize, 6)
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(source, "data"), data, 0644))
+
+	mockSFTPDial()
+	run = runLocal
+	runInput = runLocalInput
+	props := pushProperties(repo)
+	props["transport"] = "auto"
+	props["transferMode"] = "delta"
+	params := map[string]interface{}{"password": "password"}
+	err := sshRemote{}.PushCommit(props, params, remote.Commit{Id: "one",
+		Properties: map[string]interface{}{"timestamp": "2019-09-20T13:45:36Z"}}, source, "")
+	assert.NoError(t, err)
+
+	basis := filepath.Join(repo, "one", "data")
+	changed := append([]byte{}, data...)
+	changed[10] ^= 0xff
+	assert.NoError(t, ioutil.WriteFile(basis, changed, 0644))
+	data = append(data, []byte("appended")...)
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(source, "data"), data, 0644))
+	err = sshRemote{}.PushCommit(props, params, remote.Commit{Id: "two",
+		Properties: map[string]interface{}{"timestamp": "2019-09-20T13:45:37Z"}}, source, "")
+	if assert.NoError(t, err) {
+		content, _ := ioutil.ReadFile(filepath.Join(repo, "two", "data"))
+		assert.Equal(t, data, content)
+		_, err = sshRemote{}.VerifyCommit(props, params, "two")
+		assert.NoError(t, err)
+	}
+
+	run = runCommand
+	runInput = runCommandInput
+	resetSFTPDial()
+}
+
+func TestPushDeltaNoGNUHead(t *testing.T) {
+	repo := writeRepository(t, map[string]string{})
+	defer os.RemoveAll(repo)
+	source := writeRepository(t, map[string]string{})
+	defer os.RemoveAll(source)
+	data := randomData(2*deltaBlockSize, 7)
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(source, "data"), data, 0644))
+
+	mockSFTPDial()
+	run = func(conn *ssh.Client, command string) ([]byte, error) {
+		if command == "head --version" {
+			return []byte("BusyBox v1.31.1 multi-call binary.\n"), nil
+		}
+		return runLocal(conn, command)
+	}
+	var deltas int
+	runInput = func(conn *ssh.Client, command string, input io.Reader) ([]byte, error) {
+		if strings.HasPrefix(command, "exec 3>") {
+			deltas++
+		}
+		return runLocalInput(conn, command, input)
+	}
+	props := pushProperties(repo)
+	props["transport"] = "auto"
+	props["transferMode"] = "delta"
+	params := map[string]interface{}{"password": "password"}
+	for i, id := range []string{"one", "two"} {
+		data[i] ^= 0xff
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(source, "data"), data, 0644))
+		err := sshRemote{}.PushCommit(props, params, remote.Commit{Id: id,
+			Properties: map[string]interface{}{"timestamp": "2019-09-20T13:45:3" + strconv.Itoa(i) + "Z"}}, source, "")
+		if assert.NoError(t, err) {
+			content, _ := ioutil.ReadFile(filepath.Join(repo, id, "data"))
+			assert.Equal(t, data, content)
+		}
+	}
+	assert.Equal(t, 0, deltas)
+
+	run = runCommand
+	runInput = runCommandInput
+	resetSFTPDial()
+}
+
+func TestUploadDeltaSFTP(t *testing.T) {
+	repo := writeRepository(t, map[string]string{"basis/file": "content"})
+	defer os.RemoveAll(repo)
+	source := writeRepository(t, map[string]string{"file": "changed"})
+	defer os.RemoveAll(source)
+	store, done := localStore(t, repo)
+	defer done()
+
+	basis := &deltaBasis{dir: filepath.Join(repo, "basis"), blockSize: deltaBlockSize,
+		files: map[string]manifestFile{"file": {Name: "file"}}}
+	state := &transferState{Direction: directionPush, Commit: "id"}
+	assert.NoError(t, os.Mkdir(filepath.Join(repo, "id"), 0755))
+	if assert.NoError(t, uploadDir(store, source, filepath.Join(repo, "id"), state, basis)) {
+		content, _ := ioutil.ReadFile(filepath.Join(repo, "id", "file"))
+		assert.Equal(t, "changed", string(content))
+	}
+}
+
+func TestTransferModeProperty(t *testing.T) {
+	r := remote.Get("ssh")
+	props, err := r.FromURL("ssh://user@host/path", map[string]string{"transferMode": "delta"})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "delta", props["transferMode"])
+		assert.NoError(t, r.ValidateRemote(props))
+		_, extra, err := r.ToURL(props)
+		if assert.NoError(t, err) {
+			assert.Equal(t, "delta", extra["transferMode"])
+		}
+	}
+}
+
+func TestTransferModeBadProperty(t *testing.T) {
+	r := remote.Get("ssh")
+	_, err := r.FromURL("ssh://user@host/path", map[string]string{"transferMode": "rsync"})
+	assert.Error(t, err)
+	_, err = r.FromURL("ssh://user@host/path", map[string]string{"transferMode": "delta", "transport": "sftp"})
+	assert.Error(t, err)
+	err = r.ValidateRemote(map[string]interface{}{"username": "username", "address": "host", "path": "/path",
+		"transferMode": "delta", "transport": "sftp"})
+	assert.Error(t, err)
+}
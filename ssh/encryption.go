@@ -0,0 +1,518 @@
+/*
+ * Copyright The Titan Project Contributors.
+ */
+package ssh
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/titan-data/remote-sdk-go/remote"
+	"golang.org/x/crypto/scrypt"
+	"os"
+	"sort"
+	"strings"
+)
+
+const (
+	encryptionNone   = "none"
+	encryptionAESGCM = "aes-gcm"
+)
+
+/*
+ * Name of the file within the repository that holds its master key, encrypted with a key derived from the
+ * passphrase. It is hidden, so it never shows up as a commit.
+ */
+const encryptionFile = ".encryption.json"
+
+/*
+ * Name of the field of metadata.json that holds the encrypted fields of a commit.
+ */
+const encryptedField = "encrypted"
+
+/*
+ * Fields of commit metadata that are left in cleartext by default, so that commits can be listed, sorted and filtered
+ * by tag without the passphrase.
+ */
+var defaultCleartextFields = []string{"tags", "timestamp"}
+
+/*
+ * Cost of deriving the key from the passphrase. The parameters are stored along with the key, so this only applies to
+ * new repositories.
+ */
+var scryptCost = 1 << 15
+
+func getEncryption(properties map[string]interface{}) string {
+	if encryption, ok := properties["encryption"].(string); ok && encryption != "" {
+		return encryption
+	}
+	return encryptionNone
+}
+
+/*
+ * Validate the 'encryption' property. Only the objects layout can be encrypted, since it hides the names and sizes
+ * of files along with their contents.
+ */
+func validateEncryption(encryption string, layout string) error {
+	if encryption != encryptionNone && encryption != encryptionAESGCM {
+		return fmt.Errorf("invalid encryption '%s', must be one of '%s' or '%s'", encryption, encryptionNone,
+			encryptionAESGCM)
+	}
+	if encryption == encryptionAESGCM && layout != layoutObjects {
+		return fmt.Errorf("encryption requires the '%s' layout", layoutObjects)
+	}
+	return nil
+}
+
+/*
+ * Returns the fields of commit metadata that are stored in cleartext, from the comma-separated 'cleartextFields'
+ * property. The value 'none' encrypts all fields.
+ */
+func getCleartextFields(properties map[string]interface{}) []string {
+	value, ok := properties["cleartextFields"].(string)
+	if !ok || value == "" {
+		return defaultCleartextFields
+	}
+	if value == "none" {
+		return []string{}
+	}
+	return strings.Split(value, ",")
+}
+
+func validateCleartextFields(value string) error {
+	if value == "none" {
+		return nil
+	}
+	for _, field := range strings.Split(value, ",") {
+		if field == "" || field == encryptedField {
+			return fmt.Errorf("invalid cleartext fields '%s'", value)
+		}
+	}
+	return nil
+}
+
+/*
+ * The master key of a repository, as stored in the encryption file. The key itself is encrypted with a key derived
+ * from the passphrase with scrypt.
+ */
+type encryptionConfig struct {
+	Version int    `json:"version"`
+	N       int    `json:"n"`
+	R       int    `json:"r"`
+	P       int    `json:"p"`
+	Salt    []byte `json:"salt"`
+	Key     []byte `json:"key"`
+}
+
+/*
+ * Keys derived from the master key: an AES-256-GCM key for encryption, and a key for deriving the nonces of chunks.
+ */
+type cipherKey struct {
+	aead     cipher.AEAD
+	nonceKey []byte
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func newCipherKey(master []byte) (*cipherKey, error) {
+	aead, err := newAEAD(master[:32])
+	if err != nil {
+		return nil, err
+	}
+	return &cipherKey{aead: aead, nonceKey: master[32:]}, nil
+}
+
+/*
+ * Encrypt data with a random nonce, which precedes the ciphertext. The additional data binds the ciphertext to where
+ * it is stored, so that it cannot be swapped with that of another commit.
+ */
+func sealWith(aead cipher.AEAD, plaintext []byte, additional string) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		panic(err)
+	}
+	return aead.Seal(nonce, nonce, plaintext, []byte(additional))
+}
+
+func openWith(aead cipher.AEAD, ciphertext []byte, additional string) ([]byte, error) {
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, errors.New("ciphertext is too short")
+	}
+	size := aead.NonceSize()
+	return aead.Open(nil, ciphertext[:size], ciphertext[size:], []byte(additional))
+}
+
+func (k *cipherKey) seal(plaintext []byte, additional string) []byte {
+	return sealWith(k.aead, plaintext, additional)
+}
+
+func (k *cipherKey) open(ciphertext []byte, additional string) ([]byte, error) {
+	plaintext, err := openWith(k.aead, ciphertext, additional)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt %s: %w", additional, err)
+	}
+	return plaintext, nil
+}
+
+/*
+ * Encrypt a chunk. The nonce is derived from the contents of the chunk, so identical chunks encrypt to identical
+ * objects, and still deduplicate. This reveals which chunks are identical, which the object names do anyway.
+ */
+func (k *cipherKey) sealChunk(chunk []byte) []byte {
+	mac := hmac.New(sha256.New, k.nonceKey)
+	mac.Write(chunk)
+	nonce := mac.Sum(nil)[:k.aead.NonceSize()]
+	return k.aead.Seal(nonce, nonce, chunk, nil)
+}
+
+func (k *cipherKey) openChunk(object []byte) ([]byte, error) {
+	return openWith(k.aead, object, "")
+}
+
+/*
+ * Access to the master key of a repository, which is only read, and its key derived, when it is first needed.
+ */
+type keyring struct {
+	store      remoteStore
+	path       string
+	passphrase string
+	key        *cipherKey
+}
+
+func newKeyring(store remoteStore, properties map[string]interface{}, parameters map[string]interface{}) *keyring {
+	passphrase, _ := parameters["encryptionPassphrase"].(string)
+	return &keyring{store: store, path: properties["path"].(string), passphrase: passphrase}
+}
+
+/*
+ * Returns the key of the repository, failing if it has none.
+ */
+func (k *keyring) get() (*cipherKey, error) {
+	return k.load(false)
+}
+
+/*
+ * Returns the key of the repository, creating it if the repository has none, so that the first encrypted push creates
+ * the key, protected by the encryptionPassphrase parameter. This must be called while holding the repository lock.
+ */
+func (k *keyring) create() (*cipherKey, error) {
+	return k.load(true)
+}
+
+func (k *keyring) load(create bool) (*cipherKey, error) {
+	if k.key != nil {
+		return k.key, nil
+	}
+	if k.passphrase == "" {
+		return nil, errors.New("repository is encrypted, the encryptionPassphrase parameter is required")
+	}
+	file := k.path + "/" + encryptionFile
+	content, err := k.store.readFile(file)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	var master []byte
+	if err == nil {
+		config := &encryptionConfig{}
+		if err := json.Unmarshal(content, config); err != nil {
+			return nil, fmt.Errorf("invalid encryption file: %w", err)
+		}
+		if config.Version != 1 {
+			return nil, fmt.Errorf("unsupported encryption version %d", config.Version)
+		}
+		aead, err := k.passphraseKey(config)
+		if err != nil {
+			return nil, err
+		}
+		if master, err = openWith(aead, config.Key, "master key"); err != nil || len(master) != 64 {
+			return nil, errors.New("incorrect encryption passphrase")
+		}
+	} else if create {
+		config := &encryptionConfig{Version: 1, N: scryptCost, R: 8, P: 1, Salt: make([]byte, 32)}
+		master = make([]byte, 64)
+		if _, err := rand.Read(config.Salt); err != nil {
+			return nil, err
+		}
+		if _, err := rand.Read(master); err != nil {
+			return nil, err
+		}
+		aead, err := k.passphraseKey(config)
+		if err != nil {
+			return nil, err
+		}
+		config.Key = sealWith(aead, master, "master key")
+		content, err := json.Marshal(config)
+		if err != nil {
+			return nil, err
+		}
+		if err := writeFileAtomic(k.store, file, content, 0600); err != nil {
+			return nil, fmt.Errorf("failed to write encryption file: %w", err)
+		}
+	} else {
+		return nil, errors.New("repository has no encryption key")
+	}
+
+	if k.key, err = newCipherKey(master); err != nil {
+		return nil, err
+	}
+	return k.key, nil
+}
+
+func (k *keyring) passphraseKey(config *encryptionConfig) (cipher.AEAD, error) {
+	key, err := scrypt.Key([]byte(k.passphrase), config.Salt, config.N, config.R, config.P, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid encryption parameters: %w", err)
+	}
+	return newAEAD(key)
+}
+
+/*
+ * The encrypted part of commit metadata, which lists the fields that were left in cleartext.
+ */
+type metadataEnvelope struct {
+	Fields []string `json:"fields"`
+	Data   []byte   `json:"data"`
+}
+
+/*
+ * Encrypt the properties of a commit other than the cleartext fields, which stay readable without the passphrase, so
+ * that commits can still be listed and filtered by tag. The cleartext fields are authenticated along with the sealed
+ * ones, so they cannot be changed without the key either.
+ */
+func sealMetadata(key *cipherKey, commitId string, properties map[string]interface{},
+	cleartext []string) ([]byte, error) {
+	if _, ok := properties[encryptedField]; ok {
+		return nil, fmt.Errorf("commit metadata cannot contain a '%s' field when encrypted", encryptedField)
+	}
+	clear := map[string]interface{}{}
+	sealed := map[string]interface{}{}
+	for name, value := range properties {
+		sealed[name] = value
+	}
+	for _, name := range cleartext {
+		if value, ok := sealed[name]; ok {
+			clear[name] = value
+			delete(sealed, name)
+		}
+	}
+	content, err := json.Marshal(sealed)
+	if err != nil {
+		return nil, err
+	}
+	additional, err := metadataAdditional(commitId, clear, cleartext)
+	if err != nil {
+		return nil, err
+	}
+	clear[encryptedField] = metadataEnvelope{Fields: cleartext, Data: sealWith(key.aead, content, additional)}
+	return json.Marshal(clear)
+}
+
+/*
+ * Returns the additional data of sealed metadata, which binds it to its commit, to the list of cleartext fields and to
+ * the properties left in cleartext beside it. The properties are encoded as json.Marshal does once they are decoded,
+ * which sorts the keys of objects and gives each number a single form.
+ */
+func metadataAdditional(commitId string, properties map[string]interface{}, fields []string) (string, error) {
+	clear := map[string]interface{}{}
+	for name, value := range properties {
+		if name != encryptedField {
+			clear[name] = value
+		}
+	}
+	content, err := json.Marshal(map[string]interface{}{"fields": fields, "properties": clear})
+	if err != nil {
+		return "", err
+	}
+	var decoded interface{}
+	if err := json.Unmarshal(content, &decoded); err != nil {
+		return "", err
+	}
+	if content, err = json.Marshal(decoded); err != nil {
+		return "", err
+	}
+	return "metadata of " + commitId + " " + string(content), nil
+}
+
+/*
+ * Decrypt the sealed part of metadata, failing if either it or the properties left in cleartext have been changed.
+ */
+func openEnvelope(key *cipherKey, commitId string, properties map[string]interface{},
+	envelope *metadataEnvelope) ([]byte, error) {
+	additional, err := metadataAdditional(commitId, properties, envelope.Fields)
+	if err != nil {
+		return nil, err
+	}
+	content, err := openWith(key.aead, envelope.Data, additional)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt metadata of %s, it or its cleartext fields have been modified: %w",
+			commitId, err)
+	}
+	return content, nil
+}
+
+/*
+ * Returns the envelope of encrypted metadata, or nil if the metadata is not encrypted.
+ */
+func parseEnvelope(properties map[string]interface{}) (*metadataEnvelope, error) {
+	raw, ok := properties[encryptedField]
+	if !ok {
+		return nil, nil
+	}
+	content, err := json.Marshal(raw)
+	if err != nil {
+		return nil, err
+	}
+	envelope := &metadataEnvelope{}
+	if err := json.Unmarshal(content, envelope); err != nil {
+		return nil, fmt.Errorf("invalid encrypted metadata: %w", err)
+	}
+	return envelope, nil
+}
+
+/*
+ * Decrypt the metadata of a commit in place, checking that its cleartext fields are the ones it was sealed with.
+ * Without a passphrase, only the cleartext fields are kept, and they cannot be checked.
+ */
+func openMetadata(keys *keyring, commit *remote.Commit) error {
+	envelope, err := parseEnvelope(commit.Properties)
+	if envelope == nil || err != nil {
+		return err
+	}
+	if keys == nil || keys.passphrase == "" {
+		delete(commit.Properties, encryptedField)
+		return nil
+	}
+	key, err := keys.get()
+	if err != nil {
+		return err
+	}
+	content, err := openEnvelope(key, commit.Id, commit.Properties, envelope)
+	if err != nil {
+		return err
+	}
+	delete(commit.Properties, encryptedField)
+	sealed := map[string]interface{}{}
+	if err := json.Unmarshal(content, &sealed); err != nil {
+		return fmt.Errorf("invalid encrypted metadata: %w", err)
+	}
+	for name, value := range sealed {
+		commit.Properties[name] = value
+	}
+	return nil
+}
+
+/*
+ * Version of the manifests of encrypted commits, which hold the manifest of the commit in sealed form.
+ */
+const encryptedManifestVersion = 3
+
+/*
+ * Seal the manifest of a commit in the objects layout. The sealed manifest still lists the objects of the commit, so
+ * that commits can be verified and garbage collected without the passphrase, along with the root hash of its files.
+ */
+func sealManifest(key *cipherKey, commitId string, m *manifest) (*manifest, error) {
+	content, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	sealed := &manifest{Version: encryptedManifestVersion, Files: []manifestFile{}, Root: m.Root,
+		Sealed: key.seal(content, "manifest of "+commitId)}
+	for hash := range m.objects() {
+		sealed.Chunks = append(sealed.Chunks, hash)
+	}
+	sort.Strings(sealed.Chunks)
+	return sealed, nil
+}
+
+/*
+ * Returns the manifest that was sealed in the manifest of an encrypted commit.
+ */
+func (m *manifest) unseal(key *cipherKey, commitId string) (*manifest, error) {
+	content, err := key.open(m.Sealed, "manifest of "+commitId)
+	if err != nil {
+		return nil, err
+	}
+	inner := &manifest{}
+	if err := json.Unmarshal(content, inner); err != nil {
+		return nil, fmt.Errorf("invalid manifest: %w", err)
+	}
+	if inner.Version != objectsManifestVersion || inner.Root != m.Root {
+		return nil, errors.New("invalid manifest: sealed manifest does not match")
+	}
+	return inner, nil
+}
+
+/*
+ * Apply tag changes to the raw contents of metadata.json, as with applyTags(), decrypting and sealing them again if
+ * the metadata is encrypted. This needs the key even if the tags are left in cleartext, since the cleartext fields
+ * are authenticated by the sealed data.
+ */
+func applySealedTags(keys *keyring, commitId string, content []byte, add map[string]string,
+	remove []string) ([]byte, error) {
+	metadata, err := decodeMetadata(content)
+	if err != nil {
+		return nil, err
+	}
+	envelope, err := parseEnvelope(metadata)
+	if err != nil {
+		return nil, err
+	}
+	if envelope == nil {
+		return applyTags(content, add, remove)
+	}
+
+	key, err := keys.get()
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := openEnvelope(key, commitId, metadata, envelope)
+	if err != nil {
+		return nil, err
+	}
+	clearTags := false
+	for _, field := range envelope.Fields {
+		if field == "tags" {
+			clearTags = true
+		}
+	}
+	if clearTags {
+		if content, err = applyTags(content, add, remove); err != nil {
+			return nil, err
+		}
+		if metadata, err = decodeMetadata(content); err != nil {
+			return nil, err
+		}
+	} else if sealed, err = applyTags(sealed, add, remove); err != nil {
+		return nil, err
+	}
+	additional, err := metadataAdditional(commitId, metadata, envelope.Fields)
+	if err != nil {
+		return nil, err
+	}
+	envelope.Data = sealWith(key.aead, sealed, additional)
+	metadata[encryptedField] = envelope
+	return json.Marshal(metadata)
+}
+
+func decodeMetadata(content []byte) (map[string]interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.UseNumber()
+	metadata := map[string]interface{}{}
+	if err := decoder.Decode(&metadata); err != nil {
+		return nil, fmt.Errorf("failed to parse metadata: %w", err)
+	}
+	return metadata, nil
+}
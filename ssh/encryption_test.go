@@ -0,0 +1,280 @@
+/*
+ * Copyright The Titan Project Contributors.
+ */
+package ssh
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/titan-data/remote-sdk-go/remote"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func encryptedProperties(repo string) map[string]interface{} {
+	props := pushProperties(repo)
+	props["layout"] = "objects"
+	props["encryption"] = "aes-gcm"
+	return props
+}
+
+func pushEncrypted(t *testing.T, repo string) map[string]interface{} {
+	dir, source := writeSourceData(t)
+	defer os.RemoveAll(dir)
+	props := encryptedProperties(repo)
+	params := map[string]interface{}{"password": "password", "encryptionPassphrase": "secret"}
+	commit := remote.Commit{Id: "id", Properties: map[string]interface{}{"timestamp": "2019-09-20T13:45:38Z",
+		"message": "confidential", "tags": map[string]interface{}{"a": "b"}}}
+	assert.NoError(t, sshRemote{}.PushCommit(props, params, commit, source, ""))
+	return props
+}
+
+func TestEncryptedRoundTrip(t *testing.T) {
+	scryptCost = 1 << 10
+	for _, transport := range []string{"sftp", "shell"} {
+		repo := writeRepository(t, map[string]string{})
+		local := writeRepository(t, map[string]string{})
+
+		mockSFTPDial()
+		run = runLocal
+		runInput = runLocalInput
+		props := encryptedProperties(repo)
+		props["transport"] = transport
+		dir, source := writeSourceData(t)
+		params := map[string]interface{}{"password": "password", "encryptionPassphrase": "secret"}
+		commit := remote.Commit{Id: "id", Properties: map[string]interface{}{"message": "confidential"}}
+		assert.NoError(t, sshRemote{}.PushCommit(props, params, commit, source, ""), transport)
+
+		filepath.Walk(repo, func(file string, info os.FileInfo, err error) error {
+			if err == nil && info.Mode().IsRegular() {
+				content, _ := ioutil.ReadFile(file)
+				assert.False(t, bytes.Contains(content, []byte("content")), file)
+				assert.False(t, bytes.Contains(content, []byte("confidential")), file)
+			}
+			return nil
+		})
+
+		pulled, err := sshRemote{}.PullCommit(props, params, "id", filepath.Join(local, "dest"), "")
+		if assert.NoError(t, err, transport) {
+			assert.Equal(t, "confidential", pulled.Properties["message"])
+			checkCommitData(t, filepath.Join(local, "dest"))
+		}
+		root, err := sshRemote{}.VerifyCommit(props, map[string]interface{}{"password": "password"}, "id")
+		if assert.NoError(t, err, transport) {
+			assert.Len(t, root, 64)
+		}
+
+		run = runCommand
+		runInput = runCommandInput
+		resetSFTPDial()
+		os.RemoveAll(dir)
+		os.RemoveAll(repo)
+		os.RemoveAll(local)
+	}
+}
+
+func TestEncryptedMetadata(t *testing.T) {
+	scryptCost = 1 << 10
+	repo := writeRepository(t, map[string]string{})
+	defer os.RemoveAll(repo)
+	mockSFTPDial()
+	props := pushEncrypted(t, repo)
+
+	value := "b"
+	tags := []remote.Tag{{Key: "a", Value: &value}}
+	commits, err := sshRemote{}.ListCommits(props, map[string]interface{}{"password": "password"}, tags)
+	if assert.NoError(t, err) && assert.Len(t, commits, 1) {
+		assert.Equal(t, map[string]interface{}{"timestamp": "2019-09-20T13:45:38Z",
+			"tags": map[string]interface{}{"a": "b"}}, commits[0].Properties)
+	}
+	params := map[string]interface{}{"password": "password", "encryptionPassphrase": "secret"}
+	commit, err := sshRemote{}.GetCommit(props, params, "id")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "confidential", commit.Properties["message"])
+	}
+	_, err = sshRemote{}.GetCommit(props, map[string]interface{}{"password": "password",
+		"encryptionPassphrase": "wrong"}, "id")
+	assert.Error(t, err)
+	_, err = sshRemote{}.PullCommit(props, map[string]interface{}{"password": "password"}, "id",
+		filepath.Join(repo, "dest"), "")
+	assert.Error(t, err)
+	resetSFTPDial()
+}
+
+func TestEncryptedTags(t *testing.T) {
+	scryptCost = 1 << 10
+	repo := writeRepository(t, map[string]string{})
+	defer os.RemoveAll(repo)
+	mockSFTPDial()
+	props := pushEncrypted(t, repo)
+	params := map[string]interface{}{"password": "password"}
+
+	// Cleartext tags are sealed along with the rest, so they need the passphrase too
+	_, err := sshRemote{}.UpdateTags(props, params, "id", map[string]string{"c": "d"}, nil)
+	assert.Error(t, err)
+	params["encryptionPassphrase"] = "secret"
+	commit, err := sshRemote{}.UpdateTags(props, params, "id", map[string]string{"c": "d"}, nil)
+	if assert.NoError(t, err) {
+		assert.Equal(t, map[string]interface{}{"a": "b", "c": "d"}, commit.Properties["tags"])
+		assert.Equal(t, "confidential", commit.Properties["message"])
+	}
+	content, _ := ioutil.ReadFile(filepath.Join(repo, "id", "metadata.json"))
+	assert.Contains(t, string(content), "\"c\":\"d\"")
+
+	props["cleartextFields"] = "none"
+	dir, source := writeSourceData(t)
+	defer os.RemoveAll(dir)
+	assert.NoError(t, sshRemote{}.PushCommit(props, params, remote.Commit{Id: "sealed",
+		Properties: map[string]interface{}{"tags": map[string]interface{}{"a": "b"}}}, source, ""))
+	_, err = sshRemote{}.UpdateTags(props, map[string]interface{}{"password": "password"}, "sealed",
+		map[string]string{"c": "d"}, nil)
+	assert.Error(t, err)
+	commit, err = sshRemote{}.UpdateTags(props, params, "sealed", map[string]string{"c": "d"}, []string{"a"})
+	if assert.NoError(t, err) {
+		assert.Equal(t, map[string]interface{}{"c": "d"}, commit.Properties["tags"])
+	}
+	content, _ = ioutil.ReadFile(filepath.Join(repo, "sealed", "metadata.json"))
+	assert.NotContains(t, string(content), "tags")
+	resetSFTPDial()
+}
+
+func TestEncryptedMetadataModified(t *testing.T) {
+	scryptCost = 1 << 10
+	repo := writeRepository(t, map[string]string{})
+	defer os.RemoveAll(repo)
+	mockSFTPDial()
+	props := pushEncrypted(t, repo)
+	params := map[string]interface{}{"password": "password", "encryptionPassphrase": "secret"}
+	file := filepath.Join(repo, "id", "metadata.json")
+	original, _ := ioutil.ReadFile(file)
+
+	modify := []func(metadata map[string]interface{}){
+		func(metadata map[string]interface{}) { metadata["tags"] = map[string]interface{}{"a": "c"} },
+		func(metadata map[string]interface{}) { delete(metadata, "tags") },
+		func(metadata map[string]interface{}) { metadata["timestamp"] = "2000-01-01T00:00:00Z" },
+		func(metadata map[string]interface{}) { metadata["message"] = "forged" },
+		func(metadata map[string]interface{}) {
+			metadata[encryptedField].(map[string]interface{})["fields"] = []string{"tags", "timestamp", "message"}
+		},
+	}
+	for i, fn := range modify {
+		metadata := map[string]interface{}{}
+		assert.NoError(t, json.Unmarshal(original, &metadata))
+		fn(metadata)
+		content, _ := json.Marshal(metadata)
+		assert.NoError(t, ioutil.WriteFile(file, content, 0644))
+
+		_, err := sshRemote{}.GetCommit(props, params, "id")
+		assert.Error(t, err, i)
+		_, err = sshRemote{}.ListCommits(props, params, nil)
+		assert.Error(t, err, i)
+		_, err = sshRemote{}.UpdateTags(props, params, "id", map[string]string{"c": "d"}, nil)
+		assert.Error(t, err, i)
+		_, err = sshRemote{}.GetCommit(props, map[string]interface{}{"password": "password"}, "id")
+		assert.NoError(t, err, i)
+	}
+
+	// Reordering keys or reformatting the file is not a change
+	metadata := map[string]interface{}{}
+	assert.NoError(t, json.Unmarshal(original, &metadata))
+	content, _ := json.MarshalIndent(metadata, "", "    ")
+	assert.NoError(t, ioutil.WriteFile(file, content, 0644))
+	commit, err := sshRemote{}.GetCommit(props, params, "id")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "confidential", commit.Properties["message"])
+	}
+	resetSFTPDial()
+}
+
+func TestEncryptedGarbageCollection(t *testing.T) {
+	scryptCost = 1 << 10
+	repo := writeRepository(t, map[string]string{})
+	defer os.RemoveAll(repo)
+	mockSFTPDial()
+	props := pushEncrypted(t, repo)
+	objects := countObjects(t, repo)
+	age(t, repo, 48*time.Hour)
+
+	report, err := sshRemote{}.CollectGarbage(props, map[string]interface{}{"password": "password"}, GCOptions{})
+	if assert.NoError(t, err) {
+		assert.Empty(t, report.Objects)
+		assert.Equal(t, objects, report.Referenced)
+	}
+	resetSFTPDial()
+}
+
+/*
+ * A store that can't list files, as when listing fails on the remote host.
+ */
+type unlistableStore struct {
+	remoteStore
+}
+
+func (u *unlistableStore) listFiles(root string, depth int) ([]treeEntry, error) {
+	return nil, errors.New("cannot list files")
+}
+
+func TestKeyringReadsKeyFile(t *testing.T) {
+	scryptCost = 1 << 10
+	repo := writeRepository(t, map[string]string{})
+	defer os.RemoveAll(repo)
+	store, done := localStore(t, repo)
+	defer done()
+
+	props := encryptedProperties(repo)
+	params := map[string]interface{}{"encryptionPassphrase": "secret"}
+	_, err := newKeyring(&unlistableStore{store}, props, params).get()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "no encryption key")
+	}
+	created, err := newKeyring(&unlistableStore{store}, props, params).create()
+	if assert.NoError(t, err) {
+		key, err := newKeyring(&unlistableStore{store}, props, params).get()
+		if assert.NoError(t, err) {
+			assert.Equal(t, created, key)
+		}
+	}
+}
+
+func TestEncryptionRequiresPassphrase(t *testing.T) {
+	repo := writeRepository(t, map[string]string{})
+	defer os.RemoveAll(repo)
+	err := sshRemote{}.PushCommit(encryptedProperties(repo), map[string]interface{}{"password": "password"},
+		remote.Commit{Id: "id"}, "", "")
+	assert.Error(t, err)
+}
+
+func TestEncryptionProperty(t *testing.T) {
+	r := remote.Get("ssh")
+	props, err := r.FromURL("ssh://user@host/path", map[string]string{"layout": "objects", "encryption": "aes-gcm",
+		"cleartextFields": "tags"})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "aes-gcm", props["encryption"])
+		assert.NoError(t, r.ValidateRemote(props))
+		_, extra, err := r.ToURL(props)
+		if assert.NoError(t, err) {
+			assert.Equal(t, "aes-gcm", extra["encryption"])
+			assert.Equal(t, "tags", extra["cleartextFields"])
+		}
+	}
+	assert.Equal(t, []string{"tags"}, getCleartextFields(props))
+	assert.NoError(t, r.ValidateParameters(map[string]interface{}{"encryptionPassphrase": "secret"}))
+}
+
+func TestEncryptionBadProperty(t *testing.T) {
+	r := remote.Get("ssh")
+	_, err := r.FromURL("ssh://user@host/path", map[string]string{"encryption": "aes-gcm"})
+	assert.Error(t, err)
+	_, err = r.FromURL("ssh://user@host/path", map[string]string{"layout": "objects", "encryption": "rot13"})
+	assert.Error(t, err)
+	_, err = r.FromURL("ssh://user@host/path", map[string]string{"cleartextFields": "tags,encrypted"})
+	assert.Error(t, err)
+	err = r.ValidateRemote(map[string]interface{}{"username": "username", "address": "host", "path": "/path",
+		"encryption": "aes-gcm"})
+	assert.Error(t, err)
+}
@@ -0,0 +1,100 @@
+/*
+ * Copyright The Titan Project Contributors.
+ */
+package ssh
+
+import (
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"sync"
+)
+
+/*
+ * The default number of concurrent sessions per connection, matching the OpenSSH server's default MaxSessions.
+ */
+const defaultMaxSessions = 10
+
+/*
+ * Returns the 'maxSessions' property, which should be set to the server's MaxSessions if it has been lowered from the
+ * default.
+ */
+func getMaxSessions(properties map[string]interface{}) (int, error) {
+	raw, ok := properties["maxSessions"]
+	if !ok {
+		return defaultMaxSessions, nil
+	}
+	max := 0
+	switch v := raw.(type) {
+	case int:
+		max = v
+	case float32:
+		max = int(v)
+	case float64:
+		max = int(v)
+	}
+	if max <= 0 {
+		return 0, fmt.Errorf("invalid maxSessions '%v', must be a positive integer", raw)
+	}
+	return max, nil
+}
+
+/*
+ * Returns true if the server refused to open a new channel, as OpenSSH does once MaxSessions is reached.
+ */
+func isChannelRejected(err error) bool {
+	var openErr *ssh.OpenChannelError
+	return errors.As(err, &openErr)
+}
+
+/*
+ * Read the metadata of each commit using up to 'workers' concurrent operations multiplexed over a single
+ * connection. Reads that fail because the server refused another session are retried one at a time once the
+ * concurrent pass has finished. Commits whose metadata cannot be read are omitted, and the order of the remaining
+ * commits matches the order of the ids given.
+ */
+func fetchMetadata(ids []string, workers int, read func(id string) ([]byte, error)) []commitMetadata {
+	if workers < 1 {
+		workers = 1
+	}
+	results := make([][]byte, len(ids))
+	rejected := make([]bool, len(ids))
+
+	work := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers && w < len(ids); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				content, err := read(ids[i])
+				if err == nil {
+					results[i] = content
+				} else if isChannelRejected(err) {
+					rejected[i] = true
+				}
+			}
+		}()
+	}
+	for i := range ids {
+		work <- i
+	}
+	close(work)
+	wg.Wait()
+
+	for i := range ids {
+		if rejected[i] {
+			if content, err := read(ids[i]); err == nil {
+				results[i] = content
+			}
+		}
+	}
+
+	var ret []commitMetadata
+	for i, id := range ids {
+		if results[i] != nil {
+			ret = append(ret, commitMetadata{id: id, content: results[i]})
+		}
+	}
+	return ret
+}
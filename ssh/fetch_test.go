@@ -0,0 +1,119 @@
+/*
+ * Copyright The Titan Project Contributors.
+ */
+package ssh
+
+import (
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/titan-data/remote-sdk-go/remote"
+	"golang.org/x/crypto/ssh"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFetchMetadataConcurrency(t *testing.T) {
+	var ids []string
+	for i := 0; i < 20; i++ {
+		ids = append(ids, fmt.Sprintf("%02d", i))
+	}
+	var active, peak int32
+	metadata := fetchMetadata(ids, 3, func(id string) ([]byte, error) {
+		n := atomic.AddInt32(&active, 1)
+		for {
+			p := atomic.LoadInt32(&peak)
+			if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+				break
+			}
+		}
+		time.Sleep(2 * time.Millisecond)
+		atomic.AddInt32(&active, -1)
+		if id == "05" {
+			return nil, errors.New("missing")
+		}
+		return []byte(id), nil
+	})
+
+	assert.True(t, peak > 1)
+	assert.True(t, peak <= 3)
+	if assert.Len(t, metadata, 19) {
+		for i, m := range metadata {
+			assert.Equal(t, m.id, string(m.content))
+			if i > 0 {
+				assert.True(t, metadata[i-1].id < m.id)
+			}
+		}
+	}
+}
+
+func TestFetchMetadataRejected(t *testing.T) {
+	ids := []string{"a", "b", "c", "d", "e", "f"}
+	var active int32
+	metadata := fetchMetadata(ids, 6, func(id string) ([]byte, error) {
+		defer atomic.AddInt32(&active, -1)
+		if atomic.AddInt32(&active, 1) > 2 {
+			return nil, &ssh.OpenChannelError{Reason: ssh.Prohibited, Message: "open failed"}
+		}
+		time.Sleep(2 * time.Millisecond)
+		return []byte(id), nil
+	})
+	assert.Len(t, metadata, 6)
+}
+
+func TestShellListMetadataFallback(t *testing.T) {
+	run = func(conn *ssh.Client, command string) (bytes []byte, err error) {
+		switch command {
+		case "ls -1 -- /path":
+			return []byte("one\ntwo\n..\nthree\n"), nil
+		case "cat -- /path/one/metadata.json":
+			return []byte("{\"timestamp\": \"2019-09-20T13:45:36Z\"}"), nil
+		case "cat -- /path/two/metadata.json":
+			return []byte("{\"timestamp\": \"2019-09-20T13:45:37Z\"}"), nil
+		}
+		return nil, errors.New("error")
+	}
+	metadata, err := (&shellStore{maxSessions: 2}).listMetadata("/path")
+	if assert.NoError(t, err) {
+		assert.Len(t, metadata, 2)
+		assert.Equal(t, "one", metadata[0].id)
+		assert.Equal(t, "two", metadata[1].id)
+	}
+	run = runCommand
+}
+
+func TestMaxSessionsProperty(t *testing.T) {
+	r := remote.Get("ssh")
+	props, err := r.FromURL("ssh://user@host/path", map[string]string{"maxSessions": "4"})
+	if assert.NoError(t, err) {
+		assert.Equal(t, 4, props["maxSessions"])
+		assert.NoError(t, r.ValidateRemote(props))
+		_, extra, err := r.ToURL(props)
+		if assert.NoError(t, err) {
+			assert.Equal(t, "4", extra["maxSessions"])
+		}
+	}
+	max, err := getMaxSessions(map[string]interface{}{"maxSessions": 4.0})
+	if assert.NoError(t, err) {
+		assert.Equal(t, 4, max)
+	}
+	max, err = getMaxSessions(map[string]interface{}{})
+	if assert.NoError(t, err) {
+		assert.Equal(t, defaultMaxSessions, max)
+	}
+}
+
+func TestMaxSessionsBadProperty(t *testing.T) {
+	r := remote.Get("ssh")
+	for _, v := range []string{"0", "-1", "foo"} {
+		_, err := r.FromURL("ssh://user@host/path", map[string]string{"maxSessions": v})
+		assert.Error(t, err, v)
+	}
+	err := r.ValidateRemote(map[string]interface{}{"username": "username", "address": "host", "path": "/path",
+		"maxSessions": "4"})
+	if assert.Error(t, err) {
+		assert.True(t, strings.Contains(err.Error(), "maxSessions"))
+	}
+}
@@ -0,0 +1,235 @@
+/*
+ * Copyright The Titan Project Contributors.
+ */
+package ssh
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+/*
+ * Default for how long unreferenced objects and leftovers are kept before they are collected.
+ */
+var gcGracePeriod = 24 * time.Hour
+
+/*
+ * Options for garbage collection.
+ */
+type GCOptions struct {
+	// Report what would be removed, without removing anything
+	DryRun bool
+	// Entries modified more recently than this are never removed, so that nothing written by a push in progress is
+	// collected. A push that failed is collected once it has been left alone for this long, after which resuming it
+	// starts over. Defaults to 24 hours.
+	GracePeriod time.Duration
+}
+
+/*
+ * What garbage collection removed, or would remove in a dry run. Objects are listed by hash, and leftovers by their
+ * path relative to the repository.
+ */
+type GCReport struct {
+	DryRun bool
+	// Objects that are referenced by a commit
+	Referenced int
+	// Objects that are not referenced by any commit
+	Objects []string
+	// Temporary files of interrupted writes, and commits whose push never completed
+	Leftovers []string
+	// Unreferenced objects and leftovers that were kept because they are within the grace period
+	Kept int
+	// Total size of the objects and temporary files
+	Bytes int64
+}
+
+func (r *GCReport) String() string {
+	verb := "Removed"
+	if r.DryRun {
+		verb = "Would remove"
+	}
+	return fmt.Sprintf("%s %d unreferenced objects and %d leftovers (%d bytes). %d objects are in use, and %d "+
+		"entries were kept as they are within the grace period.", verb, len(r.Objects), len(r.Leftovers), r.Bytes,
+		r.Referenced, r.Kept)
+}
+
+/*
+ * Remove the data in a repository that no commit needs: objects that are no longer referenced by the manifest of any
+ * commit, temporary files left behind by interrupted writes, and commits whose push never completed, which are
+ * commit directories still marked as being pushed and without a metadata.json. Other directories without a
+ * metadata.json are left alone, since they may not have been created by a push. Only entries older than the grace
+ * period are removed. Pushes upload their data without holding the lock, and may reuse objects that no commit
+ * references yet, so no objects are removed while a push is in progress, that is while the push marker of an
+ * incomplete commit is within the grace period.
+ *
+ * The repository lock is held throughout. Every commit directory found is marked, and collection is aborted if the
+ * manifest of any of them cannot be read, so objects are never removed on the basis of a partial view. Failures to
+ * remove individual entries don't stop the sweep; they are reported in the error once it completes, and collecting
+ * again retries them.
+ */
+func (s sshRemote) CollectGarbage(properties map[string]interface{}, parameters map[string]interface{},
+	options GCOptions) (*GCReport, error) {
+	store, release, err := connectStore(properties, parameters)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	grace := options.GracePeriod
+	if grace == 0 {
+		grace = gcGracePeriod
+	}
+	report := &GCReport{DryRun: options.DryRun}
+	err = withLock(store, properties, func() error {
+		return collectGarbage(store, properties["path"].(string), time.Now().Add(-grace), report)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+func collectGarbage(store remoteStore, root string, cutoff time.Time, report *GCReport) error {
+	entries, err := store.listFiles(root, 2)
+	if err != nil {
+		return err
+	}
+
+	var leftovers, temps []treeEntry
+	commits := map[string]bool{}
+	complete := map[string]bool{}
+	pushing := map[string]bool{}
+	modified := map[string]time.Time{}
+	for _, e := range entries {
+		parts := strings.SplitN(e.name, "/", 2)
+		top := parts[0]
+		// Hidden entries are never commits, and only temporary files among them are collected
+		if strings.HasPrefix(top, ".") {
+			if len(parts) == 1 && isTempName(top) {
+				temps = append(temps, e)
+			}
+			continue
+		}
+		if validateCommitId(top) != nil {
+			continue
+		}
+		if len(parts) == 2 && isTempName(parts[1]) {
+			temps = append(temps, e)
+		}
+		if len(parts) == 1 {
+			commits[top] = e.mode.IsDir()
+		} else if parts[1] == "metadata.json" {
+			complete[top] = true
+		} else if parts[1] == pushMarker {
+			pushing[top] = true
+		}
+		if e.modTime.After(modified[top]) {
+			modified[top] = e.modTime
+		}
+	}
+
+	// Mark the objects referenced by commits, other than incomplete commits that are about to be removed
+	marked := map[string]bool{}
+	removed := map[string]bool{}
+	active := false
+	for id, isDir := range commits {
+		if !isDir {
+			continue
+		}
+		if !complete[id] && pushing[id] {
+			if modified[id].Before(cutoff) {
+				leftovers = append(leftovers, treeEntry{name: id, mode: os.ModeDir, modTime: modified[id]})
+				removed[id] = true
+				continue
+			}
+			active = true
+		}
+		m, err := readManifest(store, root+"/"+id)
+		if err != nil {
+			return fmt.Errorf("cannot collect garbage, failed to read the manifest of %s: %w", id, err)
+		}
+		if m != nil && m.isObjects() {
+			for hash := range m.objects() {
+				marked[hash] = true
+			}
+		}
+	}
+
+	for _, e := range temps {
+		top := strings.SplitN(e.name, "/", 2)[0]
+		if !removed[top] {
+			leftovers = append(leftovers, e)
+		}
+	}
+
+	objects, err := store.listFiles(root+"/"+objectsDir, 2)
+	if err != nil {
+		return err
+	}
+	var unreferenced []treeEntry
+	for _, e := range objects {
+		hash := path.Base(e.name)
+		depth := strings.Count(e.name, "/")
+		e.name = objectsDir + "/" + e.name
+		switch {
+		case depth == 0:
+		case isTempName(hash):
+			leftovers = append(leftovers, e)
+		case !e.mode.IsRegular() || len(hash) != 64:
+		case marked[hash]:
+			report.Referenced++
+		case e.modTime.Before(cutoff) && !active:
+			unreferenced = append(unreferenced, e)
+		default:
+			report.Kept++
+		}
+	}
+
+	// Sweep
+	var failed []string
+	var firstErr error
+	sweep := func(e treeEntry, remove func(string) error) bool {
+		if report.DryRun {
+			return true
+		}
+		if err := remove(root + "/" + e.name); err != nil {
+			failed = append(failed, e.name)
+			if firstErr == nil {
+				firstErr = err
+			}
+			return false
+		}
+		return true
+	}
+	for _, e := range leftovers {
+		if !e.modTime.Before(cutoff) {
+			report.Kept++
+		} else if sweep(e, store.removeAll) {
+			report.Leftovers = append(report.Leftovers, e.name)
+			if e.mode.IsRegular() {
+				report.Bytes += e.size
+			}
+		}
+	}
+	for _, e := range unreferenced {
+		if sweep(e, store.remove) {
+			report.Objects = append(report.Objects, path.Base(e.name))
+			report.Bytes += e.size
+		}
+	}
+	sort.Strings(report.Leftovers)
+	sort.Strings(report.Objects)
+
+	if len(failed) > 0 {
+		sort.Strings(failed)
+		if len(failed) > maxReportedProblems {
+			failed = append(failed[:maxReportedProblems], fmt.Sprintf("and %d more", len(failed)-maxReportedProblems))
+		}
+		return fmt.Errorf("failed to remove %s: %w", strings.Join(failed, ", "), firstErr)
+	}
+	return nil
+}
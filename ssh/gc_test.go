@@ -0,0 +1,266 @@
+/*
+ * Copyright The Titan Project Contributors.
+ */
+package ssh
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/titan-data/remote-sdk-go/remote"
+	"golang.org/x/crypto/ssh"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+/*
+ * Set the modification time of everything below a directory.
+ */
+func age(t *testing.T, dir string, d time.Duration) {
+	past := time.Now().Add(-d)
+	filepath.Walk(dir, func(file string, info os.FileInfo, err error) error {
+		if err == nil {
+			assert.NoError(t, os.Chtimes(file, past, past))
+		}
+		return nil
+	})
+}
+
+/*
+ * Create a repository with two commits in the objects layout, delete the first of them, and leave behind leftovers of
+ * interrupted writes and pushes, along with a directory that was not created by a push.
+ */
+func writeGarbage(t *testing.T, repo string, props map[string]interface{}) {
+	dir, source := writeSourceData(t)
+	defer os.RemoveAll(dir)
+	other := writeRepository(t, map[string]string{"file": "other"})
+	defer os.RemoveAll(other)
+
+	props["layout"] = "objects"
+	params := map[string]interface{}{"password": "password"}
+	assert.NoError(t, sshRemote{}.PushCommit(props, params, remote.Commit{Id: "one"}, other, ""))
+	assert.NoError(t, sshRemote{}.PushCommit(props, params, remote.Commit{Id: "two"}, source, ""))
+	assert.NoError(t, sshRemote{}.DeleteCommit(props, params, "one"))
+
+	for name, content := range map[string]string{
+		".lock.tmp-0123/owner":          "{}",
+		"two/.metadata.json.tmp-0123":   "{}",
+		".objects/ab/.abcd.tmp-0123":    "abcd",
+		"three/file":                    "incomplete",
+		"three/.metadata.json.tmp-0123": "{}",
+		"three/" + pushMarker:           "",
+		"two/dir/.data.tmp-0123":        "data",
+		"other/file":                    "not pushed",
+	} {
+		file := filepath.Join(repo, filepath.FromSlash(name))
+		assert.NoError(t, os.MkdirAll(filepath.Dir(file), 0755))
+		assert.NoError(t, ioutil.WriteFile(file, []byte(content), 0644))
+	}
+	age(t, repo, 48*time.Hour)
+}
+
+func TestCollectGarbage(t *testing.T) {
+	for _, transport := range []string{"sftp", "shell"} {
+		repo := writeRepository(t, map[string]string{})
+		local := writeRepository(t, map[string]string{})
+
+		mockSFTPDial()
+		run = runLocal
+		runInput = runLocalInput
+		props := pushProperties(repo)
+		props["transport"] = transport
+		writeGarbage(t, repo, props)
+		// Recent leftovers are kept
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(repo, "two", ".manifest.json.tmp-0123"), []byte("{}"), 0644))
+		objects := countObjects(t, repo)
+
+		params := map[string]interface{}{"password": "password"}
+		report, err := sshRemote{}.CollectGarbage(props, params, GCOptions{DryRun: true})
+		if assert.NoError(t, err, transport) {
+			assert.True(t, report.DryRun)
+			assert.Len(t, report.Objects, 1)
+			assert.Equal(t, []string{".lock.tmp-0123", ".objects/ab/.abcd.tmp-0123", "three",
+				"two/.metadata.json.tmp-0123"}, report.Leftovers)
+			assert.Equal(t, 1, report.Kept)
+			assert.Equal(t, objects-2, report.Referenced)
+			assert.Contains(t, report.String(), "Would remove 1 unreferenced objects and 4 leftovers")
+		}
+		assert.Equal(t, objects, countObjects(t, repo))
+
+		report, err = sshRemote{}.CollectGarbage(props, params, GCOptions{})
+		if assert.NoError(t, err, transport) {
+			assert.Len(t, report.Objects, 1)
+			assert.Len(t, report.Leftovers, 4)
+		}
+		assert.Equal(t, objects-2, countObjects(t, repo))
+		_, err = os.Lstat(filepath.Join(repo, "two", "dir", ".data.tmp-0123"))
+		assert.NoError(t, err)
+		// Directories that were not created by a push are left alone
+		_, err = os.Lstat(filepath.Join(repo, "other", "file"))
+		assert.NoError(t, err)
+		for _, name := range []string{".lock.tmp-0123", "three", "two/.metadata.json.tmp-0123", ".lock"} {
+			_, err := os.Lstat(filepath.Join(repo, filepath.FromSlash(name)))
+			assert.True(t, os.IsNotExist(err), name)
+		}
+
+		_, err = sshRemote{}.PullCommit(props, params, "two", filepath.Join(local, "dest"), "")
+		if assert.NoError(t, err) {
+			checkCommitData(t, filepath.Join(local, "dest"))
+		}
+
+		run = runCommand
+		runInput = runCommandInput
+		resetSFTPDial()
+		os.RemoveAll(repo)
+		os.RemoveAll(local)
+	}
+}
+
+func TestCollectGarbageGracePeriod(t *testing.T) {
+	repo := writeRepository(t, map[string]string{})
+	defer os.RemoveAll(repo)
+	mockSFTPDial()
+	props := pushProperties(repo)
+	writeGarbage(t, repo, props)
+
+	report, err := sshRemote{}.CollectGarbage(props, map[string]interface{}{"password": "password"},
+		GCOptions{GracePeriod: 72 * time.Hour})
+	if assert.NoError(t, err) {
+		assert.Empty(t, report.Objects)
+		assert.Empty(t, report.Leftovers)
+		assert.Equal(t, 5, report.Kept)
+	}
+	resetSFTPDial()
+}
+
+func TestCollectGarbageActivePush(t *testing.T) {
+	repo := writeRepository(t, map[string]string{})
+	defer os.RemoveAll(repo)
+	mockSFTPDial()
+	props := pushProperties(repo)
+	writeGarbage(t, repo, props)
+	// A push in progress may reuse unreferenced objects, so they are kept, while abandoned pushes are still removed
+	assert.NoError(t, os.Mkdir(filepath.Join(repo, "four"), 0755))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(repo, "four", pushMarker), []byte{}, 0644))
+
+	report, err := sshRemote{}.CollectGarbage(props, map[string]interface{}{"password": "password"}, GCOptions{})
+	if assert.NoError(t, err) {
+		assert.Empty(t, report.Objects)
+		assert.Contains(t, report.Leftovers, "three")
+		assert.NotContains(t, report.Leftovers, "four")
+	}
+	resetSFTPDial()
+}
+
+func TestCollectGarbageBadManifest(t *testing.T) {
+	repo := writeRepository(t, map[string]string{})
+	defer os.RemoveAll(repo)
+	mockSFTPDial()
+	props := pushProperties(repo)
+	writeGarbage(t, repo, props)
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(repo, "two", "manifest.json"), []byte("garbage"), 0644))
+	objects := countObjects(t, repo)
+
+	_, err := sshRemote{}.CollectGarbage(props, map[string]interface{}{"password": "password"}, GCOptions{})
+	assert.Error(t, err)
+	assert.Equal(t, objects, countObjects(t, repo))
+	resetSFTPDial()
+}
+
+func TestCollectGarbageWithoutGNUFind(t *testing.T) {
+	repo := writeRepository(t, map[string]string{})
+	defer os.RemoveAll(repo)
+	mockSFTPDial()
+	newSFTPClient = noSFTP
+	run = func(conn *ssh.Client, command string) ([]byte, error) {
+		if strings.Contains(command, "-printf") {
+			return nil, errors.New("find: unknown primary or operator")
+		}
+		return runLocal(conn, command)
+	}
+	runInput = runLocalInput
+	props := pushProperties(repo)
+	props["transport"] = "shell"
+	writeGarbage(t, repo, props)
+
+	report, err := sshRemote{}.CollectGarbage(props, map[string]interface{}{"password": "password"}, GCOptions{})
+	if assert.NoError(t, err) {
+		assert.Len(t, report.Objects, 1)
+		assert.Len(t, report.Leftovers, 4)
+	}
+	run = runCommand
+	runInput = runCommandInput
+	resetSFTPDial()
+}
+
+func TestParseFileList(t *testing.T) {
+	entries, err := parseFileList([]byte("d 4096 1568987136.5 dir\x00f 7 1568987136.0000000000 dir/a b\nc\x00" +
+		"l 4 1568987136 link\x00"))
+	if assert.NoError(t, err) && assert.Len(t, entries, 3) {
+		assert.True(t, entries[0].mode.IsDir())
+		assert.Equal(t, "dir/a b\nc", entries[1].name)
+		assert.Equal(t, int64(7), entries[1].size)
+		assert.Equal(t, int64(1568987136), entries[1].modTime.Unix())
+		assert.Equal(t, os.ModeSymlink, entries[2].mode)
+	}
+	_, err = parseFileList([]byte("f 7 dir\x00"))
+	assert.Error(t, err)
+}
+
+func TestParseLongList(t *testing.T) {
+	now := time.Date(2020, 1, 10, 12, 0, 0, 0, time.UTC)
+	entries, err := parseLongList([]byte("drwxr-xr-x  2 user group    4096 Jan 10 11:58 ./dir\n"+
+		"-rw-r--r--  1 user  my group   7 Dec 31 23:59 ./dir/a  b?c\n"+
+		"lrwxrwxrwx  1 user group       4 Mar  1  2019 ./link -> dir\n"+
+		"crw-rw-rw-  1 root root     1, 3 Jan  1 00:00 ./null\n"), now)
+	if assert.NoError(t, err) && assert.Len(t, entries, 4) {
+		assert.Equal(t, "dir", entries[0].name)
+		assert.True(t, entries[0].mode.IsDir())
+		assert.Equal(t, time.Date(2020, 1, 10, 11, 59, 0, -1, time.UTC), entries[0].modTime)
+		assert.Equal(t, "dir/a  b?c", entries[1].name)
+		assert.Equal(t, int64(7), entries[1].size)
+		assert.True(t, entries[1].mode.IsRegular())
+		assert.Equal(t, time.Date(2020, 1, 1, 0, 0, 0, -1, time.UTC), entries[1].modTime)
+		assert.Equal(t, "link", entries[2].name)
+		assert.Equal(t, os.ModeSymlink, entries[2].mode)
+		assert.Equal(t, time.Date(2019, 3, 2, 0, 0, 0, -1, time.UTC), entries[2].modTime)
+		assert.Equal(t, "null", entries[3].name)
+		assert.Equal(t, os.ModeIrregular, entries[3].mode)
+	}
+	_, err = parseLongList([]byte("-rw-r--r-- 1 user group 7 Jan 10 ./file\n"), now)
+	assert.Error(t, err)
+}
+
+func TestShellListFilesWithoutGNUFind(t *testing.T) {
+	repo := writeRepository(t, map[string]string{"one/a": "a", "one/b/c": "content", ".objects/ab/abc": "object"})
+	defer os.RemoveAll(repo)
+	assert.NoError(t, os.Symlink("a", filepath.Join(repo, "one", "link")))
+	run = runLocal
+	expected, err := (&shellStore{}).listFiles(repo, 2)
+	assert.NoError(t, err)
+	run = func(conn *ssh.Client, command string) ([]byte, error) {
+		if strings.Contains(command, "-printf") {
+			return nil, errors.New("find: unknown primary or operator")
+		}
+		return runLocal(conn, command)
+	}
+	newSFTPClient = noSFTP
+	entries, err := (&shellStore{}).listFiles(repo, 2)
+	if assert.NoError(t, err) && assert.Len(t, entries, len(expected)) {
+		sort.Slice(expected, func(i, j int) bool { return expected[i].name < expected[j].name })
+		sort.Slice(entries, func(i, j int) bool { return entries[i].name < entries[j].name })
+		for i, e := range entries {
+			assert.Equal(t, expected[i].name, e.name)
+			assert.Equal(t, expected[i].mode, e.mode)
+			assert.Equal(t, expected[i].size, e.size)
+			assert.False(t, e.modTime.Before(expected[i].modTime), e.name)
+			assert.True(t, e.modTime.Sub(expected[i].modTime) < time.Minute, e.name)
+		}
+	}
+	run = runCommand
+	resetSFTPDial()
+}
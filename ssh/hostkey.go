@@ -0,0 +1,228 @@
+/*
+ * Copyright The Titan Project Contributors.
+ */
+package ssh
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var userHomeDir = os.UserHomeDir
+
+/*
+ * Returns the known hosts file to use for the given remote. This is the 'knownHostsFile' property if set, otherwise
+ * the user's ~/.ssh/known_hosts. The second return value indicates whether the file was explicitly configured.
+ */
+func getKnownHostsFile(properties map[string]interface{}) (string, bool, error) {
+	if file, ok := properties["knownHostsFile"].(string); ok && file != "" {
+		return file, true, nil
+	}
+	home, err := userHomeDir()
+	if err != nil {
+		return "", false, fmt.Errorf("failed to determine home directory: %w", err)
+	}
+	return filepath.Join(home, ".ssh", "known_hosts"), false, nil
+}
+
+/*
+ * Load the known hosts file for the remote, returning the raw knownhosts callback along with the file name. Hashed
+ * hostnames and @revoked / @cert-authority markers are handled by the knownhosts package. A missing default
+ * known_hosts file is treated as empty, so that every host is reported as unknown, while a missing explicit file is
+ * an error.
+ */
+func loadKnownHosts(properties map[string]interface{}) (ssh.HostKeyCallback, string, error) {
+	file, explicit, err := getKnownHostsFile(properties)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var files []string
+	if _, err := os.Stat(file); err == nil {
+		files = append(files, file)
+	} else if explicit || !os.IsNotExist(err) {
+		return nil, "", fmt.Errorf("failed to read known hosts file %s: %w", file, err)
+	}
+
+	callback, err := knownhosts.New(files...)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to parse known hosts file %s: %w", file, err)
+	}
+	return callback, file, nil
+}
+
+/*
+ * Build a host key callback that strictly verifies the server against the known hosts file for the remote.
+ */
+func getKnownHostsCallback(properties map[string]interface{}) (ssh.HostKeyCallback, error) {
+	callback, file, err := loadKnownHosts(properties)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		return hostKeyError(hostname, file, key, callback(hostname, remote, key))
+	}, nil
+}
+
+/*
+ * Convert errors from the knownhosts package into messages that name the host and the offending fingerprint, so
+ * that users can tell a changed key from an unknown host or a revoked key.
+ */
+func hostKeyError(hostname string, file string, key ssh.PublicKey, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	fingerprint := ssh.FingerprintSHA256(key)
+
+	var revokedErr *knownhosts.RevokedError
+	if errors.As(err, &revokedErr) {
+		return fmt.Errorf("host key %s %s for %s has been revoked (%s:%d)", key.Type(), fingerprint, hostname,
+			revokedErr.Revoked.Filename, revokedErr.Revoked.Line)
+	}
+
+	var keyErr *knownhosts.KeyError
+	if errors.As(err, &keyErr) {
+		if len(keyErr.Want) == 0 {
+			return fmt.Errorf("host key verification failed: %s is not a known host (%s key %s not found in %s)",
+				hostname, key.Type(), fingerprint, file)
+		}
+		want := keyErr.Want[0]
+		return fmt.Errorf("host key verification failed: %s presented %s key %s, but %s:%d expects %s %s",
+			hostname, key.Type(), fingerprint, want.Filename, want.Line, want.Key.Type(),
+			ssh.FingerprintSHA256(want.Key))
+	}
+
+	return fmt.Errorf("host key verification failed for %s: %w", hostname, err)
+}
+
+/*
+ * Validate that a pinned host key is a SHA256 fingerprint as produced by ssh.FingerprintSHA256.
+ */
+func validateHostKey(fingerprint string) error {
+	if !strings.HasPrefix(fingerprint, "SHA256:") {
+		return fmt.Errorf("invalid host key fingerprint '%s', must be of the form SHA256:<base64>", fingerprint)
+	}
+	hash, err := base64.RawStdEncoding.DecodeString(fingerprint[7:])
+	if err != nil || len(hash) != 32 {
+		return fmt.Errorf("invalid host key fingerprint '%s', must be of the form SHA256:<base64>", fingerprint)
+	}
+	return nil
+}
+
+/*
+ * Value of the 'hostKey' property given to FromURL to pin the key that the host presents when the remote is added.
+ */
+const hostKeyFirstUse = "first-use"
+
+/*
+ * Build the host key callback for the target of a remote. If the remote has a pinned 'hostKey', the server must
+ * present exactly that key. Otherwise the key is strictly checked against known_hosts.
+ */
+func getHostKeyCallback(properties map[string]interface{}) (ssh.HostKeyCallback, error) {
+	if pinned, ok := properties["hostKey"].(string); ok && pinned != "" {
+		return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			fingerprint := ssh.FingerprintSHA256(key)
+			if fingerprint != pinned {
+				return fmt.Errorf("host key verification failed: %s presented %s key %s, but the remote is pinned "+
+					"to %s", hostname, key.Type(), fingerprint, pinned)
+			}
+			return nil
+		}, nil
+	}
+
+	return getKnownHostsCallback(properties)
+}
+
+var errHostKeyScanned = errors.New("host key scanned")
+
+/*
+ * Returns the fingerprint of the key that the target of a remote presents, without authenticating. The key is
+ * accepted if known_hosts lists it, or doesn't list the host at all, but never if it conflicts with known_hosts or
+ * has been revoked. Jump hosts would need credentials to reach the target, so they are not supported.
+ */
+func scanHostKey(properties map[string]interface{}) (string, error) {
+	if proxyJump, ok := properties["proxyJump"].(string); ok && proxyJump != "" {
+		return "", errors.New("the host key cannot be pinned on first use through a proxy jump, specify its " +
+			"fingerprint instead")
+	}
+	address, err := getAddress(properties)
+	if err != nil {
+		return "", err
+	}
+	callback, file, err := loadKnownHosts(properties)
+	if err != nil {
+		return "", err
+	}
+
+	fingerprint := ""
+	config := &ssh.ClientConfig{
+		User: properties["username"].(string),
+		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			err := callback(hostname, remote, key)
+			var keyErr *knownhosts.KeyError
+			if err != nil && !(errors.As(err, &keyErr) && len(keyErr.Want) == 0) {
+				return hostKeyError(hostname, file, key, err)
+			}
+			fingerprint = ssh.FingerprintSHA256(key)
+			// Abort the handshake, since there is no need to authenticate
+			return errHostKeyScanned
+		},
+	}
+	client, err := dial("tcp", address, config)
+	if client != nil {
+		client.Close()
+	}
+	if fingerprint == "" {
+		if err == nil {
+			err = errors.New("server presented no host key")
+		}
+		return "", fmt.Errorf("failed to get the host key of %s: %w", address, err)
+	}
+	return fingerprint, nil
+}
+
+/*
+ * Deliberately re-pin the host key of a remote, such as after a legitimate key rotation. Any existing pin is
+ * discarded and a new connection is made. If a fingerprint is given, the server must present exactly that key, even
+ * if it conflicts with a stale known_hosts entry. Otherwise the key the server presents is pinned, subject to the
+ * same checks as pinning on first use. On success the new fingerprint is recorded in the properties and returned.
+ */
+func (s sshRemote) PinHostKey(properties map[string]interface{}, parameters map[string]interface{},
+	fingerprint string) (string, error) {
+	if fingerprint != "" {
+		if err := validateHostKey(fingerprint); err != nil {
+			return "", err
+		}
+	}
+
+	pinned := map[string]interface{}{}
+	for k, v := range properties {
+		pinned[k] = v
+	}
+	if fingerprint == "" {
+		delete(pinned, "hostKey")
+		var err error
+		if fingerprint, err = scanHostKey(pinned); err != nil {
+			return "", err
+		}
+	}
+	pinned["hostKey"] = fingerprint
+
+	conn, err := getConnection(pinned, parameters)
+	if err != nil {
+		return "", err
+	}
+	conn.Close()
+
+	properties["hostKey"] = fingerprint
+	return fingerprint, nil
+}
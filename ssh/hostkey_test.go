@@ -0,0 +1,294 @@
+/*
+ * Copyright The Titan Project Contributors.
+ */
+package ssh
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"github.com/stretchr/testify/assert"
+	"github.com/titan-data/remote-sdk-go/remote"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var testAddr = &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 22}
+
+func newHostKey(t *testing.T) ssh.PublicKey {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	key, err := ssh.NewPublicKey(pub)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	return key
+}
+
+func writeKnownHosts(t *testing.T, lines ...string) string {
+	dir, err := ioutil.TempDir("", "ssh.test")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	path := filepath.Join(dir, "known_hosts")
+	content := ""
+	for _, l := range lines {
+		content += l + "\n"
+	}
+	err = ioutil.WriteFile(path, []byte(content), 0600)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	return path
+}
+
+func TestHostKeyKnown(t *testing.T) {
+	key := newHostKey(t)
+	file := writeKnownHosts(t, knownhosts.Line([]string{"host"}, key))
+	defer os.RemoveAll(filepath.Dir(file))
+
+	callback, err := getKnownHostsCallback(map[string]interface{}{"knownHostsFile": file})
+	if assert.NoError(t, err) {
+		assert.NoError(t, callback("host:22", testAddr, key))
+	}
+}
+
+func TestHostKeyHashed(t *testing.T) {
+	key := newHostKey(t)
+	file := writeKnownHosts(t, knownhosts.Line([]string{knownhosts.HashHostname("host")}, key))
+	defer os.RemoveAll(filepath.Dir(file))
+
+	callback, err := getKnownHostsCallback(map[string]interface{}{"knownHostsFile": file})
+	if assert.NoError(t, err) {
+		assert.NoError(t, callback("host:22", testAddr, key))
+	}
+}
+
+func TestHostKeyUnknown(t *testing.T) {
+	key := newHostKey(t)
+	file := writeKnownHosts(t, knownhosts.Line([]string{"other"}, key))
+	defer os.RemoveAll(filepath.Dir(file))
+
+	callback, err := getKnownHostsCallback(map[string]interface{}{"knownHostsFile": file})
+	if assert.NoError(t, err) {
+		err = callback("host:22", testAddr, key)
+		if assert.Error(t, err) {
+			assert.Contains(t, err.Error(), "not a known host")
+			assert.Contains(t, err.Error(), ssh.FingerprintSHA256(key))
+		}
+	}
+}
+
+func TestHostKeyMismatch(t *testing.T) {
+	known := newHostKey(t)
+	presented := newHostKey(t)
+	file := writeKnownHosts(t, knownhosts.Line([]string{"host"}, known))
+	defer os.RemoveAll(filepath.Dir(file))
+
+	callback, err := getKnownHostsCallback(map[string]interface{}{"knownHostsFile": file})
+	if assert.NoError(t, err) {
+		err = callback("host:22", testAddr, presented)
+		if assert.Error(t, err) {
+			assert.Contains(t, err.Error(), ssh.FingerprintSHA256(presented))
+			assert.Contains(t, err.Error(), ssh.FingerprintSHA256(known))
+		}
+	}
+}
+
+func TestHostKeyRevoked(t *testing.T) {
+	key := newHostKey(t)
+	file := writeKnownHosts(t, knownhosts.Line([]string{"host"}, key),
+		"@revoked * "+string(ssh.MarshalAuthorizedKey(key)))
+	defer os.RemoveAll(filepath.Dir(file))
+
+	callback, err := getKnownHostsCallback(map[string]interface{}{"knownHostsFile": file})
+	if assert.NoError(t, err) {
+		err = callback("host:22", testAddr, key)
+		if assert.Error(t, err) {
+			assert.Contains(t, err.Error(), "revoked")
+			assert.Contains(t, err.Error(), ssh.FingerprintSHA256(key))
+		}
+	}
+}
+
+func TestHostKeyMissingExplicitFile(t *testing.T) {
+	_, err := getKnownHostsCallback(map[string]interface{}{"knownHostsFile": "/nonexistent/known_hosts"})
+	assert.Error(t, err)
+}
+
+func TestHostKeyMissingDefaultFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ssh.test")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	userHomeDir = func() (string, error) {
+		return dir, nil
+	}
+	callback, err := getKnownHostsCallback(map[string]interface{}{})
+	userHomeDir = emptyHomeDir
+	if assert.NoError(t, err) {
+		assert.Error(t, callback("host:22", testAddr, newHostKey(t)))
+	}
+}
+
+func TestHostKeyBadFile(t *testing.T) {
+	file := writeKnownHosts(t, "host not-a-key")
+	defer os.RemoveAll(filepath.Dir(file))
+
+	_, err := getKnownHostsCallback(map[string]interface{}{"knownHostsFile": file})
+	assert.Error(t, err)
+}
+
+func TestKnownHostsFileProperty(t *testing.T) {
+	r := remote.Get("ssh")
+	props, err := r.FromURL("ssh://user@host/path", map[string]string{"knownHostsFile": "/known_hosts"})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "/known_hosts", props["knownHostsFile"])
+		assert.NoError(t, r.ValidateRemote(props))
+		_, extra, err := r.ToURL(props)
+		if assert.NoError(t, err) {
+			assert.Equal(t, "/known_hosts", extra["knownHostsFile"])
+		}
+	}
+}
+
+func TestHostKeyUnknownNotTrusted(t *testing.T) {
+	file := writeKnownHosts(t)
+	defer os.RemoveAll(filepath.Dir(file))
+
+	props := map[string]interface{}{"knownHostsFile": file}
+	callback, err := getHostKeyCallback(props)
+	if assert.NoError(t, err) {
+		assert.Error(t, callback("host:22", testAddr, newHostKey(t)))
+		assert.Nil(t, props["hostKey"])
+	}
+}
+
+/*
+ * Make dial present the given host key, failing the connection if it is rejected.
+ */
+func mockHostKeyDial(key ssh.PublicKey) {
+	conn := new(MockConn)
+	conn.On("Close").Return(nil)
+	dial = func(network string, addr string, cfg *ssh.ClientConfig) (*ssh.Client, error) {
+		if err := cfg.HostKeyCallback("host:22", testAddr, key); err != nil {
+			return nil, err
+		}
+		return &ssh.Client{Conn: conn}, nil
+	}
+}
+
+func TestHostKeyFirstUse(t *testing.T) {
+	key := newHostKey(t)
+	file := writeKnownHosts(t)
+	defer os.RemoveAll(filepath.Dir(file))
+	mockHostKeyDial(key)
+
+	r := remote.Get("ssh")
+	props, err := r.FromURL("ssh://user@host/path", map[string]string{"knownHostsFile": file,
+		"hostKey": "first-use"})
+	if assert.NoError(t, err) {
+		assert.Equal(t, ssh.FingerprintSHA256(key), props["hostKey"])
+		assert.NoError(t, r.ValidateRemote(props))
+	}
+	dial = ssh.Dial
+}
+
+func TestHostKeyFirstUseKnownMismatch(t *testing.T) {
+	file := writeKnownHosts(t, knownhosts.Line([]string{"host"}, newHostKey(t)))
+	defer os.RemoveAll(filepath.Dir(file))
+	mockHostKeyDial(newHostKey(t))
+
+	_, err := remote.Get("ssh").FromURL("ssh://user@host/path", map[string]string{"knownHostsFile": file,
+		"hostKey": "first-use"})
+	assert.Error(t, err)
+	_, err = remote.Get("ssh").FromURL("ssh://user@host/path", map[string]string{"knownHostsFile": file,
+		"hostKey": "first-use", "proxyJump": "jump"})
+	assert.Error(t, err)
+	dial = ssh.Dial
+}
+
+func TestHostKeyPinned(t *testing.T) {
+	key := newHostKey(t)
+	callback, err := getHostKeyCallback(map[string]interface{}{"hostKey": ssh.FingerprintSHA256(key)})
+	if assert.NoError(t, err) {
+		assert.NoError(t, callback("host:22", testAddr, key))
+	}
+}
+
+func TestHostKeyPinnedMismatch(t *testing.T) {
+	pinned := ssh.FingerprintSHA256(newHostKey(t))
+	key := newHostKey(t)
+	callback, err := getHostKeyCallback(map[string]interface{}{"hostKey": pinned})
+	if assert.NoError(t, err) {
+		err = callback("host:22", testAddr, key)
+		if assert.Error(t, err) {
+			assert.Contains(t, err.Error(), pinned)
+			assert.Contains(t, err.Error(), ssh.FingerprintSHA256(key))
+		}
+	}
+}
+
+func TestHostKeyProperty(t *testing.T) {
+	fingerprint := ssh.FingerprintSHA256(newHostKey(t))
+	r := remote.Get("ssh")
+	props, err := r.FromURL("ssh://user@host/path", map[string]string{"hostKey": fingerprint})
+	if assert.NoError(t, err) {
+		assert.Equal(t, fingerprint, props["hostKey"])
+		assert.NoError(t, r.ValidateRemote(props))
+		_, extra, err := r.ToURL(props)
+		if assert.NoError(t, err) {
+			assert.Equal(t, fingerprint, extra["hostKey"])
+		}
+	}
+}
+
+func TestHostKeyBadProperty(t *testing.T) {
+	r := remote.Get("ssh")
+	_, err := r.FromURL("ssh://user@host/path", map[string]string{"hostKey": "MD5:foo"})
+	assert.Error(t, err)
+}
+
+func TestValidateRemoteBadHostKey(t *testing.T) {
+	r := remote.Get("ssh")
+	err := r.ValidateRemote(map[string]interface{}{"username": "username", "address": "host", "path": "/path",
+		"hostKey": "SHA256:short"})
+	assert.Error(t, err)
+}
+
+func TestPinHostKey(t *testing.T) {
+	oldKey := newHostKey(t)
+	newKey := newHostKey(t)
+	mockHostKeyDial(newKey)
+	props := map[string]interface{}{"username": "username", "address": "host", "path": "/path",
+		"hostKey": ssh.FingerprintSHA256(oldKey)}
+	params := map[string]interface{}{"password": "password"}
+
+	_, err := sshRemote{}.PinHostKey(props, params, ssh.FingerprintSHA256(oldKey))
+	assert.Error(t, err)
+	assert.Equal(t, ssh.FingerprintSHA256(oldKey), props["hostKey"])
+
+	fingerprint, err := sshRemote{}.PinHostKey(props, params, ssh.FingerprintSHA256(newKey))
+	if assert.NoError(t, err) {
+		assert.Equal(t, ssh.FingerprintSHA256(newKey), fingerprint)
+		assert.Equal(t, fingerprint, props["hostKey"])
+	}
+
+	// Without a fingerprint, the key the server presents is pinned
+	file := writeKnownHosts(t)
+	defer os.RemoveAll(filepath.Dir(file))
+	props["hostKey"] = ssh.FingerprintSHA256(oldKey)
+	props["knownHostsFile"] = file
+	fingerprint, err = sshRemote{}.PinHostKey(props, params, "")
+	if assert.NoError(t, err) {
+		assert.Equal(t, ssh.FingerprintSHA256(newKey), fingerprint)
+	}
+	dial = ssh.Dial
+}
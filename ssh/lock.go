@@ -0,0 +1,359 @@
+/*
+ * Copyright The Titan Project Contributors.
+ */
+package ssh
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"sync"
+	"time"
+)
+
+/*
+ * Name of the lock directory within the repository. It is hidden, so it never shows up as a commit.
+ */
+const lockDir = ".lock"
+
+var (
+	// How long a lock remains valid without a heartbeat from its holder
+	lockExpiry = 2 * time.Minute
+	// How often the holder of a lock renews it
+	lockHeartbeat = 30 * time.Second
+	// How long to wait for a lock held by someone else before giving up
+	lockTimeout = 5 * time.Minute
+	// How often to check whether a held lock has been released
+	lockRetryInterval = time.Second
+)
+
+/*
+ * Contents of the owner file within the lock directory, identifying who holds the lock and until when. The expiry is
+ * only informational, since it comes from the clock of the holder.
+ */
+type LockOwner struct {
+	Holder   string    `json:"holder"`
+	Token    string    `json:"token"`
+	Acquired time.Time `json:"acquired"`
+	Expires  time.Time `json:"expires"`
+}
+
+/*
+ * Returns a description of the local process, so that users can tell who holds a lock.
+ */
+func lockHolder() string {
+	name := "unknown"
+	if u, err := user.Current(); err == nil {
+		name = u.Username
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return fmt.Sprintf("%s@%s (pid %d)", name, host, os.Getpid())
+}
+
+/*
+ * An advisory lock on a repository, used to coordinate writers. The lock is a directory created with mkdir, which
+ * is atomic on both the shell and SFTP transports, holding an owner file that identifies the holder and when the lock
+ * expires. While held, a heartbeat keeps rewriting the owner file, so a lock only expires if its holder has died or
+ * lost its connection. Readers never take the lock: ListCommits, GetCommit and PullCommit only ever see complete
+ * commits, since metadata.json is always the last file written.
+ */
+type repoLock struct {
+	store remoteStore
+	dir   string
+	owner LockOwner
+	stop  chan struct{}
+	done  chan struct{}
+	mu    sync.Mutex
+	err   error
+}
+
+func ownerFile(dir string) string {
+	return dir + "/owner"
+}
+
+func readLockOwner(store remoteStore, dir string) (*LockOwner, error) {
+	content, err := store.readFile(ownerFile(dir))
+	if err != nil {
+		return nil, err
+	}
+	owner := &LockOwner{}
+	if err := json.Unmarshal(content, owner); err != nil {
+		return nil, fmt.Errorf("invalid lock owner: %w", err)
+	}
+	return owner, nil
+}
+
+func writeLockOwner(store remoteStore, dir string, owner LockOwner) error {
+	content, err := json.Marshal(owner)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(store, ownerFile(dir), content, 0644)
+}
+
+/*
+ * Returns the modification time of the owner file of a lock, as recorded by the remote host, or the zero time if it
+ * cannot be found.
+ */
+func lockStamp(store remoteStore, dir string) time.Time {
+	entries, _ := store.listFiles(dir, 1)
+	for _, e := range entries {
+		if e.name == "owner" {
+			return e.modTime
+		}
+	}
+	return time.Time{}
+}
+
+/*
+ * Acquire the lock for the repository at the given path, waiting for up to the lock timeout if it is held by someone
+ * else. A lock whose holder has stopped renewing it is broken. Every heartbeat rewrites the owner file, so a lock is
+ * stale once the remote modification time and contents of its owner file have been seen unchanged for as long as the
+ * lock expiry. The expiry in the owner file is not compared with the local clock, so that a client whose clock is
+ * ahead never breaks a live lock. A lock that has had no owner file for as long as the lock expiry is broken too,
+ * which is left behind if a holder dies between creating the directory and writing the owner; a
+ * shorter wait could mistake the brand new locks of other writers for it. Breaking only succeeds if the lock is still
+ * the one that was seen, so that when several clients find the same stale lock, one of them can't break the lock
+ * that another has just acquired in its place.
+ */
+func acquireLock(store remoteStore, path string) (*repoLock, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	dir := path + "/" + lockDir
+	lock := &repoLock{store: store, dir: dir, owner: LockOwner{Holder: lockHolder(), Token: hex.EncodeToString(b)}}
+
+	deadline := time.Now().Add(lockTimeout)
+	var ownerless time.Time
+	missing := false
+	var seen LockOwner
+	var seenStamp, seenAt time.Time
+	for {
+		mkdirErr := store.mkdir(dir)
+		if mkdirErr == nil {
+			lock.owner.Acquired = time.Now().UTC()
+			lock.owner.Expires = lock.owner.Acquired.Add(lockExpiry)
+			if err := writeLockOwner(store, dir, lock.owner); err != nil {
+				store.removeAll(dir)
+				return nil, fmt.Errorf("failed to acquire lock: %w", err)
+			}
+			lock.startHeartbeat()
+			return lock, nil
+		}
+
+		holder := "an unknown holder"
+		owner, err := readLockOwner(store, dir)
+		if err == nil {
+			stamp := lockStamp(store, dir)
+			if owner.Token != seen.Token || !owner.Expires.Equal(seen.Expires) || !stamp.Equal(seenStamp) {
+				seen, seenStamp, seenAt = *owner, stamp, time.Now()
+			} else if time.Since(seenAt) > lockExpiry {
+				breakLock(store, dir, owner)
+				seen = LockOwner{}
+				continue
+			}
+			holder = fmt.Sprintf("%s since %s", owner.Holder, owner.Acquired.Format(time.RFC3339))
+			ownerless, missing = time.Time{}, false
+		} else if _, listErr := store.listDir(dir); listErr != nil {
+			// Either the lock was just released, or the mkdir failed for some other reason
+			if missing {
+				return nil, fmt.Errorf("failed to acquire lock: %w", mkdirErr)
+			}
+			ownerless, missing = time.Time{}, true
+			continue
+		} else if ownerless.IsZero() {
+			ownerless, missing = time.Now(), false
+		} else if time.Since(ownerless) > lockExpiry {
+			breakLock(store, dir, nil)
+			ownerless, missing = time.Time{}, false
+			continue
+		} else {
+			missing = false
+		}
+
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("repository is locked by %s", holder)
+		}
+		time.Sleep(lockRetryInterval)
+	}
+}
+
+/*
+ * Remove a lock directory, provided it is still held by the given owner, or has no owner file if the owner is nil.
+ * It is first renamed to a unique name, so that when several clients break the same stale lock at once, only one of
+ * them removes it. The owner is then read from the renamed directory: if the lock was replaced between being looked
+ * at and being renamed, it is put back, and false is returned.
+ */
+func breakLock(store remoteStore, dir string, expected *LockOwner) (bool, error) {
+	broken := tempName(dir)
+	if err := store.rename(dir, broken); err != nil {
+		return false, err
+	}
+	owner, err := readLockOwner(store, broken)
+	if expected == nil && err != nil || expected != nil && err == nil && owner.Token == expected.Token {
+		return true, store.removeAll(broken)
+	}
+	return false, restoreLock(store, broken, dir)
+}
+
+/*
+ * Put back a lock that was renamed by mistake. The lock directory is created again with mkdir rather than renamed
+ * into place, so that a lock acquired by someone else in the meantime is never overwritten; in that case the holder
+ * of the renamed lock has lost it, and will find out when it next renews or releases it.
+ */
+func restoreLock(store remoteStore, broken string, dir string) error {
+	if err := store.mkdir(dir); err != nil {
+		store.removeAll(broken)
+		return fmt.Errorf("failed to restore lock: %w", err)
+	}
+	if err := store.rename(ownerFile(broken), ownerFile(dir)); err != nil {
+		return fmt.Errorf("failed to restore lock: %w", err)
+	}
+	return store.removeAll(broken)
+}
+
+func (l *repoLock) startHeartbeat() {
+	l.stop = make(chan struct{})
+	l.done = make(chan struct{})
+	go func() {
+		defer close(l.done)
+		ticker := time.NewTicker(lockHeartbeat)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-l.stop:
+				return
+			case <-ticker.C:
+				if err := l.renew(); err != nil {
+					l.mu.Lock()
+					l.err = err
+					l.mu.Unlock()
+					return
+				}
+			}
+		}
+	}()
+}
+
+/*
+ * Push the expiry of the lock forward, failing if the lock has been broken by someone else.
+ */
+func (l *repoLock) renew() error {
+	if err := l.check(); err != nil {
+		return err
+	}
+	l.owner.Expires = time.Now().UTC().Add(lockExpiry)
+	return writeLockOwner(l.store, l.dir, l.owner)
+}
+
+/*
+ * Verify that the lock is still held.
+ */
+func (l *repoLock) check() error {
+	owner, err := readLockOwner(l.store, l.dir)
+	if err != nil {
+		return fmt.Errorf("lost repository lock: %w", err)
+	}
+	if owner.Token != l.owner.Token {
+		return fmt.Errorf("lost repository lock, it is now held by %s", owner.Holder)
+	}
+	return nil
+}
+
+/*
+ * Release the lock. Returns an error if the lock was lost while held, in which case another writer may have made
+ * concurrent changes.
+ */
+func (l *repoLock) release() error {
+	close(l.stop)
+	<-l.done
+
+	l.mu.Lock()
+	err := l.err
+	l.mu.Unlock()
+	if err == nil {
+		err = l.check()
+	}
+	if err != nil {
+		return err
+	}
+	released, err := breakLock(l.store, l.dir, &l.owner)
+	if err == nil && !released {
+		err = errors.New("lost repository lock while releasing it")
+	}
+	return err
+}
+
+/*
+ * Run a mutating operation while holding the repository lock.
+ */
+func withLock(store remoteStore, properties map[string]interface{}, fn func() error) error {
+	lock, err := acquireLock(store, properties["path"].(string))
+	if err != nil {
+		return err
+	}
+	err = fn()
+	if releaseErr := lock.release(); err == nil {
+		err = releaseErr
+	}
+	return err
+}
+
+/*
+ * Returns the current holder of the repository lock, or nil if the repository is not locked. This never blocks.
+ */
+func (s sshRemote) GetLock(properties map[string]interface{}, parameters map[string]interface{}) (*LockOwner, error) {
+	store, release, err := connectStore(properties, parameters)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	dir := properties["path"].(string) + "/" + lockDir
+	owner, err := readLockOwner(store, dir)
+	if err != nil {
+		if _, listErr := store.listDir(dir); listErr != nil {
+			return nil, nil
+		}
+		return &LockOwner{Holder: "unknown"}, nil
+	}
+	return owner, nil
+}
+
+/*
+ * Forcibly break the repository lock, regardless of whether its holder is still alive. This is meant for recovering
+ * from a holder that is known to be gone; breaking the lock of an active writer allows concurrent changes. Returns
+ * the holder of the broken lock, or an empty string if the repository was not locked.
+ */
+func (s sshRemote) BreakLock(properties map[string]interface{}, parameters map[string]interface{}) (string, error) {
+	store, release, err := connectStore(properties, parameters)
+	if err != nil {
+		return "", err
+	}
+	defer release()
+
+	dir := properties["path"].(string) + "/" + lockDir
+	holder := "unknown"
+	owner, err := readLockOwner(store, dir)
+	if err == nil {
+		holder = owner.Holder
+	} else if _, listErr := store.listDir(dir); listErr != nil {
+		return "", nil
+	}
+	broken, err := breakLock(store, dir, owner)
+	if err == nil && !broken {
+		err = errors.New("the lock changed hands while being broken")
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to break lock held by %s: %w", holder, err)
+	}
+	return holder, nil
+}
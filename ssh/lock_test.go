@@ -0,0 +1,273 @@
+/*
+ * Copyright The Titan Project Contributors.
+ */
+package ssh
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/titan-data/remote-sdk-go/remote"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func withLockTimings(expiry time.Duration, heartbeat time.Duration, timeout time.Duration) func() {
+	lockExpiry, lockHeartbeat, lockTimeout, lockRetryInterval = expiry, heartbeat, timeout, time.Millisecond
+	return func() {
+		lockExpiry, lockHeartbeat, lockTimeout, lockRetryInterval = 2*time.Minute, 30*time.Second, 5*time.Minute,
+			time.Second
+	}
+}
+
+func writeLock(t *testing.T, repo string, owner LockOwner) {
+	content, err := json.Marshal(owner)
+	if assert.NoError(t, err) {
+		assert.NoError(t, os.Mkdir(filepath.Join(repo, lockDir), 0755))
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(repo, lockDir, "owner"), content, 0644))
+	}
+}
+
+func localStore(t *testing.T, repo string) (remoteStore, func()) {
+	mockSFTPDial()
+	store, release, err := connectStore(pushProperties(repo), map[string]interface{}{"password": "password"})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	return store, func() {
+		release()
+		resetSFTPDial()
+	}
+}
+
+func TestLockAcquireRelease(t *testing.T) {
+	repo := writeRepository(t, map[string]string{})
+	defer os.RemoveAll(repo)
+	store, done := localStore(t, repo)
+	defer done()
+
+	lock, err := acquireLock(store, repo)
+	if assert.NoError(t, err) {
+		owner, err := readLockOwner(store, repo+"/"+lockDir)
+		if assert.NoError(t, err) {
+			assert.Equal(t, lockHolder(), owner.Holder)
+			assert.True(t, owner.Expires.After(time.Now()))
+		}
+		assert.NoError(t, lock.release())
+	}
+	entries, err := ioutil.ReadDir(repo)
+	if assert.NoError(t, err) {
+		assert.Empty(t, entries)
+	}
+}
+
+func TestLockHeld(t *testing.T) {
+	repo := writeRepository(t, map[string]string{})
+	defer os.RemoveAll(repo)
+	store, done := localStore(t, repo)
+	defer done()
+	defer withLockTimings(time.Minute, time.Minute, 10*time.Millisecond)()
+
+	writeLock(t, repo, LockOwner{Holder: "someone", Token: "token", Expires: time.Now().Add(time.Minute)})
+	_, err := acquireLock(store, repo)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "someone")
+	}
+
+	err = sshRemote{}.PushCommit(pushProperties(repo), map[string]interface{}{"password": "password"},
+		remote.Commit{Id: "id"}, "", "")
+	assert.Error(t, err)
+	_, err = os.Stat(filepath.Join(repo, "id", "metadata.json"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestLockExpired(t *testing.T) {
+	repo := writeRepository(t, map[string]string{})
+	defer os.RemoveAll(repo)
+	store, done := localStore(t, repo)
+	defer done()
+	defer withLockTimings(10*time.Millisecond, time.Minute, time.Minute)()
+
+	writeLock(t, repo, LockOwner{Holder: "someone", Token: "token", Expires: time.Now().Add(time.Hour)})
+	lock, err := acquireLock(store, repo)
+	if assert.NoError(t, err) {
+		assert.NoError(t, lock.release())
+	}
+}
+
+func TestLockSkewedClock(t *testing.T) {
+	repo := writeRepository(t, map[string]string{})
+	defer os.RemoveAll(repo)
+	store, done := localStore(t, repo)
+	defer done()
+	defer withLockTimings(20*time.Millisecond, time.Minute, 100*time.Millisecond)()
+
+	// The holder keeps renewing the lock, but its clock is far behind ours
+	owner := LockOwner{Holder: "someone", Token: "token", Expires: time.Now().Add(-time.Hour)}
+	writeLock(t, repo, owner)
+	stop := make(chan struct{})
+	renewed := make(chan struct{})
+	go func() {
+		defer close(renewed)
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(5 * time.Millisecond):
+				owner.Expires = owner.Expires.Add(time.Second)
+				content, _ := json.Marshal(owner)
+				ioutil.WriteFile(filepath.Join(repo, lockDir, "owner"), content, 0644)
+			}
+		}
+	}()
+	_, err := acquireLock(store, repo)
+	close(stop)
+	<-renewed
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "someone")
+	}
+}
+
+func TestLockOwnerless(t *testing.T) {
+	repo := writeRepository(t, map[string]string{})
+	defer os.RemoveAll(repo)
+	store, done := localStore(t, repo)
+	defer done()
+	defer withLockTimings(10*time.Millisecond, time.Minute, time.Minute)()
+
+	assert.NoError(t, os.Mkdir(filepath.Join(repo, lockDir), 0755))
+	lock, err := acquireLock(store, repo)
+	if assert.NoError(t, err) {
+		assert.NoError(t, lock.release())
+	}
+}
+
+/*
+ * A store that simulates another client replacing the lock just before it is renamed to be broken.
+ */
+type racingStore struct {
+	remoteStore
+	repo  string
+	owner *LockOwner
+	t     *testing.T
+}
+
+func (r *racingStore) rename(from string, to string) error {
+	if r.owner != nil && from == filepath.Join(r.repo, lockDir) {
+		os.RemoveAll(from)
+		writeLock(r.t, r.repo, *r.owner)
+		r.owner = nil
+	}
+	return r.remoteStore.rename(from, to)
+}
+
+func TestLockBreakRace(t *testing.T) {
+	for _, ownerless := range []bool{false, true} {
+		repo := writeRepository(t, map[string]string{})
+		store, done := localStore(t, repo)
+		restore := withLockTimings(50*time.Millisecond, time.Minute, 75*time.Millisecond)
+
+		if ownerless {
+			assert.NoError(t, os.Mkdir(filepath.Join(repo, lockDir), 0755))
+		} else {
+			writeLock(t, repo, LockOwner{Holder: "old", Token: "old", Expires: time.Now().Add(-time.Second)})
+		}
+		racing := &racingStore{remoteStore: store, repo: repo, t: t,
+			owner: &LockOwner{Holder: "new", Token: "new", Expires: time.Now().Add(time.Minute)}}
+		_, err := acquireLock(racing, repo)
+		if assert.Error(t, err) {
+			assert.Contains(t, err.Error(), "new")
+		}
+		owner, err := readLockOwner(store, repo+"/"+lockDir)
+		if assert.NoError(t, err) {
+			assert.Equal(t, "new", owner.Token)
+		}
+		entries, err := ioutil.ReadDir(repo)
+		if assert.NoError(t, err) {
+			assert.Len(t, entries, 1)
+		}
+
+		restore()
+		done()
+		os.RemoveAll(repo)
+	}
+}
+
+func TestLockMissingRepository(t *testing.T) {
+	repo := writeRepository(t, map[string]string{})
+	defer os.RemoveAll(repo)
+	store, done := localStore(t, repo)
+	defer done()
+
+	_, err := acquireLock(store, filepath.Join(repo, "missing"))
+	assert.Error(t, err)
+}
+
+func TestLockHeartbeat(t *testing.T) {
+	repo := writeRepository(t, map[string]string{})
+	defer os.RemoveAll(repo)
+	store, done := localStore(t, repo)
+	defer done()
+	defer withLockTimings(time.Minute, 5*time.Millisecond, time.Minute)()
+
+	lock, err := acquireLock(store, repo)
+	if assert.NoError(t, err) {
+		first, _ := readLockOwner(store, repo+"/"+lockDir)
+		time.Sleep(50 * time.Millisecond)
+		second, _ := readLockOwner(store, repo+"/"+lockDir)
+		assert.True(t, second.Expires.After(first.Expires))
+		assert.NoError(t, lock.release())
+	}
+}
+
+func TestLockLost(t *testing.T) {
+	repo := writeRepository(t, map[string]string{})
+	defer os.RemoveAll(repo)
+	store, done := localStore(t, repo)
+	defer done()
+
+	lock, err := acquireLock(store, repo)
+	if assert.NoError(t, err) {
+		holder, err := sshRemote{}.BreakLock(pushProperties(repo), map[string]interface{}{"password": "password"})
+		if assert.NoError(t, err) {
+			assert.Equal(t, lockHolder(), holder)
+		}
+		writeLock(t, repo, LockOwner{Holder: "someone", Token: "token", Expires: time.Now().Add(time.Minute)})
+		err = lock.release()
+		if assert.Error(t, err) {
+			assert.Contains(t, err.Error(), "someone")
+		}
+		_, err = os.Stat(filepath.Join(repo, lockDir))
+		assert.NoError(t, err)
+	}
+}
+
+func TestGetLock(t *testing.T) {
+	repo := writeRepository(t, map[string]string{})
+	defer os.RemoveAll(repo)
+	props := pushProperties(repo)
+	params := map[string]interface{}{"password": "password"}
+
+	mockSFTPDial()
+	owner, err := sshRemote{}.GetLock(props, params)
+	if assert.NoError(t, err) {
+		assert.Nil(t, owner)
+	}
+	holder, err := sshRemote{}.BreakLock(props, params)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "", holder)
+	}
+
+	writeLock(t, repo, LockOwner{Holder: "someone", Token: "token", Expires: time.Now().Add(time.Minute)})
+	owner, err = sshRemote{}.GetLock(props, params)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "someone", owner.Holder)
+	}
+	commits, err := sshRemote{}.ListCommits(props, params, []remote.Tag{})
+	if assert.NoError(t, err) {
+		assert.Empty(t, commits)
+	}
+	resetSFTPDial()
+}
@@ -0,0 +1,298 @@
+/*
+ * Copyright The Titan Project Contributors.
+ */
+package ssh
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const manifestVersion = 1
+
+/*
+ * Maximum number of problems reported when a commit fails verification.
+ */
+const maxReportedProblems = 10
+
+/*
+ * The integrity manifest of a commit, stored as manifest.json next to metadata.json. It lists the SHA-256 of every
+ * regular file in the commit data, along with a root hash over the whole list, so that the contents of a commit can
+ * be checked against what was pushed. Manifests written by pushes also hold the signature of every block of each
+ * file, which later delta pushes use to find the blocks they don't need to send. For commits in the objects layout,
+ * the manifest also holds the tree of the commit, since the commit directory holds no data, and the compression of its
+ * objects, so that readers know how to decode them. The manifests of encrypted commits are themselves sealed, and only
+ * list the objects they reference.
+ */
+type manifest struct {
+	Version     int             `json:"version"`
+	BlockSize   int             `json:"blockSize,omitempty"`
+	Files       []manifestFile  `json:"files"`
+	Tree        []manifestEntry `json:"tree,omitempty"`
+	Compression string          `json:"compression,omitempty"`
+	Chunks      []string        `json:"chunks,omitempty"`
+	Sealed      []byte          `json:"sealed,omitempty"`
+	Root        string          `json:"root"`
+}
+
+type manifestFile struct {
+	Name   string          `json:"name"`
+	Size   int64           `json:"size"`
+	SHA256 string          `json:"sha256"`
+	Blocks []manifestBlock `json:"blocks,omitempty"`
+}
+
+/*
+ * The rolling checksum and SHA-256 of a block of a file.
+ */
+type manifestBlock struct {
+	Weak   uint32 `json:"w"`
+	Strong string `json:"s"`
+}
+
+/*
+ * Returns whether a top-level name in a commit directory is part of the commit itself rather than its data.
+ */
+func isCommitFile(name string) bool {
+	return name == "metadata.json" || name == "manifest.json" || name == pushMarker || isTempName(name)
+}
+
+/*
+ * Compute the root hash of a list of file hashes: the SHA-256 of one "<sha256>  <name>" line per file, sorted by
+ * name.
+ */
+func rootHash(files map[string]string) string {
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	h := sha256.New()
+	for _, name := range names {
+		fmt.Fprintf(h, "%s  %s\n", files[name], name)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func hashFile(r io.Reader) (string, int64, error) {
+	h := sha256.New()
+	size, err := io.Copy(h, r)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), size, nil
+}
+
+/*
+ * Hash a file along with each of its blocks.
+ */
+func hashFileBlocks(r io.Reader, blockSize int) (string, int64, []manifestBlock, error) {
+	h := sha256.New()
+	var size int64
+	var blocks []manifestBlock
+	buf := make([]byte, blockSize)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			h.Write(buf[:n])
+			size += int64(n)
+			strong := sha256.Sum256(buf[:n])
+			blocks = append(blocks, manifestBlock{Weak: newRollingSum(buf[:n]).sum(),
+				Strong: hex.EncodeToString(strong[:])})
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return "", 0, nil, err
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), size, blocks, nil
+}
+
+/*
+ * Build the manifest of a local directory, including block signatures if a block size is given.
+ */
+func buildManifest(dir string, blockSize int) (*manifest, error) {
+	m := &manifest{Version: manifestVersion, BlockSize: blockSize, Files: []manifestFile{}}
+	err := filepath.Walk(dir, func(file string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, file)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		if isCommitFile(name) {
+			return nil
+		}
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		entry := manifestFile{Name: name}
+		if blockSize != 0 {
+			entry.SHA256, entry.Size, entry.Blocks, err = hashFileBlocks(f, blockSize)
+		} else {
+			entry.SHA256, entry.Size, err = hashFile(f)
+		}
+		if err != nil {
+			return err
+		}
+		m.Files = append(m.Files, entry)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(m.Files, func(i, j int) bool { return m.Files[i].Name < m.Files[j].Name })
+	m.Root = rootHash(m.hashes())
+	return m, nil
+}
+
+func (m *manifest) hashes() map[string]string {
+	files := map[string]string{}
+	for _, f := range m.Files {
+		files[f.Name] = f.SHA256
+	}
+	return files
+}
+
+/*
+ * Check the actual hashes of the files in a commit against the manifest. Returns an error naming the files that are
+ * missing, unexpected, or modified.
+ */
+func (m *manifest) verify(actual map[string]string) error {
+	expected := m.hashes()
+	if rootHash(expected) != m.Root {
+		return errors.New("manifest is corrupt, its root hash does not match its contents")
+	}
+
+	var problems []string
+	for _, f := range m.Files {
+		sum, ok := actual[f.Name]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("%s is missing", f.Name))
+		} else if sum != f.SHA256 {
+			problems = append(problems, fmt.Sprintf("%s has been modified", f.Name))
+		}
+	}
+	for name := range actual {
+		if _, ok := expected[name]; !ok && !isCommitFile(name) {
+			problems = append(problems, fmt.Sprintf("%s is not in the manifest", name))
+		}
+	}
+	return reportProblems(problems)
+}
+
+func reportProblems(problems []string) error {
+	if len(problems) == 0 {
+		return nil
+	}
+	sort.Strings(problems)
+	if len(problems) > maxReportedProblems {
+		problems = append(problems[:maxReportedProblems], fmt.Sprintf("and %d more",
+			len(problems)-maxReportedProblems))
+	}
+	return fmt.Errorf("integrity check failed: %s", strings.Join(problems, ", "))
+}
+
+/*
+ * Read the manifest of a commit. Returns nil if the commit has no manifest, as is the case for commits pushed by
+ * earlier versions.
+ */
+func readManifest(store remoteStore, dir string) (*manifest, error) {
+	entries, err := store.listDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	found := false
+	for _, e := range entries {
+		found = found || e == "manifest.json"
+	}
+	if !found {
+		return nil, nil
+	}
+
+	content, err := store.readFile(dir + "/manifest.json")
+	if err != nil {
+		return nil, err
+	}
+	m := &manifest{}
+	if err := json.Unmarshal(content, m); err != nil {
+		return nil, fmt.Errorf("invalid manifest: %w", err)
+	}
+	if m.Version != manifestVersion && !m.isObjects() {
+		return nil, fmt.Errorf("unsupported manifest version %d", m.Version)
+	}
+	for hash := range m.objects() {
+		if len(hash) != 64 {
+			return nil, fmt.Errorf("invalid manifest: bad object hash '%s'", hash)
+		}
+	}
+	return m, nil
+}
+
+func writeManifest(store remoteStore, dir string, m *manifest) error {
+	content, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(store, dir+"/manifest.json", content, 0644)
+}
+
+/*
+ * Verify the data of a commit on the remote against its manifest, to detect bit rot or tampering on the storage host.
+ * Whenever commands can be run on the remote host, the hashes are computed there with sha256sum, so no data is
+ * transferred. Over SFTP alone, which has no way to run commands, the data is read and hashed locally. For commits in the objects layout,
+ * only the objects the commit references are hashed and checked, which needs no passphrase for encrypted commits.
+ * Returns the root hash of the verified commit.
+ */
+func (s sshRemote) VerifyCommit(properties map[string]interface{}, parameters map[string]interface{},
+	commitId string) (string, error) {
+	if err := validateCommitId(commitId); err != nil {
+		return "", err
+	}
+
+	store, release, err := connectStore(properties, parameters)
+	if err != nil {
+		return "", err
+	}
+	defer release()
+
+	dir := fmt.Sprintf("%s/%s", properties["path"], commitId)
+	m, err := readManifest(store, dir)
+	if err != nil {
+		return "", err
+	}
+	if m == nil {
+		return "", fmt.Errorf("commit %s has no manifest", commitId)
+	}
+	var actual map[string]string
+	if m.isObjects() {
+		var names []string
+		for hash := range m.objects() {
+			names = append(names, hash[:2]+"/"+hash)
+		}
+		sort.Strings(names)
+		if actual, err = store.hashFileList(fmt.Sprintf("%s/%s", properties["path"], objectsDir), names); err == nil {
+			err = m.verifyObjects(actual)
+		}
+	} else if actual, err = store.hashFiles(dir); err == nil {
+		err = m.verify(actual)
+	}
+	if err != nil {
+		return "", fmt.Errorf("commit %s: %w", commitId, err)
+	}
+	return m.Root, nil
+}
@@ -0,0 +1,171 @@
+/*
+ * Copyright The Titan Project Contributors.
+ */
+package ssh
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/titan-data/remote-sdk-go/remote"
+	"golang.org/x/crypto/ssh"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const (
+	sumContent = "ed7002b439e9ac845f22357d822bac1444730fbdb6016d3ec9432297b9ec9f73"
+	sumEmpty   = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+func TestBuildManifest(t *testing.T) {
+	dir := writeRepository(t, map[string]string{"dir/file": "content", "empty": "", "metadata.json": "{}"})
+	defer os.RemoveAll(dir)
+
+	m, err := buildManifest(dir, 0)
+	if assert.NoError(t, err) {
+		assert.Equal(t, []manifestFile{
+			{Name: "dir/file", Size: 7, SHA256: sumContent},
+			{Name: "empty", Size: 0, SHA256: sumEmpty},
+		}, m.Files)
+		assert.Equal(t, rootHash(map[string]string{"dir/file": sumContent, "empty": sumEmpty}), m.Root)
+		assert.NoError(t, m.verify(map[string]string{"dir/file": sumContent, "empty": sumEmpty,
+			"metadata.json": sumEmpty}))
+	}
+}
+
+func TestBuildManifestNestedTempName(t *testing.T) {
+	dir := writeRepository(t, map[string]string{"dir/.file.tmp-0123": "content", ".metadata.json.tmp-0123": "{}",
+		"dir/metadata.json": ""})
+	defer os.RemoveAll(dir)
+
+	m, err := buildManifest(dir, 0)
+	if assert.NoError(t, err) {
+		assert.Equal(t, []manifestFile{
+			{Name: "dir/.file.tmp-0123", Size: 7, SHA256: sumContent},
+			{Name: "dir/metadata.json", Size: 0, SHA256: sumEmpty},
+		}, m.Files)
+		assert.Error(t, m.verify(map[string]string{"dir/metadata.json": sumEmpty}))
+	}
+}
+
+func TestManifestVerify(t *testing.T) {
+	m := &manifest{Version: manifestVersion, Files: []manifestFile{{Name: "a", SHA256: sumContent},
+		{Name: "b", SHA256: sumContent}}}
+	m.Root = rootHash(m.hashes())
+
+	err := m.verify(map[string]string{"a": sumEmpty, "c": sumEmpty})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "a has been modified")
+		assert.Contains(t, err.Error(), "b is missing")
+		assert.Contains(t, err.Error(), "c is not in the manifest")
+	}
+
+	m.Files[0].SHA256 = sumEmpty
+	err = m.verify(map[string]string{"a": sumEmpty, "b": sumContent})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "corrupt")
+	}
+}
+
+func TestParseChecksums(t *testing.T) {
+	files, err := parseChecksums([]byte(sumContent + "  ./dir/file\n" + "\\" + sumEmpty + "  ./a\\nb\\\\c\n" +
+		sumEmpty + " *./binary\n"))
+	if assert.NoError(t, err) {
+		assert.Equal(t, map[string]string{"dir/file": sumContent, "a\nb\\c": sumEmpty, "binary": sumEmpty}, files)
+	}
+	_, err = parseChecksums([]byte("garbage\n"))
+	assert.Error(t, err)
+}
+
+func pushForVerify(t *testing.T) (string, string) {
+	repo := writeRepository(t, map[string]string{})
+	source := writeRepository(t, map[string]string{"dir/file": "content", "a\nb": "odd name"})
+
+	mockSFTPDial()
+	err := sshRemote{}.PushCommit(pushProperties(repo), map[string]interface{}{"password": "password"},
+		remote.Commit{Id: "id", Properties: map[string]interface{}{}}, source, "")
+	assert.NoError(t, err)
+	return repo, source
+}
+
+func TestVerifyCommit(t *testing.T) {
+	for _, transport := range []string{"sftp", "shell", "auto"} {
+		if _, err := exec.LookPath("sha256sum"); err != nil && transport != "sftp" {
+			continue
+		}
+		repo, source := pushForVerify(t)
+		hashed := false
+		run = func(conn *ssh.Client, command string) ([]byte, error) {
+			hashed = hashed || strings.Contains(command, "sha256sum")
+			return runLocal(conn, command)
+		}
+		props := pushProperties(repo)
+		props["transport"] = transport
+		params := map[string]interface{}{"password": "password"}
+
+		expected, _ := buildManifest(source, 0)
+		root, err := sshRemote{}.VerifyCommit(props, params, "id")
+		if assert.NoError(t, err, transport) {
+			assert.Equal(t, expected.Root, root)
+		}
+
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(repo, "id", "dir", "file"), []byte("tampered"), 0644))
+		_, err = sshRemote{}.VerifyCommit(props, params, "id")
+		if assert.Error(t, err) {
+			assert.Contains(t, err.Error(), "dir/file has been modified")
+		}
+		// The data is only read over SFTP when no commands can be run
+		assert.Equal(t, transport != "sftp", hashed, transport)
+		run = runCommand
+		resetSFTPDial()
+		os.RemoveAll(repo)
+		os.RemoveAll(source)
+	}
+}
+
+func TestVerifyCommitNoManifest(t *testing.T) {
+	repo := writeRepository(t, map[string]string{"id/metadata.json": "{}"})
+	defer os.RemoveAll(repo)
+
+	mockSFTPDial()
+	_, err := sshRemote{}.VerifyCommit(pushProperties(repo), map[string]interface{}{"password": "password"}, "id")
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "no manifest")
+	}
+	resetSFTPDial()
+}
+
+func TestPullCommitTampered(t *testing.T) {
+	repo, source := pushForVerify(t)
+	defer os.RemoveAll(repo)
+	defer os.RemoveAll(source)
+	local := writeRepository(t, map[string]string{})
+	defer os.RemoveAll(local)
+	params := map[string]interface{}{"password": "password"}
+
+	_, err := sshRemote{}.PullCommit(pushProperties(repo), params, "id", filepath.Join(local, "good"), "")
+	assert.NoError(t, err)
+
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(repo, "id", "extra"), []byte("extra"), 0644))
+	_, err = sshRemote{}.PullCommit(pushProperties(repo), params, "id", filepath.Join(local, "bad"), "")
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "extra is not in the manifest")
+	}
+	entries, _ := ioutil.ReadDir(local)
+	assert.Len(t, entries, 1)
+	resetSFTPDial()
+}
+
+func TestPushCommitSourceManifest(t *testing.T) {
+	source := writeRepository(t, map[string]string{"manifest.json": "{}"})
+	defer os.RemoveAll(source)
+
+	err := sshRemote{}.PushCommit(pushProperties("/path"), map[string]interface{}{"password": "password"},
+		remote.Commit{Id: "id"}, source, "")
+	if assert.Error(t, err) {
+		assert.True(t, strings.Contains(err.Error(), "manifest.json"))
+	}
+}
@@ -0,0 +1,432 @@
+/*
+ * Copyright The Titan Project Contributors.
+ */
+package ssh
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+const (
+	layoutFiles   = "files"
+	layoutObjects = "objects"
+)
+
+/*
+ * Name of the directory within the repository that holds the chunks of commits pushed with the objects layout. It is
+ * hidden, so it never shows up as a commit.
+ */
+const objectsDir = ".objects"
+
+/*
+ * Version of the manifests of commits pushed with the objects layout. Earlier versions refuse such manifests, rather
+ * than mistaking the commit for an empty one.
+ */
+const objectsManifestVersion = 2
+
+/*
+ * Bounds on the size of chunks. Boundaries are chosen where the rolling hash of the data matches chunkMask, giving an
+ * average chunk size of about 256KiB above the minimum.
+ */
+const (
+	minChunkSize = 64 * 1024
+	maxChunkSize = 1024 * 1024
+	chunkMask    = 1<<18 - 1
+)
+
+/*
+ * Random values for the gear hash used to find chunk boundaries. They are derived from SHA-256 rather than a random
+ * number generator, since boundaries must never change: data chunked differently no longer deduplicates.
+ */
+var gearTable [256]uint64
+
+func init() {
+	for i := range gearTable {
+		sum := sha256.Sum256([]byte{byte(i)})
+		gearTable[i] = binary.BigEndian.Uint64(sum[:8])
+	}
+}
+
+/*
+ * Returns the configured 'layout' property, defaulting to storing commits as plain files.
+ */
+func getLayout(properties map[string]interface{}) string {
+	if layout, ok := properties["layout"].(string); ok && layout != "" {
+		return layout
+	}
+	return layoutFiles
+}
+
+/*
+ * Validate the 'layout' property. Commits in the objects layout already share their data, so delta transfers don't
+ * apply to them.
+ */
+func validateLayout(layout string, mode string) error {
+	if layout != layoutFiles && layout != layoutObjects {
+		return fmt.Errorf("invalid layout '%s', must be one of '%s' or '%s'", layout, layoutFiles, layoutObjects)
+	}
+	if layout == layoutObjects && mode == transferDelta {
+		return fmt.Errorf("transfer mode '%s' cannot be used with the '%s' layout", transferDelta, layoutObjects)
+	}
+	return nil
+}
+
+/*
+ * An entry of the tree of a commit in the objects layout. Regular files list the chunks that make up their contents.
+ */
+type manifestEntry struct {
+	Name    string          `json:"name"`
+	Mode    os.FileMode     `json:"mode"`
+	ModTime time.Time       `json:"modTime"`
+	Size    int64           `json:"size,omitempty"`
+	Link    string          `json:"link,omitempty"`
+	Chunks  []manifestChunk `json:"chunks,omitempty"`
+}
+
+type manifestChunk struct {
+	Hash string `json:"h"`
+	Size int64  `json:"n"`
+}
+
+/*
+ * Returns the path of the object holding the chunk with the given hash. Objects are spread over subdirectories by the
+ * first byte of their hash, to keep directories at a manageable size.
+ */
+func objectPath(path string, hash string) string {
+	return fmt.Sprintf("%s/%s/%s/%s", path, objectsDir, hash[:2], hash)
+}
+
+/*
+ * Splits data into chunks using content-defined chunking, so that inserting or removing data only changes the chunks
+ * around the change, and the rest still deduplicate against earlier commits.
+ */
+type chunker struct {
+	r   io.Reader
+	buf []byte
+	eof bool
+}
+
+func newChunker(r io.Reader) *chunker {
+	return &chunker{r: r}
+}
+
+/*
+ * Returns the next chunk, or io.EOF once all data has been read.
+ */
+func (c *chunker) next() ([]byte, error) {
+	if len(c.buf) < maxChunkSize && !c.eof {
+		start := len(c.buf)
+		c.buf = append(c.buf, make([]byte, maxChunkSize-start)...)
+		n, err := io.ReadFull(c.r, c.buf[start:])
+		c.buf = c.buf[:start+n]
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			c.eof = true
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	if len(c.buf) == 0 {
+		return nil, io.EOF
+	}
+
+	size := chunkBoundary(c.buf)
+	chunk := make([]byte, size)
+	copy(chunk, c.buf)
+	c.buf = append(c.buf[:0], c.buf[size:]...)
+	return chunk, nil
+}
+
+/*
+ * Returns the length of the first chunk of the given data.
+ */
+func chunkBoundary(data []byte) int {
+	if len(data) <= minChunkSize {
+		return len(data)
+	}
+	var h uint64
+	for i := minChunkSize; i < len(data) && i < maxChunkSize; i++ {
+		h = h<<1 + gearTable[data[i]]
+		if h&chunkMask == 0 {
+			return i + 1
+		}
+	}
+	if len(data) < maxChunkSize {
+		return len(data)
+	}
+	return maxChunkSize
+}
+
+/*
+ * Writes chunks to the objects directory of a repository, skipping those already stored. The objects present are
+ * listed once per subdirectory, which is safe since writers hold the repository lock. Chunks are compressed and then
+ * encrypted if so configured, and objects are named by the hash of what is stored.
+ */
+type objectWriter struct {
+	store       remoteStore
+	path        string
+	key         *cipherKey
+	compression string
+	known       map[string]map[string]bool
+}
+
+func (w *objectWriter) put(chunk []byte) (manifestChunk, error) {
+	size := int64(len(chunk))
+	chunk, err := compressChunk(chunk, w.compression)
+	if err != nil {
+		return manifestChunk{}, err
+	}
+	if w.key != nil {
+		chunk = w.key.sealChunk(chunk)
+	}
+	sum := sha256.Sum256(chunk)
+	hash := hex.EncodeToString(sum[:])
+	prefix := hash[:2]
+	known, ok := w.known[prefix]
+	if !ok {
+		known = map[string]bool{}
+		dir := fmt.Sprintf("%s/%s/%s", w.path, objectsDir, prefix)
+		if entries, err := w.store.listDir(dir); err == nil {
+			for _, e := range entries {
+				known[e] = true
+			}
+		} else if err := w.store.mkdirAll(dir); err != nil {
+			return manifestChunk{}, err
+		}
+		w.known[prefix] = known
+	}
+	if !known[hash] {
+		if err := writeFileAtomic(w.store, objectPath(w.path, hash), chunk, 0444); err != nil {
+			return manifestChunk{}, fmt.Errorf("failed to write object %s: %w", hash, err)
+		}
+		known[hash] = true
+	}
+	return manifestChunk{Hash: hash, Size: size}, nil
+}
+
+/*
+ * Upload the contents of a local directory to the objects directory of a repository, and return the manifest of the
+ * commit that describes it. The commit directory then only holds the manifest, which lists the chunks of every file.
+ * Chunks already stored, whether by other commits or by an interrupted attempt at the same push, are not uploaded
+ * again. Chunks are compressed as given, and encrypted with the key, if one is given. The compression is recorded in
+ * the manifest rather than in metadata.json, next to the objects it decodes, and where it is sealed along with them.
+ */
+func uploadObjects(store remoteStore, source string, path string, key *cipherKey,
+	compression string) (*manifest, error) {
+	w := &objectWriter{store: store, path: path, key: key, compression: compression,
+		known: map[string]map[string]bool{}}
+	m := &manifest{Version: objectsManifestVersion, Files: []manifestFile{}}
+	if compression != compressionNone {
+		m.Compression = compression
+	}
+	err := filepath.Walk(source, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(source, file)
+		if err != nil || rel == "." {
+			return err
+		}
+		entry := manifestEntry{Name: filepath.ToSlash(rel), Mode: info.Mode(), ModTime: info.ModTime().UTC()}
+
+		switch {
+		case info.IsDir():
+		case info.Mode()&os.ModeSymlink != 0:
+			if entry.Link, err = os.Readlink(file); err != nil {
+				return err
+			}
+		case info.Mode().IsRegular():
+			f, err := os.Open(file)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			h := sha256.New()
+			c := newChunker(io.TeeReader(f, h))
+			for {
+				chunk, err := c.next()
+				if err == io.EOF {
+					break
+				} else if err != nil {
+					return err
+				}
+				ref, err := w.put(chunk)
+				if err != nil {
+					return err
+				}
+				entry.Chunks = append(entry.Chunks, ref)
+				entry.Size += ref.Size
+			}
+			m.Files = append(m.Files, manifestFile{Name: entry.Name, Size: entry.Size,
+				SHA256: hex.EncodeToString(h.Sum(nil))})
+		default:
+			return fmt.Errorf("unsupported file type for %s", file)
+		}
+		m.Tree = append(m.Tree, entry)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(m.Files, func(i, j int) bool { return m.Files[i].Name < m.Files[j].Name })
+	m.Root = rootHash(m.hashes())
+	return m, nil
+}
+
+/*
+ * Reads the contents of a file from its chunks, starting at an offset, and checks each chunk against its hash. Chunks
+ * are decrypted with the key, if one is given, and then decompressed.
+ */
+type chunkReader struct {
+	store       remoteStore
+	path        string
+	key         *cipherKey
+	compression string
+	chunks      []manifestChunk
+	offset      int64
+	buf         []byte
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if len(r.chunks) == 0 {
+			return 0, io.EOF
+		}
+		chunk := r.chunks[0]
+		r.chunks = r.chunks[1:]
+		if r.offset >= chunk.Size {
+			r.offset -= chunk.Size
+			continue
+		}
+		data, err := r.store.readFile(objectPath(r.path, chunk.Hash))
+		if err != nil {
+			return 0, fmt.Errorf("failed to read object %s: %w", chunk.Hash, err)
+		}
+		sum := sha256.Sum256(data)
+		if hex.EncodeToString(sum[:]) == chunk.Hash && r.key != nil {
+			data, err = r.key.openChunk(data)
+		}
+		if err == nil {
+			data, err = decompressChunk(data, r.compression)
+		}
+		if err != nil || int64(len(data)) != chunk.Size || hex.EncodeToString(sum[:]) != chunk.Hash {
+			return 0, fmt.Errorf("object %s is corrupt", chunk.Hash)
+		}
+		r.buf = data[r.offset:]
+		r.offset = 0
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+/*
+ * Walk the tree of a commit in the objects layout, in the same manner as remoteStore.readTree(). Files are reassembled
+ * from their chunks, each of which is checked against its hash, and decompressed as recorded in the manifest. The key
+ * decrypts the chunks of encrypted commits, and is nil otherwise.
+ */
+func readObjectTree(store remoteStore, path string, key *cipherKey, m *manifest, resume *treeResume,
+	fn func(entry treeEntry, r io.Reader) error) error {
+	for _, e := range m.Tree {
+		if resume != nil && resume.done[e.Name] {
+			continue
+		}
+		entry := treeEntry{name: e.Name, mode: e.Mode, size: e.Size, modTime: e.ModTime, link: e.Link}
+		if resume != nil && resume.partial != nil && resume.partial.name == e.Name {
+			entry.offset = resume.partial.offset
+		}
+		var r io.Reader = bytes.NewReader(nil)
+		if e.Mode.IsRegular() {
+			r = &chunkReader{store: store, path: path, key: key, compression: m.Compression, chunks: e.Chunks,
+				offset: entry.offset}
+		}
+		if err := fn(entry, r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+ * Returns whether a manifest describes a commit in the objects layout.
+ */
+func (m *manifest) isObjects() bool {
+	return m.Version == objectsManifestVersion || m.Version == encryptedManifestVersion
+}
+
+/*
+ * Returns the objects referenced by a manifest in the objects layout, along with the name of a file that uses each of
+ * them. The files of encrypted commits are not known, so their names are left empty.
+ */
+func (m *manifest) objects() map[string]string {
+	objects := map[string]string{}
+	for _, hash := range m.Chunks {
+		objects[hash] = ""
+	}
+	for _, e := range m.Tree {
+		for _, c := range e.Chunks {
+			if _, ok := objects[c.Hash]; !ok {
+				objects[c.Hash] = e.Name
+			}
+		}
+	}
+	return objects
+}
+
+/*
+ * Returns the objects referenced by a manifest that are not in the objects directory of the repository at the given
+ * path. Pushes upload objects without holding the repository lock, so garbage collection may remove an object that a
+ * push found already stored before the push is published.
+ */
+func missingObjects(store remoteStore, path string, m *manifest) ([]string, error) {
+	entries, err := store.listFiles(path+"/"+objectsDir, 2)
+	if err != nil {
+		return nil, err
+	}
+	stored := map[string]bool{}
+	for _, e := range entries {
+		stored[e.name] = true
+	}
+	var missing []string
+	for hash := range m.objects() {
+		if !stored[hash[:2]+"/"+hash] {
+			missing = append(missing, hash)
+		}
+	}
+	sort.Strings(missing)
+	return missing, nil
+}
+
+/*
+ * Check the objects referenced by a manifest against the actual hashes of the objects directory, keyed by path
+ * relative to it. Returns an error naming the objects that are missing or modified. The files of encrypted commits
+ * are sealed, so their root hash can only be checked once they are decrypted.
+ */
+func (m *manifest) verifyObjects(actual map[string]string) error {
+	if m.Sealed == nil && rootHash(m.hashes()) != m.Root {
+		return errors.New("manifest is corrupt, its root hash does not match its contents")
+	}
+	var problems []string
+	for hash, name := range m.objects() {
+		object := "object " + hash
+		if name != "" {
+			object += " of " + name
+		}
+		sum, ok := actual[hash[:2]+"/"+hash]
+		if !ok {
+			problems = append(problems, object+" is missing")
+		} else if sum != hash {
+			problems = append(problems, object+" has been modified")
+		}
+	}
+	return reportProblems(problems)
+}
@@ -0,0 +1,291 @@
+/*
+ * Copyright The Titan Project Contributors.
+ */
+package ssh
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"github.com/titan-data/remote-sdk-go/remote"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func chunkHashes(t *testing.T, data []byte) []string {
+	var hashes []string
+	c := newChunker(bytes.NewReader(data))
+	var joined []byte
+	for {
+		chunk, err := c.next()
+		if err == io.EOF {
+			break
+		}
+		if !assert.NoError(t, err) {
+			break
+		}
+		assert.True(t, len(chunk) <= maxChunkSize)
+		joined = append(joined, chunk...)
+		hashes = append(hashes, string(chunk))
+	}
+	assert.Equal(t, data, joined)
+	return hashes
+}
+
+func TestChunker(t *testing.T) {
+	data := randomData(5*maxChunkSize, 6)
+	before := chunkHashes(t, data)
+	assert.True(t, len(before) > 5)
+
+	changed := append(append(append([]byte{}, data[:2*maxChunkSize]...), []byte("inserted")...),
+		data[2*maxChunkSize:]...)
+	after := chunkHashes(t, changed)
+	shared := map[string]bool{}
+	for _, h := range before {
+		shared[h] = true
+	}
+	unchanged := 0
+	for _, h := range after {
+		if shared[h] {
+			unchanged++
+		}
+	}
+	assert.True(t, unchanged >= len(before)-2)
+}
+
+func TestChunkerEmpty(t *testing.T) {
+	_, err := newChunker(bytes.NewReader(nil)).next()
+	assert.Equal(t, io.EOF, err)
+}
+
+/*
+ * Create a source directory with the same contents as the commit written by writeCommitData().
+ */
+func writeSourceData(t *testing.T) (string, string) {
+	dir := writeCommitData(t)
+	assert.NoError(t, os.Remove(filepath.Join(dir, "id", "metadata.json")))
+	return dir, filepath.Join(dir, "id")
+}
+
+func countObjects(t *testing.T, repo string) int {
+	count := 0
+	filepath.Walk(filepath.Join(repo, objectsDir), func(file string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			count++
+		}
+		return nil
+	})
+	return count
+}
+
+func TestObjectsLayout(t *testing.T) {
+	for _, transport := range []string{"sftp", "shell"} {
+		repo := writeRepository(t, map[string]string{})
+		dir, source := writeSourceData(t)
+		local := writeRepository(t, map[string]string{})
+
+		mockSFTPDial()
+		run = runLocal
+		runInput = runLocalInput
+		props := pushProperties(repo)
+		props["transport"] = transport
+		props["layout"] = "objects"
+		params := map[string]interface{}{"password": "password"}
+		err := sshRemote{}.PushCommit(props, params, remote.Commit{Id: "one",
+			Properties: map[string]interface{}{"a": "b"}}, source, "")
+		assert.NoError(t, err, transport)
+		entries, _ := ioutil.ReadDir(filepath.Join(repo, "one"))
+		assert.Len(t, entries, 2)
+		objects := countObjects(t, repo)
+		assert.True(t, objects > 0)
+
+		// Pushing the same data again adds no objects
+		err = sshRemote{}.PushCommit(props, params, remote.Commit{Id: "two",
+			Properties: map[string]interface{}{"a": "c"}}, source, "")
+		assert.NoError(t, err)
+		assert.Equal(t, objects, countObjects(t, repo))
+
+		commits, err := sshRemote{}.ListCommits(props, params, []remote.Tag{})
+		if assert.NoError(t, err) {
+			assert.Len(t, commits, 2)
+		}
+		commit, err := sshRemote{}.GetCommit(props, params, "one")
+		if assert.NoError(t, err) {
+			assert.Equal(t, "b", commit.Properties["a"])
+		}
+
+		_, err = sshRemote{}.PullCommit(props, params, "two", filepath.Join(local, "dest"), "")
+		if assert.NoError(t, err, transport) {
+			checkCommitData(t, filepath.Join(local, "dest"))
+		}
+		_, err = sshRemote{}.VerifyCommit(pushProperties(repo), params, "one")
+		assert.NoError(t, err)
+
+		run = runCommand
+		runInput = runCommandInput
+		resetSFTPDial()
+		os.RemoveAll(repo)
+		os.RemoveAll(dir)
+		os.RemoveAll(local)
+	}
+}
+
+func TestObjectsLayoutCorrupt(t *testing.T) {
+	repo := writeRepository(t, map[string]string{})
+	defer os.RemoveAll(repo)
+	dir, source := writeSourceData(t)
+	defer os.RemoveAll(dir)
+	local := writeRepository(t, map[string]string{})
+	defer os.RemoveAll(local)
+
+	mockSFTPDial()
+	props := pushProperties(repo)
+	props["layout"] = "objects"
+	params := map[string]interface{}{"password": "password"}
+	err := sshRemote{}.PushCommit(props, params, remote.Commit{Id: "id"}, source, "")
+	assert.NoError(t, err)
+
+	var object string
+	filepath.Walk(filepath.Join(repo, objectsDir), func(file string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() && info.Size() == 7 {
+			object = file
+		}
+		return nil
+	})
+	if assert.NotEmpty(t, object) {
+		assert.NoError(t, os.Chmod(object, 0644))
+		assert.NoError(t, ioutil.WriteFile(object, []byte("CONTENT"), 0644))
+	}
+	_, err = sshRemote{}.VerifyCommit(props, params, "id")
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "has been modified")
+	}
+	_, err = sshRemote{}.PullCommit(props, params, "id", filepath.Join(local, "dest"), "")
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "is corrupt")
+	}
+	_, err = os.Stat(filepath.Join(local, "dest"))
+	assert.True(t, os.IsNotExist(err))
+	resetSFTPDial()
+}
+
+func TestMissingObjects(t *testing.T) {
+	repo := writeRepository(t, map[string]string{})
+	defer os.RemoveAll(repo)
+	dir, source := writeSourceData(t)
+	defer os.RemoveAll(dir)
+	store, done := localStore(t, repo)
+	defer done()
+
+	m, err := uploadObjects(store, source, repo, nil, compressionNone)
+	if !assert.NoError(t, err) {
+		return
+	}
+	missing, err := missingObjects(store, repo, m)
+	if assert.NoError(t, err) {
+		assert.Empty(t, missing)
+	}
+	for hash := range m.objects() {
+		assert.NoError(t, os.Remove(filepath.Join(repo, objectsDir, hash[:2], hash)))
+		missing, err = missingObjects(store, repo, m)
+		if assert.NoError(t, err) {
+			assert.Equal(t, []string{hash}, missing)
+		}
+		break
+	}
+}
+
+func TestVerifyObjectsReferenced(t *testing.T) {
+	for _, transport := range []string{"sftp", "shell"} {
+		repo := writeRepository(t, map[string]string{})
+		dir, source := writeSourceData(t)
+
+		mockSFTPDial()
+		run = runLocal
+		runInput = runLocalInput
+		props := pushProperties(repo)
+		props["layout"] = "objects"
+		props["transport"] = transport
+		params := map[string]interface{}{"password": "password"}
+		assert.NoError(t, sshRemote{}.PushCommit(props, params, remote.Commit{Id: "id"}, source, ""))
+
+		// Objects that the commit doesn't reference are not checked
+		unreferenced := filepath.Join(repo, objectsDir, "00", strings.Repeat("0", 64))
+		assert.NoError(t, os.MkdirAll(filepath.Dir(unreferenced), 0755))
+		assert.NoError(t, ioutil.WriteFile(unreferenced, []byte("garbage"), 0644))
+		var names []string
+		filepath.Walk(filepath.Join(repo, objectsDir), func(file string, info os.FileInfo, err error) error {
+			if err == nil && info.Mode().IsRegular() && file != unreferenced {
+				names = append(names, file)
+			}
+			return nil
+		})
+		_, err := sshRemote{}.VerifyCommit(props, params, "id")
+		assert.NoError(t, err, transport)
+
+		if assert.NotEmpty(t, names) {
+			assert.NoError(t, os.Remove(names[0]))
+		}
+		_, err = sshRemote{}.VerifyCommit(props, params, "id")
+		if assert.Error(t, err, transport) {
+			assert.Contains(t, err.Error(), "is missing")
+		}
+
+		run = runCommand
+		runInput = runCommandInput
+		resetSFTPDial()
+		os.RemoveAll(repo)
+		os.RemoveAll(dir)
+	}
+}
+
+func TestHashFileList(t *testing.T) {
+	repo := writeRepository(t, map[string]string{"ab/one": "content", "ab/two": "content"})
+	defer os.RemoveAll(repo)
+	store, done := localStore(t, repo)
+	defer done()
+	run = runLocal
+	runInput = runLocalInput
+	defer func() {
+		run = runCommand
+		runInput = runCommandInput
+	}()
+
+	for _, s := range []remoteStore{store, &shellStore{}} {
+		files, err := s.hashFileList(repo, []string{"ab/one", "ab/missing"})
+		if assert.NoError(t, err) {
+			assert.Equal(t, map[string]string{"ab/one": sumContent}, files)
+		}
+		files, err = s.hashFileList(repo, nil)
+		if assert.NoError(t, err) {
+			assert.Empty(t, files)
+		}
+	}
+}
+
+func TestLayoutProperty(t *testing.T) {
+	r := remote.Get("ssh")
+	props, err := r.FromURL("ssh://user@host/path", map[string]string{"layout": "objects"})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "objects", props["layout"])
+		assert.NoError(t, r.ValidateRemote(props))
+		_, extra, err := r.ToURL(props)
+		if assert.NoError(t, err) {
+			assert.Equal(t, "objects", extra["layout"])
+		}
+	}
+}
+
+func TestLayoutBadProperty(t *testing.T) {
+	r := remote.Get("ssh")
+	_, err := r.FromURL("ssh://user@host/path", map[string]string{"layout": "chunks"})
+	assert.Error(t, err)
+	_, err = r.FromURL("ssh://user@host/path", map[string]string{"layout": "objects", "transferMode": "delta"})
+	assert.Error(t, err)
+	err = r.ValidateRemote(map[string]interface{}{"username": "username", "address": "host", "path": "/path",
+		"layout": "chunks"})
+	assert.Error(t, err)
+}
@@ -0,0 +1,179 @@
+/*
+ * Copyright The Titan Project Contributors.
+ */
+package ssh
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"sync"
+	"time"
+)
+
+/*
+ * How long an unused connection is kept open for reuse by later operations.
+ */
+const defaultIdleTimeout = 2 * time.Minute
+
+type pooledConn struct {
+	client   *ssh.Client
+	refs     int
+	lastUsed time.Time
+}
+
+/*
+ * Cache of open connections, so that a sequence of operations against the same remote (such as ListCommits followed
+ * by several GetCommit calls when running under remote.Serve) pays for the TCP connection, key exchange, and
+ * authentication only once. Connections are shared between concurrent callers, checked with a keepalive request
+ * before being reused, and closed once they have been idle for the idle timeout.
+ */
+type connPool struct {
+	mu          sync.Mutex
+	conns       map[string]*pooledConn
+	idleTimeout time.Duration
+}
+
+func newConnPool(idleTimeout time.Duration) *connPool {
+	return &connPool{conns: map[string]*pooledConn{}, idleTimeout: idleTimeout}
+}
+
+var connections = newConnPool(defaultIdleTimeout)
+
+/*
+ * Build the cache key for a remote. Connections are only shared between remotes with the same user, address, proxy
+ * chain, host key settings, and authentication identity. Credentials are hashed rather than stored in the key.
+ */
+func poolKey(properties map[string]interface{}, parameters map[string]interface{}) (string, error) {
+	address, err := getAddress(properties)
+	if err != nil {
+		return "", err
+	}
+	identity := sha256.New()
+	for _, v := range []interface{}{properties["password"], parameters["password"], parameters["key"],
+		parameters["passphrase"], useAgent(properties)} {
+		fmt.Fprintf(identity, "%v\x00", v)
+	}
+	return fmt.Sprintf("%v@%s|%v|%v|%v|%s", properties["username"], address, properties["proxyJump"],
+		properties["hostKey"], properties["knownHostsFile"], hex.EncodeToString(identity.Sum(nil))), nil
+}
+
+/*
+ * How long to wait for the reply to a keepalive request. A half-open connection, such as one left behind by a dropped
+ * VPN, never replies, and would otherwise block until the operating system gives up on the socket.
+ */
+var keepaliveTimeout = 5 * time.Second
+
+/*
+ * Returns true if the connection is still usable. The keepalive request fails only if the connection is broken; a
+ * server that doesn't understand the request still replies. A connection that doesn't reply within the keepalive
+ * timeout is considered dead, and closing it unblocks the request.
+ */
+func isAlive(client *ssh.Client) bool {
+	reply := make(chan error, 1)
+	go func() {
+		_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+		reply <- err
+	}()
+	select {
+	case err := <-reply:
+		return err == nil
+	case <-time.After(keepaliveTimeout):
+		return false
+	}
+}
+
+/*
+ * Get a connection for the remote, reusing a cached connection if possible. The returned function must be called
+ * once the caller is done with the connection, instead of closing it.
+ */
+func (p *connPool) get(properties map[string]interface{}, parameters map[string]interface{}) (*ssh.Client, func(), error) {
+	key, err := poolKey(properties, parameters)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	p.mu.Lock()
+	entry, ok := p.conns[key]
+	if ok {
+		entry.refs++
+	}
+	p.mu.Unlock()
+
+	if ok {
+		if isAlive(entry.client) {
+			return entry.client, p.releaser(key, entry), nil
+		}
+		p.mu.Lock()
+		entry.refs--
+		if p.conns[key] == entry {
+			delete(p.conns, key)
+		}
+		p.mu.Unlock()
+		entry.client.Close()
+	}
+
+	client, err := getConnection(properties, parameters)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, exists := p.conns[key]; exists {
+		// Another caller connected concurrently, so don't cache this one
+		return client, func() { client.Close() }, nil
+	}
+	entry = &pooledConn{client: client, refs: 1}
+	p.conns[key] = entry
+	return client, p.releaser(key, entry), nil
+}
+
+func (p *connPool) releaser(key string, entry *pooledConn) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			entry.refs--
+			entry.lastUsed = time.Now()
+			if entry.refs == 0 {
+				time.AfterFunc(p.idleTimeout, p.evictIdle)
+			}
+		})
+	}
+}
+
+/*
+ * Close any connections that are not in use and have been idle for at least the idle timeout.
+ */
+func (p *connPool) evictIdle() {
+	p.mu.Lock()
+	var idle []*ssh.Client
+	for key, entry := range p.conns {
+		if entry.refs == 0 && time.Since(entry.lastUsed) >= p.idleTimeout {
+			idle = append(idle, entry.client)
+			delete(p.conns, key)
+		}
+	}
+	p.mu.Unlock()
+
+	for _, client := range idle {
+		client.Close()
+	}
+}
+
+/*
+ * Close all cached connections, regardless of whether they are in use.
+ */
+func (p *connPool) closeAll() {
+	p.mu.Lock()
+	conns := p.conns
+	p.conns = map[string]*pooledConn{}
+	p.mu.Unlock()
+
+	for _, entry := range conns {
+		entry.client.Close()
+	}
+}
@@ -0,0 +1,220 @@
+/*
+ * Copyright The Titan Project Contributors.
+ */
+package ssh
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newMockClient(alive bool) (*ssh.Client, *MockConn) {
+	conn := new(MockConn)
+	conn.On("Close").Return(nil)
+	if alive {
+		conn.On("SendRequest", "keepalive@openssh.com", true, []byte(nil)).Return(false, []byte(nil), nil)
+	} else {
+		conn.On("SendRequest", "keepalive@openssh.com", true, []byte(nil)).Return(false, []byte(nil),
+			errors.New("EOF"))
+	}
+	return &ssh.Client{Conn: conn}, conn
+}
+
+func TestPoolReuse(t *testing.T) {
+	var dials int32
+	client, conn := newMockClient(true)
+	dial = func(network string, addr string, cfg *ssh.ClientConfig) (*ssh.Client, error) {
+		atomic.AddInt32(&dials, 1)
+		return client, nil
+	}
+	pool := newConnPool(time.Minute)
+	props := map[string]interface{}{"username": "username", "address": "address"}
+	params := map[string]interface{}{"password": "password"}
+
+	first, release, err := pool.get(props, params)
+	if assert.NoError(t, err) {
+		release()
+		release()
+		second, release, err := pool.get(props, params)
+		if assert.NoError(t, err) {
+			release()
+			assert.Equal(t, first, second)
+		}
+	}
+	assert.Equal(t, int32(1), dials)
+	conn.AssertNotCalled(t, "Close")
+
+	pool.closeAll()
+	conn.AssertCalled(t, "Close")
+	dial = ssh.Dial
+}
+
+func TestPoolDeadConnection(t *testing.T) {
+	dead, deadConn := newMockClient(false)
+	alive, _ := newMockClient(true)
+	clients := []*ssh.Client{dead, alive}
+	dial = func(network string, addr string, cfg *ssh.ClientConfig) (*ssh.Client, error) {
+		c := clients[0]
+		clients = clients[1:]
+		return c, nil
+	}
+	pool := newConnPool(time.Minute)
+	props := map[string]interface{}{"username": "username", "address": "address"}
+	params := map[string]interface{}{"password": "password"}
+
+	_, release, err := pool.get(props, params)
+	if assert.NoError(t, err) {
+		release()
+		client, release, err := pool.get(props, params)
+		if assert.NoError(t, err) {
+			release()
+			assert.Equal(t, alive, client)
+			deadConn.AssertCalled(t, "Close")
+		}
+	}
+	pool.closeAll()
+	dial = ssh.Dial
+}
+
+func TestPoolUnresponsiveConnection(t *testing.T) {
+	keepaliveTimeout = 10 * time.Millisecond
+	hung := new(MockConn)
+	hung.On("Close").Return(nil)
+	hung.On("SendRequest", "keepalive@openssh.com", true, []byte(nil)).After(time.Second).Return(false,
+		[]byte(nil), nil)
+	alive, _ := newMockClient(true)
+	clients := []*ssh.Client{{Conn: hung}, alive}
+	dial = func(network string, addr string, cfg *ssh.ClientConfig) (*ssh.Client, error) {
+		c := clients[0]
+		clients = clients[1:]
+		return c, nil
+	}
+	pool := newConnPool(time.Minute)
+	props := map[string]interface{}{"username": "username", "address": "address"}
+	params := map[string]interface{}{"password": "password"}
+
+	_, release, err := pool.get(props, params)
+	if assert.NoError(t, err) {
+		release()
+		start := time.Now()
+		client, release, err := pool.get(props, params)
+		if assert.NoError(t, err) {
+			release()
+			assert.Equal(t, alive, client)
+			assert.True(t, time.Since(start) < time.Second)
+			hung.AssertCalled(t, "Close")
+		}
+	}
+	pool.closeAll()
+	dial = ssh.Dial
+	keepaliveTimeout = 5 * time.Second
+}
+
+func TestPoolSeparateIdentities(t *testing.T) {
+	var dials int32
+	dial = func(network string, addr string, cfg *ssh.ClientConfig) (*ssh.Client, error) {
+		atomic.AddInt32(&dials, 1)
+		client, _ := newMockClient(true)
+		return client, nil
+	}
+	pool := newConnPool(time.Minute)
+	for _, params := range []map[string]interface{}{{"password": "one"}, {"password": "two"}, {"password": "one"}} {
+		_, release, err := pool.get(map[string]interface{}{"username": "username", "address": "address"}, params)
+		if assert.NoError(t, err) {
+			release()
+		}
+	}
+	_, release, err := pool.get(map[string]interface{}{"username": "username", "address": "address", "port": 8022},
+		map[string]interface{}{"password": "one"})
+	if assert.NoError(t, err) {
+		release()
+	}
+	assert.Equal(t, int32(3), dials)
+	pool.closeAll()
+	dial = ssh.Dial
+}
+
+func TestPoolKeyHidesCredentials(t *testing.T) {
+	key, err := poolKey(map[string]interface{}{"username": "username", "address": "address", "password": "secret"},
+		map[string]interface{}{"key": "PRIVATE KEY"})
+	if assert.NoError(t, err) {
+		assert.False(t, strings.Contains(key, "secret"))
+		assert.False(t, strings.Contains(key, "PRIVATE KEY"))
+	}
+}
+
+func TestPoolIdleTimeout(t *testing.T) {
+	client, conn := newMockClient(true)
+	dial = func(network string, addr string, cfg *ssh.ClientConfig) (*ssh.Client, error) {
+		return client, nil
+	}
+	pool := newConnPool(10 * time.Millisecond)
+	_, release, err := pool.get(map[string]interface{}{"username": "username", "address": "address"},
+		map[string]interface{}{"password": "password"})
+	if assert.NoError(t, err) {
+		release()
+		time.Sleep(50 * time.Millisecond)
+		conn.AssertCalled(t, "Close")
+		pool.mu.Lock()
+		assert.Empty(t, pool.conns)
+		pool.mu.Unlock()
+	}
+	dial = ssh.Dial
+}
+
+func TestPoolInUseNotEvicted(t *testing.T) {
+	client, conn := newMockClient(true)
+	dial = func(network string, addr string, cfg *ssh.ClientConfig) (*ssh.Client, error) {
+		return client, nil
+	}
+	pool := newConnPool(5 * time.Millisecond)
+	props := map[string]interface{}{"username": "username", "address": "address"}
+	params := map[string]interface{}{"password": "password"}
+	_, first, err := pool.get(props, params)
+	if assert.NoError(t, err) {
+		_, second, err := pool.get(props, params)
+		if assert.NoError(t, err) {
+			second()
+			time.Sleep(20 * time.Millisecond)
+			conn.AssertNotCalled(t, "Close")
+		}
+		first()
+	}
+	pool.closeAll()
+	dial = ssh.Dial
+}
+
+func TestPoolConcurrent(t *testing.T) {
+	var dials int32
+	dial = func(network string, addr string, cfg *ssh.ClientConfig) (*ssh.Client, error) {
+		atomic.AddInt32(&dials, 1)
+		client, _ := newMockClient(true)
+		return client, nil
+	}
+	pool := newConnPool(time.Minute)
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, release, err := pool.get(map[string]interface{}{"username": "username", "address": "address"},
+				map[string]interface{}{"password": "password"})
+			if assert.NoError(t, err) {
+				release()
+			}
+		}()
+	}
+	wg.Wait()
+	assert.True(t, dials >= 1)
+	pool.mu.Lock()
+	assert.Len(t, pool.conns, 1)
+	pool.mu.Unlock()
+	pool.closeAll()
+	dial = ssh.Dial
+}
@@ -0,0 +1,202 @@
+/*
+ * Copyright The Titan Project Contributors.
+ */
+package ssh
+
+import (
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+/*
+ * A single intermediate host in a ProxyJump chain.
+ */
+type jumpHost struct {
+	username string
+	address  string
+	port     int
+}
+
+func (j jumpHost) String() string {
+	return fmt.Sprintf("%s@%s", j.username, net.JoinHostPort(j.address, strconv.Itoa(j.port)))
+}
+
+/*
+ * Parse a ProxyJump specification of the form "[user@]host[:port],[user@]host[:port],...", as accepted by OpenSSH.
+ * Hosts without a username use the default username, and hosts without a port use 22. IPv6 literals must be enclosed
+ * in brackets.
+ */
+func parseProxyJump(spec string, defaultUser string) ([]jumpHost, error) {
+	var hosts []jumpHost
+	for _, hop := range strings.Split(spec, ",") {
+		hop = strings.TrimPrefix(strings.TrimSpace(hop), "ssh://")
+		if hop == "" {
+			return nil, fmt.Errorf("invalid proxy jump '%s': empty host", spec)
+		}
+		u, err := url.Parse("ssh://" + hop)
+		if err != nil || u.Hostname() == "" || (u.Path != "" && u.Path != "/") {
+			return nil, fmt.Errorf("invalid proxy jump host '%s'", hop)
+		}
+		if _, set := u.User.Password(); set {
+			return nil, fmt.Errorf("invalid proxy jump host '%s': passwords are not supported", hop)
+		}
+
+		host := jumpHost{username: defaultUser, address: u.Hostname(), port: 22}
+		if u.User != nil && u.User.Username() != "" {
+			host.username = u.User.Username()
+		}
+		if u.Port() != "" {
+			port, err := strconv.Atoi(u.Port())
+			if err != nil || port <= 0 || port > 65535 {
+				return nil, fmt.Errorf("invalid proxy jump port '%s'", u.Port())
+			}
+			host.port = port
+		}
+		hosts = append(hosts, host)
+	}
+	return hosts, nil
+}
+
+/*
+ * Connection wrapper that closes the connection to the previous hop along with the tunneled connection, so that
+ * closing the final client tears down the whole chain.
+ */
+type jumpConn struct {
+	ssh.Conn
+	via *ssh.Client
+}
+
+func (c *jumpConn) Close() error {
+	err := c.Conn.Close()
+	c.via.Close()
+	return err
+}
+
+/*
+ * Open a new SSH connection to the given address, tunneled through an existing client.
+ */
+func dialThrough(via *ssh.Client, addr string, config *ssh.ClientConfig) (*ssh.Client, error) {
+	conn, err := via.Dial("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s through proxy: %w", addr, err)
+	}
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return ssh.NewClient(&jumpConn{Conn: c, via: via}, chans, reqs), nil
+}
+
+var dialVia = dialThrough
+
+/*
+ * Returns the authentication methods for a jump host. The password of the target is never offered to a jump host, so
+ * hops authenticate with public keys only: those held by ssh-agent, the key parameter, and the IdentityFile that
+ * ~/.ssh/config gives for the hop. An IdentityFile protected by a passphrase is skipped, since the passphrase parameter
+ * belongs to the key of the target. The returned function must be called once authentication has completed.
+ */
+func getJumpAuthMethods(host jumpHost, parameters map[string]interface{}) ([]ssh.AuthMethod, func(), error) {
+	var auth []ssh.AuthMethod
+	release := func() {}
+	if agentAuth, closer, err := getAgentAuth(); err == nil {
+		auth = append(auth, agentAuth)
+		release = func() { closer.Close() }
+	}
+
+	var signers []ssh.Signer
+	if key, ok := parameters["key"].(string); ok {
+		signer, err := parsePrivateKey(key, parameters["passphrase"])
+		if err != nil {
+			release()
+			return nil, nil, err
+		}
+		signers = append(signers, signer)
+	}
+	config, err := lookupSSHConfig(host.address, host.username)
+	if err != nil {
+		release()
+		return nil, nil, err
+	}
+	if config.identityFile != "" {
+		if content, err := ioutil.ReadFile(config.identityFile); err == nil {
+			signer, err := ssh.ParsePrivateKey(content)
+			var missing *ssh.PassphraseMissingError
+			if err == nil {
+				signers = append(signers, signer)
+			} else if !errors.As(err, &missing) {
+				release()
+				return nil, nil, fmt.Errorf("failed to read identity file %s for proxy jump host %s: %w",
+					config.identityFile, host, err)
+			}
+		}
+	}
+	if len(signers) != 0 {
+		auth = append(auth, ssh.PublicKeys(signers...))
+	}
+
+	if len(auth) == 0 {
+		return nil, nil, fmt.Errorf("no key to authenticate to proxy jump host %s with, passwords are only sent to "+
+			"the target host", host)
+	}
+	return auth, release, nil
+}
+
+/*
+ * Dial the target address through the chain of jump hosts. Each hop authenticates with its own methods, and is
+ * verified strictly against known_hosts since only the target can have a pinned host key.
+ */
+func dialJumpHosts(hosts []jumpHost, properties map[string]interface{}, parameters map[string]interface{},
+	address string, config *ssh.ClientConfig) (*ssh.Client, error) {
+	if len(hosts) == 0 {
+		return nil, errors.New("no proxy jump hosts specified")
+	}
+	hostKeyCallback, err := getKnownHostsCallback(properties)
+	if err != nil {
+		return nil, err
+	}
+
+	var client *ssh.Client
+	for i, host := range hosts {
+		auth, release, err := getJumpAuthMethods(host, parameters)
+		if err != nil {
+			if client != nil {
+				client.Close()
+			}
+			return nil, err
+		}
+		hopConfig := &ssh.ClientConfig{
+			User:            host.username,
+			Auth:            auth,
+			HostKeyCallback: hostKeyCallback,
+		}
+		hopAddress := net.JoinHostPort(host.address, strconv.Itoa(host.port))
+		var next *ssh.Client
+		if i == 0 {
+			next, err = dial("tcp", hopAddress, hopConfig)
+		} else {
+			next, err = dialVia(client, hopAddress, hopConfig)
+		}
+		release()
+		if err != nil {
+			if client != nil {
+				client.Close()
+			}
+			return nil, fmt.Errorf("failed to connect to proxy jump host %s: %w", host, err)
+		}
+		client = next
+	}
+
+	target, err := dialVia(client, address, config)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	return target, nil
+}
@@ -0,0 +1,238 @@
+/*
+ * Copyright The Titan Project Contributors.
+ */
+package ssh
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/titan-data/remote-sdk-go/remote"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseProxyJump(t *testing.T) {
+	hosts, err := parseProxyJump("admin@bastion:2222, bastion2,[::1]:22", "user")
+	if assert.NoError(t, err) {
+		assert.Len(t, hosts, 3)
+		assert.Equal(t, jumpHost{username: "admin", address: "bastion", port: 2222}, hosts[0])
+		assert.Equal(t, jumpHost{username: "user", address: "bastion2", port: 22}, hosts[1])
+		assert.Equal(t, jumpHost{username: "user", address: "::1", port: 22}, hosts[2])
+		assert.Equal(t, "user@[::1]:22", hosts[2].String())
+	}
+}
+
+func TestParseProxyJumpBad(t *testing.T) {
+	for _, spec := range []string{"", "bastion,", "user:pass@bastion", "bastion:0", "bastion:foo",
+		"bastion/path"} {
+		_, err := parseProxyJump(spec, "user")
+		assert.Error(t, err, spec)
+	}
+}
+
+func TestProxyJumpProperty(t *testing.T) {
+	r := remote.Get("ssh")
+	props, err := r.FromURL("ssh://user@host/path", map[string]string{"proxyJump": "user@bastion:2222,bastion2"})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "user@bastion:2222,bastion2", props["proxyJump"])
+		assert.NoError(t, r.ValidateRemote(props))
+		u, extra, err := r.ToURL(props)
+		if assert.NoError(t, err) {
+			assert.Equal(t, "user@bastion:2222,bastion2", extra["proxyJump"])
+			roundTrip, err := r.FromURL(u, extra)
+			if assert.NoError(t, err) {
+				assert.Equal(t, props, roundTrip)
+			}
+		}
+	}
+}
+
+func TestProxyJumpBadProperty(t *testing.T) {
+	r := remote.Get("ssh")
+	_, err := r.FromURL("ssh://user@host/path", map[string]string{"proxyJump": "bastion:foo"})
+	assert.Error(t, err)
+}
+
+func TestValidateRemoteBadProxyJump(t *testing.T) {
+	r := remote.Get("ssh")
+	err := r.ValidateRemote(map[string]interface{}{"username": "username", "address": "host", "path": "/path",
+		"proxyJump": 1})
+	assert.Error(t, err)
+}
+
+/*
+ * Returns a new private key in PEM form.
+ */
+func newPrivateKey(t *testing.T) string {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+}
+
+func TestGetConnProxyJump(t *testing.T) {
+	bastionKey := newHostKey(t)
+	targetKey := newHostKey(t)
+	file := writeKnownHosts(t, knownhosts.Line([]string{"bastion", "[bastion2]:2222"}, bastionKey),
+		knownhosts.Line([]string{"[host]:8022"}, targetKey))
+	defer os.RemoveAll(filepath.Dir(file))
+	home := withSSHConfig(t, map[string]string{
+		"config":  "Host bastion bastion2\n  IdentityFile ~/.ssh/id_jump\n",
+		"id_jump": newPrivateKey(t),
+	})
+	defer resetSSHConfig(home)
+	dialAgent = func() (net.Conn, error) {
+		return nil, errors.New("no agent")
+	}
+
+	var hops []string
+	var users []string
+	var auth [][]ssh.AuthMethod
+	dial = func(network string, addr string, cfg *ssh.ClientConfig) (*ssh.Client, error) {
+		hops = append(hops, addr)
+		users = append(users, cfg.User)
+		auth = append(auth, cfg.Auth)
+		return &ssh.Client{}, cfg.HostKeyCallback(addr, testAddr, bastionKey)
+	}
+	dialVia = func(via *ssh.Client, addr string, cfg *ssh.ClientConfig) (*ssh.Client, error) {
+		hops = append(hops, addr)
+		users = append(users, cfg.User)
+		auth = append(auth, cfg.Auth)
+		key := bastionKey
+		if addr == "host:8022" {
+			key = targetKey
+		}
+		return &ssh.Client{}, cfg.HostKeyCallback(addr, testAddr, key)
+	}
+	props := map[string]interface{}{"username": "username", "address": "host", "port": 8022,
+		"proxyJump": "bastion,admin@bastion2:2222", "knownHostsFile": file}
+	_, err := getConnection(props, map[string]interface{}{"password": "password"})
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"bastion:22", "bastion2:2222", "host:8022"}, hops)
+		assert.Equal(t, []string{"username", "admin", "username"}, users)
+		// The hops authenticate with the identity file, and only the target with the password
+		password := fmt.Sprintf("%T", ssh.Password("password"))
+		for i, methods := range auth {
+			if assert.Len(t, methods, 1) {
+				assert.Equal(t, i == 2, fmt.Sprintf("%T", methods[0]) == password, hops[i])
+			}
+		}
+	}
+	dial = ssh.Dial
+	dialVia = dialThrough
+	dialAgent = defaultDialAgent
+}
+
+func TestGetConnProxyJumpPasswordOnly(t *testing.T) {
+	dialAgent = func() (net.Conn, error) {
+		return nil, errors.New("no agent")
+	}
+	var dialed []string
+	dial = func(network string, addr string, cfg *ssh.ClientConfig) (*ssh.Client, error) {
+		dialed = append(dialed, addr)
+		return &ssh.Client{}, nil
+	}
+	_, err := getConnection(map[string]interface{}{"username": "username", "address": "host",
+		"proxyJump": "bastion"}, map[string]interface{}{"password": "password"})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "passwords are only sent to the target host")
+	}
+	assert.Empty(t, dialed)
+	dial = ssh.Dial
+	dialAgent = defaultDialAgent
+}
+
+func TestGetJumpAuthMethods(t *testing.T) {
+	dialAgent = func() (net.Conn, error) {
+		return nil, errors.New("no agent")
+	}
+	host := jumpHost{username: "user", address: "bastion", port: 22}
+	auth, release, err := getJumpAuthMethods(host, map[string]interface{}{"key": newPrivateKey(t)})
+	if assert.NoError(t, err) {
+		assert.Len(t, auth, 1)
+		release()
+	}
+	_, _, err = getJumpAuthMethods(host, map[string]interface{}{"key": "bad"})
+	assert.Error(t, err)
+
+	// A passphrase protected identity file is left to the agent
+	home := withSSHConfig(t, map[string]string{
+		"config":  "Host bastion\n  IdentityFile ~/.ssh/id_jump\n",
+		"id_jump": encryptedKey,
+	})
+	_, _, err = getJumpAuthMethods(host, map[string]interface{}{})
+	assert.Error(t, err)
+	resetSSHConfig(home)
+
+	client, server := net.Pipe()
+	go agent.ServeAgent(agent.NewKeyring(), server)
+	dialAgent = func() (net.Conn, error) {
+		return client, nil
+	}
+	auth, release, err = getJumpAuthMethods(host, map[string]interface{}{})
+	if assert.NoError(t, err) {
+		assert.Len(t, auth, 1)
+		release()
+		_, err = client.Write([]byte{0})
+		assert.Error(t, err)
+	}
+	dialAgent = defaultDialAgent
+}
+
+func TestGetConnProxyJumpUnknownHop(t *testing.T) {
+	file := writeKnownHosts(t)
+	defer os.RemoveAll(filepath.Dir(file))
+
+	dial = func(network string, addr string, cfg *ssh.ClientConfig) (*ssh.Client, error) {
+		return nil, cfg.HostKeyCallback(addr, testAddr, newHostKey(t))
+	}
+	_, err := getConnection(map[string]interface{}{"username": "username", "address": "host",
+		"proxyJump": "bastion", "knownHostsFile": file}, map[string]interface{}{"key": newPrivateKey(t)})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "failed to connect to proxy jump host username@bastion:22")
+	}
+	dial = ssh.Dial
+}
+
+func TestGetConnProxyJumpFailure(t *testing.T) {
+	conn := new(MockConn)
+	conn.On("Close").Return(nil)
+	dial = func(network string, addr string, cfg *ssh.ClientConfig) (*ssh.Client, error) {
+		return &ssh.Client{Conn: conn}, nil
+	}
+	dialVia = func(via *ssh.Client, addr string, cfg *ssh.ClientConfig) (*ssh.Client, error) {
+		return nil, errors.New("error")
+	}
+	_, err := getConnection(map[string]interface{}{"username": "username", "address": "host",
+		"proxyJump": "bastion"}, map[string]interface{}{"key": newPrivateKey(t)})
+	assert.Error(t, err)
+	conn.AssertCalled(t, "Close")
+	dial = ssh.Dial
+	dialVia = dialThrough
+}
+
+func TestJumpConnClose(t *testing.T) {
+	target := new(MockConn)
+	target.On("Close").Return(nil)
+	bastion := new(MockConn)
+	bastion.On("Close").Return(nil)
+	c := &jumpConn{Conn: target, via: &ssh.Client{Conn: bastion}}
+	assert.NoError(t, c.Close())
+	target.AssertCalled(t, "Close")
+	bastion.AssertCalled(t, "Close")
+}
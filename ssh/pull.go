@@ -0,0 +1,310 @@
+/*
+ * Copyright The Titan Project Contributors.
+ */
+package ssh
+
+import (
+	"fmt"
+	"github.com/titan-data/remote-sdk-go/remote"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+/*
+ * Size of the blocks checked for zeroes when writing files, which matches the block size of most filesystems.
+ */
+const sparseBlockSize = 4096
+
+/*
+ * Returns whether a file name, without any directory, was left behind by an interrupted atomic write. Only the
+ * top-level names of a commit directory and the names of objects are written atomically, so files of the same name
+ * deeper in a commit are data like any other.
+ */
+func isTempName(name string) bool {
+	return !strings.Contains(name, "/") && strings.HasPrefix(name, ".") && strings.Contains(name, tempMarker)
+}
+
+/*
+ * Extracts a tree read from the remote into a local directory, recording progress in the transfer state so that an
+ * interrupted pull can be resumed. Permissions, symbolic links and sparse files are preserved, while metadata.json and
+ * manifest.json are not part of the data.
+ */
+type extractor struct {
+	root  string
+	dirs  []treeEntry
+	state *transferState
+}
+
+/*
+ * Returns the local path for an entry, refusing names that would escape the root. Entries are visited parents
+ * first, so the parent must already exist as a real directory, which also prevents writing through a symbolic link
+ * extracted earlier.
+ */
+func (x *extractor) target(name string) (string, error) {
+	clean := path.Clean(name)
+	if path.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", fmt.Errorf("refusing to extract '%s' outside of the destination", name)
+	}
+	target := filepath.Join(x.root, filepath.FromSlash(clean))
+	info, err := os.Lstat(filepath.Dir(target))
+	if err != nil || !info.IsDir() {
+		return "", fmt.Errorf("refusing to extract '%s', parent is not a directory", name)
+	}
+	return target, nil
+}
+
+func (x *extractor) extract(entry treeEntry, r io.Reader) error {
+	if isCommitFile(entry.name) {
+		return nil
+	}
+	target, err := x.target(entry.name)
+	if err != nil {
+		return err
+	}
+
+	// When resuming, entries may exist from the previous attempt
+	existing, err := os.Lstat(target)
+	sameType := err == nil && (entry.mode.IsDir() && existing.IsDir() ||
+		entry.mode.IsRegular() && existing.Mode().IsRegular())
+	if err == nil && !sameType {
+		if err := os.Remove(target); err != nil {
+			return err
+		}
+	}
+
+	switch {
+	case entry.mode.IsDir():
+		if err := os.Mkdir(target, 0700); err != nil && !os.IsExist(err) {
+			return err
+		}
+		// Permissions are applied once the directory has been populated, in case it is read-only
+		x.dirs = append(x.dirs, entry)
+		return nil
+	case entry.mode&os.ModeSymlink != 0:
+		return os.Symlink(entry.link, target)
+	default:
+		if x.state != nil {
+			x.state.Partial = &partialState{Name: entry.name, Size: entry.size, Mode: entry.mode,
+				ModTime: entry.modTime}
+		}
+		if err := writeLocalFile(target, entry, r); err != nil {
+			return err
+		}
+		if x.state != nil {
+			x.state.Done = append(x.state.Done, entry.name)
+			x.state.Partial = nil
+		}
+		return nil
+	}
+}
+
+/*
+ * Apply the permissions and modification times of extracted directories, deepest first.
+ */
+func (x *extractor) finish() error {
+	for i := len(x.dirs) - 1; i >= 0; i-- {
+		dir := x.dirs[i]
+		target := filepath.Join(x.root, filepath.FromSlash(path.Clean(dir.name)))
+		if err := os.Chmod(target, dir.mode.Perm()); err != nil {
+			return err
+		}
+		if err := os.Chtimes(target, dir.modTime, dir.modTime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+ * Write a regular file, starting at the offset of the entry, and verify that all of its content was received.
+ */
+func writeLocalFile(target string, entry treeEntry, r io.Reader) error {
+	f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	err = f.Truncate(entry.offset)
+	if err == nil {
+		_, err = f.Seek(entry.offset, io.SeekStart)
+	}
+	var written int64
+	if err == nil {
+		written, err = copySparse(f, r)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %w", entry.name, err)
+	}
+	written += entry.offset
+	if written != entry.size {
+		return fmt.Errorf("incomplete transfer of %s: received %d of %d bytes", entry.name, written, entry.size)
+	}
+	if err := os.Chmod(target, entry.mode.Perm()); err != nil {
+		return err
+	}
+	return os.Chtimes(target, entry.modTime, entry.modTime)
+}
+
+/*
+ * Copy the contents of a file from its current position, seeking over blocks of zeroes rather than writing them so
+ * that sparse files stay sparse. Returns the number of bytes copied.
+ */
+func copySparse(f *os.File, r io.Reader) (int64, error) {
+	start, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+	buf := make([]byte, 16*sparseBlockSize)
+	var written int64
+	for {
+		n := 0
+		var err error
+		for n < len(buf) && err == nil {
+			var m int
+			m, err = r.Read(buf[n:])
+			n += m
+		}
+
+		for off := 0; off < n; off += sparseBlockSize {
+			end := off + sparseBlockSize
+			if end > n {
+				end = n
+			}
+			block := buf[off:end]
+			if isZero(block) {
+				if _, err := f.Seek(int64(len(block)), io.SeekCurrent); err != nil {
+					return written, err
+				}
+			} else if _, err := f.Write(block); err != nil {
+				return written, err
+			}
+			written += int64(len(block))
+		}
+
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+	// Extend the file in case it ends with a hole
+	return written, f.Truncate(start + written)
+}
+
+func isZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+ * Download the data of a commit from <path>/<commitId>/ into the local destination directory, which must not already
+ * exist. The commit is extracted into a temporary directory alongside the destination, and only renamed into place
+ * once every file has been received in full and matches the manifest of the commit, if it has one, so a failed pull
+ * never leaves a partial or corrupt destination. Returns the commit.
+ *
+ * If the pull fails part way through, the error is a *TransferError whose resume token can be passed to a retry to
+ * continue where it stopped. The temporary directory is kept until the pull is resumed and completes.
+ */
+func (s sshRemote) PullCommit(properties map[string]interface{}, parameters map[string]interface{}, commitId string,
+	dest string, resumeToken string) (*remote.Commit, error) {
+	if _, err := os.Lstat(dest); err == nil {
+		return nil, fmt.Errorf("destination %s already exists", dest)
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	state, err := decodeResumeToken(resumeToken, directionPull, commitId)
+	if err != nil {
+		return nil, err
+	}
+
+	store, release, err := connectStore(properties, parameters)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	keys := newKeyring(store, properties, parameters)
+	commit, err := readCommit(store, properties, keys, commitId)
+	if err != nil {
+		return nil, err
+	}
+
+	dir := fmt.Sprintf("%s/%s", properties["path"], commitId)
+	m, err := readManifest(store, dir)
+	if err != nil {
+		return nil, err
+	}
+	var key *cipherKey
+	if m != nil && m.Sealed != nil {
+		if key, err = keys.get(); err != nil {
+			return nil, err
+		}
+		if m, err = m.unseal(key, commitId); err != nil {
+			return nil, err
+		}
+	}
+
+	var resume *treeResume
+	if state.Temp != "" {
+		if info, err := os.Lstat(state.Temp); err != nil || !info.IsDir() {
+			return nil, fmt.Errorf("cannot resume pull, %s no longer exists", state.Temp)
+		}
+		resume = &treeResume{done: state.doneSet()}
+		if p := state.Partial; p != nil {
+			local := filepath.Join(state.Temp, filepath.FromSlash(p.Name))
+			if info, err := os.Lstat(local); err == nil && info.Mode().IsRegular() {
+				offset := verifiedOffset(p.Size, info.Size(), remoteHash(store, dir+"/"+p.Name), localHash(local))
+				resume.partial = &treeEntry{name: p.Name, mode: p.Mode, size: p.Size, modTime: p.ModTime,
+					offset: offset}
+			}
+		}
+	} else {
+		state.Temp, err = ioutil.TempDir(filepath.Dir(dest), "."+filepath.Base(dest)+tempMarker)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	x := &extractor{root: state.Temp, state: state}
+	if m != nil && m.isObjects() {
+		err = readObjectTree(store, properties["path"].(string), key, m, resume, x.extract)
+	} else {
+		err = store.readTree(dir, resume, x.extract)
+	}
+	if err != nil {
+		return nil, &TransferError{Err: fmt.Errorf("failed to pull commit %s: %w", commitId, err),
+			ResumeToken: state.token()}
+	}
+	if m != nil {
+		var local *manifest
+		local, err = buildManifest(state.Temp, 0)
+		if err == nil {
+			err = m.verify(local.hashes())
+		}
+	}
+	if err == nil {
+		err = x.finish()
+	}
+	if err == nil {
+		err = os.Chmod(state.Temp, 0755)
+	}
+	if err == nil {
+		err = os.Rename(state.Temp, dest)
+	}
+	if err != nil {
+		os.RemoveAll(state.Temp)
+		return nil, fmt.Errorf("failed to pull commit %s: %w", commitId, err)
+	}
+	return commit, nil
+}
@@ -0,0 +1,237 @@
+/*
+ * Copyright The Titan Project Contributors.
+ */
+package ssh
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+type localStream struct {
+	io.Reader
+	cmd *exec.Cmd
+}
+
+func (l *localStream) Close() error {
+	return l.cmd.Wait()
+}
+
+func streamLocal(conn *ssh.Client, command string, input io.Reader) (io.ReadCloser, error) {
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Stdin = input
+	output, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return &localStream{Reader: output, cmd: cmd}, nil
+}
+
+/*
+ * Create a repository with a commit containing nested files, a symbolic link and a sparse file.
+ */
+func writeCommitData(t *testing.T) string {
+	repo := writeRepository(t, map[string]string{
+		"id/metadata.json": "{\"a\": \"b\"}",
+		"id/dir/file":      "content",
+		"id/private":       "secret",
+	})
+	assert.NoError(t, os.Chmod(filepath.Join(repo, "id", "private"), 0600))
+	assert.NoError(t, os.Symlink("dir/file", filepath.Join(repo, "id", "link")))
+	f, err := os.Create(filepath.Join(repo, "id", "sparse"))
+	if assert.NoError(t, err) {
+		_, err = f.WriteAt([]byte("end"), 1<<20)
+		assert.NoError(t, err)
+		f.Close()
+	}
+	return repo
+}
+
+func checkCommitData(t *testing.T, dest string) {
+	content, err := ioutil.ReadFile(filepath.Join(dest, "dir", "file"))
+	if assert.NoError(t, err) {
+		assert.Equal(t, "content", string(content))
+	}
+	info, err := os.Stat(filepath.Join(dest, "private"))
+	if assert.NoError(t, err) {
+		assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	}
+	link, err := os.Readlink(filepath.Join(dest, "link"))
+	if assert.NoError(t, err) {
+		assert.Equal(t, "dir/file", link)
+	}
+	content, err = ioutil.ReadFile(filepath.Join(dest, "sparse"))
+	if assert.NoError(t, err) {
+		assert.Len(t, content, 1<<20+3)
+		assert.Equal(t, "end", string(content[1<<20:]))
+	}
+	_, err = os.Stat(filepath.Join(dest, "metadata.json"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestPullCommitSFTP(t *testing.T) {
+	repo := writeCommitData(t)
+	defer os.RemoveAll(repo)
+	local := writeRepository(t, map[string]string{})
+	defer os.RemoveAll(local)
+	dest := filepath.Join(local, "dest")
+
+	mockSFTPDial()
+	commit, err := sshRemote{}.PullCommit(pushProperties(repo), map[string]interface{}{"password": "password"},
+		"id", dest, "")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "b", commit.Properties["a"])
+		checkCommitData(t, dest)
+	}
+	resetSFTPDial()
+}
+
+func TestPullCommitNestedTempName(t *testing.T) {
+	repo := writeRepository(t, map[string]string{
+		"id/metadata.json":           "{}",
+		"id/.metadata.json.tmp-0123": "{}",
+		"id/dir/.file.tmp-0123":      "content",
+		"id/dir/manifest.json":       "data",
+	})
+	defer os.RemoveAll(repo)
+	local := writeRepository(t, map[string]string{})
+	defer os.RemoveAll(local)
+	dest := filepath.Join(local, "dest")
+
+	mockSFTPDial()
+	_, err := sshRemote{}.PullCommit(pushProperties(repo), map[string]interface{}{"password": "password"},
+		"id", dest, "")
+	if assert.NoError(t, err) {
+		for name, expected := range map[string]string{"dir/.file.tmp-0123": "content", "dir/manifest.json": "data"} {
+			content, err := ioutil.ReadFile(filepath.Join(dest, filepath.FromSlash(name)))
+			if assert.NoError(t, err) {
+				assert.Equal(t, expected, string(content))
+			}
+		}
+		_, err = os.Lstat(filepath.Join(dest, ".metadata.json.tmp-0123"))
+		assert.True(t, os.IsNotExist(err))
+	}
+	resetSFTPDial()
+}
+
+func TestPullCommitShell(t *testing.T) {
+	if _, err := exec.LookPath("tar"); err != nil {
+		t.Skip("no tar available")
+	}
+	repo := writeCommitData(t)
+	defer os.RemoveAll(repo)
+	local := writeRepository(t, map[string]string{})
+	defer os.RemoveAll(local)
+	dest := filepath.Join(local, "dest")
+
+	mockSFTPDial()
+	run = runLocal
+	stream = streamLocal
+	props := pushProperties(repo)
+	props["transport"] = "shell"
+	_, err := sshRemote{}.PullCommit(props, map[string]interface{}{"password": "password"}, "id", dest, "")
+	if assert.NoError(t, err) {
+		checkCommitData(t, dest)
+	}
+	run = runCommand
+	stream = streamCommand
+	resetSFTPDial()
+}
+
+func TestPullCommitDestinationExists(t *testing.T) {
+	local := writeRepository(t, map[string]string{})
+	defer os.RemoveAll(local)
+
+	_, err := sshRemote{}.PullCommit(pushProperties("/path"), map[string]interface{}{"password": "password"},
+		"id", local, "")
+	assert.Error(t, err)
+}
+
+func TestPullCommitMissing(t *testing.T) {
+	repo := writeRepository(t, map[string]string{})
+	defer os.RemoveAll(repo)
+	local := writeRepository(t, map[string]string{})
+	defer os.RemoveAll(local)
+
+	mockSFTPDial()
+	_, err := sshRemote{}.PullCommit(pushProperties(repo), map[string]interface{}{"password": "password"},
+		"id", filepath.Join(local, "dest"), "")
+	assert.Error(t, err)
+	resetSFTPDial()
+}
+
+func readTestTar(t *testing.T, dest string, build func(w *tar.Writer)) error {
+	var buf bytes.Buffer
+	w := tar.NewWriter(&buf)
+	build(w)
+	w.Flush()
+	x := &extractor{root: dest}
+	return readTar(&buf, x.extract)
+}
+
+func TestExtractEscape(t *testing.T) {
+	local := writeRepository(t, map[string]string{})
+	defer os.RemoveAll(local)
+
+	err := readTestTar(t, local, func(w *tar.Writer) {
+		w.WriteHeader(&tar.Header{Name: "../evil", Mode: 0644, Size: 1, Typeflag: tar.TypeReg})
+		w.Write([]byte("x"))
+	})
+	assert.Error(t, err)
+	_, err = os.Stat(filepath.Join(filepath.Dir(local), "evil"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestExtractThroughSymlink(t *testing.T) {
+	local := writeRepository(t, map[string]string{})
+	defer os.RemoveAll(local)
+	outside := writeRepository(t, map[string]string{})
+	defer os.RemoveAll(outside)
+
+	err := readTestTar(t, local, func(w *tar.Writer) {
+		w.WriteHeader(&tar.Header{Name: "./link", Linkname: outside, Typeflag: tar.TypeSymlink})
+		w.WriteHeader(&tar.Header{Name: "./link/evil", Mode: 0644, Size: 1, Typeflag: tar.TypeReg})
+		w.Write([]byte("x"))
+	})
+	assert.Error(t, err)
+	_, err = os.Stat(filepath.Join(outside, "evil"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestExtractTruncated(t *testing.T) {
+	local := writeRepository(t, map[string]string{})
+	defer os.RemoveAll(local)
+
+	var buf bytes.Buffer
+	w := tar.NewWriter(&buf)
+	w.WriteHeader(&tar.Header{Name: "./file", Mode: 0644, Size: 10000, Typeflag: tar.TypeReg})
+	w.Write(make([]byte, 5000))
+	x := &extractor{root: local}
+	err := readTar(&buf, x.extract)
+	assert.Error(t, err)
+}
+
+func TestShellReadTreeFailure(t *testing.T) {
+	repo := writeCommitData(t)
+	defer os.RemoveAll(repo)
+	stream = func(conn *ssh.Client, command string, input io.Reader) (io.ReadCloser, error) {
+		return nil, errors.New("no shell")
+	}
+	err := (&shellStore{}).readTree(repo, nil, func(entry treeEntry, r io.Reader) error {
+		return nil
+	})
+	assert.Error(t, err)
+	stream = streamCommand
+}
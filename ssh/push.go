@@ -0,0 +1,319 @@
+/*
+ * Copyright The Titan Project Contributors.
+ */
+package ssh
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/titan-data/remote-sdk-go/remote"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+)
+
+/*
+ * Marker used in the names of files that are still being written. Such files are hidden, so they never show up as
+ * commits, and can be recognized as leftovers of an interrupted upload.
+ */
+const tempMarker = ".tmp-"
+
+/*
+ * Hidden file that marks a commit directory as being pushed. It is created before anything else is written, and
+ * removed once the metadata.json is in place, so that garbage collection can tell a push that never completed from
+ * other directories in the repository.
+ */
+const pushMarker = ".push"
+
+/*
+ * How often the push marker of a commit being uploaded is rewritten. This only needs to be well within the grace
+ * period of garbage collection.
+ */
+var pushHeartbeat = time.Minute
+
+/*
+ * Returns a hidden temporary name in the same directory as the given path, so that it can be renamed into place.
+ */
+func tempName(p string) string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return path.Join(path.Dir(p), "."+path.Base(p)+tempMarker+hex.EncodeToString(b))
+}
+
+/*
+ * Write a file under a temporary name and then rename it into place, so that readers see either the previous content
+ * or the complete new content.
+ */
+func writeFileAtomic(store remoteStore, p string, content []byte, mode os.FileMode) error {
+	tmp := tempName(p)
+	if err := store.writeFile(tmp, bytes.NewReader(content), mode); err != nil {
+		store.remove(tmp)
+		return err
+	}
+	if err := store.rename(tmp, p); err != nil {
+		store.remove(tmp)
+		return err
+	}
+	return nil
+}
+
+/*
+ * Upload the contents of a local directory to the given remote directory. Regular files, directories and symbolic
+ * links are supported, and permissions are preserved. Progress is recorded in the transfer state: files it lists as
+ * done are skipped, and its partial file is resumed if the part already on the remote matches.
+ *
+ * Given a basis, files that also exist in the basis commit are sent as deltas in the manner of rsync: only the blocks
+ * that are not already in the basis are transferred, and the rest are copied from the basis on the remote host. This
+ * needs the shell transport, and files are sent in full if it is not available.
+ */
+func uploadDir(store remoteStore, source string, dest string, state *transferState, basis *deltaBasis) error {
+	done := state.doneSet()
+	return filepath.Walk(source, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(source, file)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		name := filepath.ToSlash(rel)
+		target := path.Join(dest, name)
+
+		switch {
+		case info.IsDir():
+			return store.mkdirAll(target)
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(file)
+			if err != nil {
+				return err
+			}
+			return store.symlink(link, target)
+		case info.Mode().IsRegular():
+			if done[name] {
+				return nil
+			}
+			var offset int64
+			if state.Partial != nil && state.Partial.Name == name {
+				if size, err := store.fileSize(target); err == nil {
+					offset = verifiedOffset(info.Size(), size, localHash(file), remoteHash(store, target))
+				}
+			}
+			state.Partial = &partialState{Name: name, Size: info.Size(), Mode: info.Mode(), ModTime: info.ModTime()}
+			if basis != nil && offset == 0 {
+				if f, ok := basis.files[name]; ok {
+					err := uploadDelta(store, file, target, basis.dir+"/"+name, basis.blockSize, f.Blocks, info.Mode())
+					if err == errNoDelta {
+						basis = nil
+					} else if err == nil {
+						state.Done = append(state.Done, name)
+						state.Partial = nil
+						return nil
+					} else if err != errDeltaMismatch {
+						return err
+					}
+				}
+			}
+			if err := uploadFile(store, file, target, offset, info.Mode()); err != nil {
+				return err
+			}
+			state.Done = append(state.Done, name)
+			state.Partial = nil
+			return nil
+		default:
+			return fmt.Errorf("unsupported file type for %s", file)
+		}
+	})
+}
+
+func uploadFile(store remoteStore, file string, target string, offset int64, mode os.FileMode) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if offset == 0 {
+		return store.writeFile(target, f, mode)
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	return store.resumeFile(target, f, offset, mode)
+}
+
+/*
+ * Publish a commit to <path>/<commitId>/. The local source directory, if given, is uploaded first, by uploadDir() in
+ * the files layout and uploadObjects() in the objects layout. The metadata.json is then written under a temporary
+ * name and renamed into place, and since commits are only listed once it exists, readers never see a partial commit.
+ * Pushing a commit that already exists fails, since its data would be overwritten in place; tags are changed with
+ * UpdateTags() instead. The data is uploaded without holding the repository lock, which is only taken to publish the
+ * manifest and metadata, so that a long push doesn't hold up other writers; see markPush(). If the upload fails part
+ * way through, the error is a *TransferError whose resume token continues it on a retry.
+ */
+func (s sshRemote) PushCommit(properties map[string]interface{}, parameters map[string]interface{},
+	commit remote.Commit, source string, resumeToken string) error {
+	if err := validateCommitId(commit.Id); err != nil {
+		return err
+	}
+	var m *manifest
+	if source != "" {
+		for _, name := range []string{"metadata.json", "manifest.json", pushMarker} {
+			if _, err := os.Lstat(filepath.Join(source, name)); err == nil {
+				return fmt.Errorf("commit data cannot contain a top-level %s", name)
+			}
+		}
+		if getLayout(properties) == layoutFiles {
+			var err error
+			if m, err = buildManifest(source, deltaBlockSize); err != nil {
+				return fmt.Errorf("failed to build manifest: %w", err)
+			}
+		}
+	}
+	state, err := decodeResumeToken(resumeToken, directionPush, commit.Id)
+	if err != nil {
+		return err
+	}
+
+	metadata, err := json.Marshal(commit.Properties)
+	if err != nil {
+		return fmt.Errorf("failed to encode commit metadata: %w", err)
+	}
+	encrypted := getEncryption(properties) == encryptionAESGCM
+	if _, ok := parameters["encryptionPassphrase"].(string); encrypted && !ok {
+		return errors.New("repository is encrypted, the encryptionPassphrase parameter is required")
+	}
+
+	store, release, err := connectStore(properties, parameters)
+	if err != nil {
+		return err
+	}
+	defer release()
+	keys := newKeyring(store, properties, parameters)
+
+	if err := store.mkdirAll(properties["path"].(string)); err != nil {
+		return err
+	}
+	dir := fmt.Sprintf("%s/%s", properties["path"], commit.Id)
+	// Data is written in place, so a published commit can never be pushed over
+	if _, err := store.fileSize(dir + "/metadata.json"); err == nil {
+		return fmt.Errorf("commit %s already exists", commit.Id)
+	}
+	var key *cipherKey
+	if encrypted {
+		err := withLock(store, properties, func() error {
+			var err error
+			key, err = keys.create()
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		if metadata, err = sealMetadata(key, commit.Id, commit.Properties, getCleartextFields(properties)); err != nil {
+			return err
+		}
+	}
+
+	if err := store.mkdirAll(dir); err != nil {
+		return err
+	}
+	// If the interrupted push has been garbage collected since, there is nothing left to resume
+	if _, err := store.fileSize(dir + "/" + pushMarker); err != nil {
+		state = &transferState{Direction: directionPush, Commit: commit.Id}
+	}
+	stopMarking, err := markPush(store, dir)
+	if err != nil {
+		return err
+	}
+	if source != "" && getLayout(properties) == layoutObjects {
+		m, err = uploadObjects(store, source, properties["path"].(string), key, getCompression(properties))
+		if err == nil && key != nil {
+			m, err = sealManifest(key, commit.Id, m)
+		}
+	} else if source != "" {
+		var basis *deltaBasis
+		if getTransferMode(properties) == transferDelta {
+			basis, err = findDeltaBasis(store, properties, commit.Id)
+		}
+		if err == nil {
+			err = uploadDir(store, source, dir, state, basis)
+		}
+	}
+	stopMarking()
+	if err != nil {
+		return &TransferError{Err: fmt.Errorf("failed to upload commit %s: %w", commit.Id, err),
+			ResumeToken: state.token()}
+	}
+
+	return withLock(store, properties, func() error {
+		if _, err := store.fileSize(dir + "/metadata.json"); err == nil {
+			return fmt.Errorf("commit %s already exists", commit.Id)
+		}
+		if _, err := store.fileSize(dir + "/" + pushMarker); err != nil {
+			return &TransferError{Err: fmt.Errorf("failed to push commit %s, it was garbage collected while "+
+				"being uploaded", commit.Id), ResumeToken: state.token()}
+		}
+		if m != nil && m.isObjects() {
+			missing, err := missingObjects(store, properties["path"].(string), m)
+			if err != nil {
+				return err
+			}
+			if len(missing) > 0 {
+				return &TransferError{Err: fmt.Errorf("failed to push commit %s, %d of its objects were garbage "+
+					"collected while it was being uploaded", commit.Id, len(missing)), ResumeToken: state.token()}
+			}
+		}
+		if m != nil {
+			if err := writeManifest(store, dir, m); err != nil {
+				return err
+			}
+		}
+		if err := writeFileAtomic(store, dir+"/metadata.json", metadata, 0644); err != nil {
+			return err
+		}
+		// Once the metadata is in place the commit is complete, and a marker left behind is ignored
+		store.remove(dir + "/" + pushMarker)
+		return nil
+	})
+}
+
+/*
+ * Mark a commit directory as being pushed. The data of a push is uploaded without holding the repository lock, so
+ * the marker is rewritten every push heartbeat until the returned function is called, which lets garbage collection
+ * tell a push in progress from one that was abandoned.
+ */
+func markPush(store remoteStore, dir string) (func(), error) {
+	marker := dir + "/" + pushMarker
+	if err := store.writeFile(marker, bytes.NewReader(nil), 0644); err != nil {
+		return nil, err
+	}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(pushHeartbeat)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				// A failure means the push was garbage collected, which is detected before publishing it
+				store.writeFile(marker, bytes.NewReader(nil), 0644)
+			}
+		}
+	}()
+	return func() {
+		close(stop)
+		<-done
+	}, nil
+}
@@ -0,0 +1,250 @@
+/*
+ * Copyright The Titan Project Contributors.
+ */
+package ssh
+
+import (
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/titan-data/remote-sdk-go/remote"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func runLocalInput(conn *ssh.Client, command string, input io.Reader) ([]byte, error) {
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Stdin = input
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute '%s': %w\n%s", command, err, string(output))
+	}
+	return output, nil
+}
+
+func pushProperties(dir string) map[string]interface{} {
+	return map[string]interface{}{"username": "username", "address": "address", "path": dir, "transport": "sftp"}
+}
+
+func mockSFTPDial() {
+	conn := new(MockConn)
+	conn.On("Close").Return(nil)
+	conn.On("SendRequest", "keepalive@openssh.com", true, []byte(nil)).Return(true, []byte(nil), nil)
+	dial = func(network string, addr string, cfg *ssh.ClientConfig) (*ssh.Client, error) {
+		return &ssh.Client{Conn: conn}, nil
+	}
+	newSFTPClient = localSFTP
+}
+
+func resetSFTPDial() {
+	dial = ssh.Dial
+	newSFTPClient = startSFTP
+	connections.closeAll()
+}
+
+func TestPushCommit(t *testing.T) {
+	repo := writeRepository(t, map[string]string{})
+	defer os.RemoveAll(repo)
+	source := writeRepository(t, map[string]string{"data/file": "content", "top": "top"})
+	defer os.RemoveAll(source)
+	assert.NoError(t, os.Chmod(filepath.Join(source, "top"), 0600))
+	assert.NoError(t, os.Symlink("data/file", filepath.Join(source, "link")))
+
+	mockSFTPDial()
+	params := map[string]interface{}{"password": "password"}
+	err := sshRemote{}.PushCommit(pushProperties(repo), params, remote.Commit{Id: "id",
+		Properties: map[string]interface{}{"tags": map[string]interface{}{"a": "b"}}}, source, "")
+	if assert.NoError(t, err) {
+		content, err := ioutil.ReadFile(filepath.Join(repo, "id", "data", "file"))
+		if assert.NoError(t, err) {
+			assert.Equal(t, "content", string(content))
+		}
+		info, err := os.Stat(filepath.Join(repo, "id", "top"))
+		if assert.NoError(t, err) {
+			assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+		}
+		link, err := os.Readlink(filepath.Join(repo, "id", "link"))
+		if assert.NoError(t, err) {
+			assert.Equal(t, "data/file", link)
+		}
+
+		commit, err := sshRemote{}.GetCommit(pushProperties(repo), params, "id")
+		if assert.NoError(t, err) {
+			assert.Equal(t, "b", commit.Properties["tags"].(map[string]interface{})["a"])
+		}
+
+		entries, err := ioutil.ReadDir(filepath.Join(repo, "id"))
+		if assert.NoError(t, err) {
+			assert.Len(t, entries, 5)
+		}
+	}
+	resetSFTPDial()
+}
+
+func TestPushCommitMetadataOnly(t *testing.T) {
+	repo := writeRepository(t, map[string]string{})
+	defer os.RemoveAll(repo)
+
+	mockSFTPDial()
+	params := map[string]interface{}{"password": "password"}
+	err := sshRemote{}.PushCommit(pushProperties(repo), params, remote.Commit{Id: "id",
+		Properties: map[string]interface{}{"timestamp": "2019-09-20T13:45:36Z"}}, "", "")
+	if assert.NoError(t, err) {
+		commits, err := sshRemote{}.ListCommits(pushProperties(repo), params, []remote.Tag{})
+		if assert.NoError(t, err) {
+			assert.Len(t, commits, 1)
+			assert.Equal(t, "id", commits[0].Id)
+		}
+	}
+	resetSFTPDial()
+}
+
+func TestPushCommitExisting(t *testing.T) {
+	repo := writeRepository(t, map[string]string{})
+	defer os.RemoveAll(repo)
+	first := writeRepository(t, map[string]string{"a": "a", "b": "b"})
+	defer os.RemoveAll(first)
+	second := writeRepository(t, map[string]string{"a": "changed"})
+	defer os.RemoveAll(second)
+
+	mockSFTPDial()
+	params := map[string]interface{}{"password": "password"}
+	assert.NoError(t, sshRemote{}.PushCommit(pushProperties(repo), params, remote.Commit{Id: "id"}, first, ""))
+	err := sshRemote{}.PushCommit(pushProperties(repo), params, remote.Commit{Id: "id"}, second, "")
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "already exists")
+	}
+	content, err := ioutil.ReadFile(filepath.Join(repo, "id", "a"))
+	if assert.NoError(t, err) {
+		assert.Equal(t, "a", string(content))
+	}
+	_, err = sshRemote{}.VerifyCommit(pushProperties(repo), params, "id")
+	assert.NoError(t, err)
+	resetSFTPDial()
+}
+
+func TestPushCommitUnlocked(t *testing.T) {
+	repo := writeRepository(t, map[string]string{})
+	defer os.RemoveAll(repo)
+	dir, source := writeSourceData(t)
+	defer os.RemoveAll(dir)
+
+	mockSFTPDial()
+	run = runLocal
+	stream = streamLocal
+	collect := true
+	var locked []bool
+	runInput = func(conn *ssh.Client, command string, input io.Reader) ([]byte, error) {
+		if strings.Contains(command, "/id/dir/file") {
+			_, err := os.Lstat(filepath.Join(repo, lockDir))
+			locked = append(locked, err == nil)
+			// Garbage collection removes the push while it is being uploaded
+			if collect {
+				os.Remove(filepath.Join(repo, "id", pushMarker))
+			}
+		}
+		return runLocalInput(conn, command, input)
+	}
+	props := pushProperties(repo)
+	props["transport"] = "shell"
+	params := map[string]interface{}{"password": "password"}
+	err := sshRemote{}.PushCommit(props, params, remote.Commit{Id: "id"}, source, "")
+	var transferErr *TransferError
+	if assert.True(t, errors.As(err, &transferErr)) {
+		assert.Contains(t, err.Error(), "garbage collected")
+		_, err = os.Lstat(filepath.Join(repo, "id", "metadata.json"))
+		assert.True(t, os.IsNotExist(err))
+
+		collect = false
+		err = sshRemote{}.PushCommit(props, params, remote.Commit{Id: "id"}, source, transferErr.ResumeToken)
+		if assert.NoError(t, err) {
+			_, err = sshRemote{}.VerifyCommit(props, params, "id")
+			assert.NoError(t, err)
+		}
+	}
+	assert.Equal(t, []bool{false, false}, locked)
+
+	run = runCommand
+	runInput = runCommandInput
+	stream = streamCommand
+	resetSFTPDial()
+}
+
+func TestMarkPush(t *testing.T) {
+	repo := writeRepository(t, map[string]string{})
+	defer os.RemoveAll(repo)
+	store, done := localStore(t, repo)
+	defer done()
+	pushHeartbeat = 5 * time.Millisecond
+	defer func() { pushHeartbeat = time.Minute }()
+
+	stop, err := markPush(store, repo)
+	if assert.NoError(t, err) {
+		marker := filepath.Join(repo, pushMarker)
+		age(t, repo, time.Hour)
+		time.Sleep(50 * time.Millisecond)
+		stop()
+		info, err := os.Stat(marker)
+		if assert.NoError(t, err) {
+			assert.True(t, time.Since(info.ModTime()) < time.Minute)
+		}
+	}
+}
+
+func TestPushCommitBadId(t *testing.T) {
+	err := sshRemote{}.PushCommit(pushProperties("/path"), map[string]interface{}{"password": "password"},
+		remote.Commit{Id: "../id"}, "", "")
+	assert.Error(t, err)
+}
+
+func TestPushCommitSourceMetadata(t *testing.T) {
+	for _, name := range []string{"metadata.json", pushMarker} {
+		source := writeRepository(t, map[string]string{name: "{}"})
+		err := sshRemote{}.PushCommit(pushProperties("/path"), map[string]interface{}{"password": "password"},
+			remote.Commit{Id: "id"}, source, "")
+		assert.Error(t, err, name)
+		os.RemoveAll(source)
+	}
+}
+
+func TestShellWriteFile(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("no POSIX shell available")
+	}
+	dir := writeRepository(t, map[string]string{})
+	defer os.RemoveAll(dir)
+	run = runLocal
+	runInput = runLocalInput
+
+	store := &shellStore{}
+	target := filepath.Join(dir, "sub dir", "-file")
+	assert.NoError(t, store.mkdirAll(filepath.Dir(target)))
+	assert.NoError(t, writeFileAtomic(store, target, []byte("it's here"), 0640))
+	content, err := ioutil.ReadFile(target)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "it's here", string(content))
+	}
+	info, err := os.Stat(target)
+	if assert.NoError(t, err) {
+		assert.Equal(t, os.FileMode(0640), info.Mode().Perm())
+	}
+	entries, err := ioutil.ReadDir(filepath.Dir(target))
+	if assert.NoError(t, err) {
+		assert.Len(t, entries, 1)
+	}
+
+	assert.NoError(t, store.symlink("-file", filepath.Join(dir, "link")))
+	link, err := os.Readlink(filepath.Join(dir, "link"))
+	if assert.NoError(t, err) {
+		assert.Equal(t, "-file", link)
+	}
+	run = runCommand
+	runInput = runCommandInput
+}
@@ -0,0 +1,153 @@
+/*
+ * Copyright The Titan Project Contributors.
+ */
+package ssh
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+/*
+ * Length of the block preceding the resume offset whose hash must match between the source and the destination
+ * before a partial file is resumed.
+ */
+const resumeCheckSize = 64 * 1024
+
+const (
+	directionPush = "push"
+	directionPull = "pull"
+)
+
+/*
+ * The progress of an interrupted transfer. Files listed as done were transferred in full, while the partial file was
+ * being transferred when the transfer stopped. For pulls, temp is the local directory holding what was received so
+ * far.
+ */
+type transferState struct {
+	Direction string        `json:"direction"`
+	Commit    string        `json:"commit"`
+	Temp      string        `json:"temp,omitempty"`
+	Done      []string      `json:"done,omitempty"`
+	Partial   *partialState `json:"partial,omitempty"`
+}
+
+type partialState struct {
+	Name    string      `json:"name"`
+	Size    int64       `json:"size"`
+	Mode    os.FileMode `json:"mode"`
+	ModTime time.Time   `json:"modTime"`
+}
+
+/*
+ * Error returned when a push or pull fails part way through. Passing the resume token to a retry of the same
+ * transfer skips the files that were already transferred and continues the partial file where it stopped.
+ */
+type TransferError struct {
+	Err         error
+	ResumeToken string
+}
+
+func (e *TransferError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *TransferError) Unwrap() error {
+	return e.Err
+}
+
+func (s *transferState) token() string {
+	content, err := json.Marshal(s)
+	if err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(content)
+}
+
+func (s *transferState) doneSet() map[string]bool {
+	done := map[string]bool{}
+	for _, name := range s.Done {
+		done[name] = true
+	}
+	return done
+}
+
+/*
+ * Decode a resume token, checking that it was issued for the same kind of transfer of the same commit. An empty
+ * token starts a new transfer.
+ */
+func decodeResumeToken(token string, direction string, commitId string) (*transferState, error) {
+	state := &transferState{Direction: direction, Commit: commitId}
+	if token == "" {
+		return state, nil
+	}
+	content, err := base64.RawURLEncoding.DecodeString(token)
+	if err == nil {
+		err = json.Unmarshal(content, state)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid resume token: %w", err)
+	}
+	if state.Direction != direction || state.Commit != commitId {
+		return nil, errors.New("resume token is for a different transfer")
+	}
+	return state, nil
+}
+
+/*
+ * Returns the offset at which to resume writing a partial file. This is the size of the destination, provided that
+ * the block preceding that offset hashes the same in the source and the destination, or zero if it does not, in which
+ * case the file is transferred again from the beginning. Remote blocks are hashed on the remote host where possible,
+ * so that only their hashes are transferred.
+ */
+func verifiedOffset(sourceSize int64, destSize int64, source func(offset int64, length int64) (string, error),
+	dest func(offset int64, length int64) (string, error)) int64 {
+	if destSize <= 0 || destSize > sourceSize {
+		return 0
+	}
+	start := destSize - resumeCheckSize
+	if start < 0 {
+		start = 0
+	}
+	a, err := source(start, destSize-start)
+	if err != nil {
+		return 0
+	}
+	b, err := dest(start, destSize-start)
+	if err != nil || a != b {
+		return 0
+	}
+	return destSize
+}
+
+/*
+ * Hash a range of a local file.
+ */
+func localHash(file string) func(offset int64, length int64) (string, error) {
+	return func(offset int64, length int64) (string, error) {
+		f, err := os.Open(file)
+		if err != nil {
+			return "", err
+		}
+		defer f.Close()
+		sum, size, err := hashFile(io.NewSectionReader(f, offset, length))
+		if err == nil && size != length {
+			err = io.ErrUnexpectedEOF
+		}
+		return sum, err
+	}
+}
+
+/*
+ * Hash a range of a remote file.
+ */
+func remoteHash(store remoteStore, file string) func(offset int64, length int64) (string, error) {
+	return func(offset int64, length int64) (string, error) {
+		return store.hashRange(file, offset, length)
+	}
+}
@@ -0,0 +1,323 @@
+/*
+ * Copyright The Titan Project Contributors.
+ */
+package ssh
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/titan-data/remote-sdk-go/remote"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestResumeToken(t *testing.T) {
+	state := &transferState{Direction: directionPush, Commit: "id", Done: []string{"a"},
+		Partial: &partialState{Name: "b", Size: 10}}
+	decoded, err := decodeResumeToken(state.token(), directionPush, "id")
+	if assert.NoError(t, err) {
+		assert.Equal(t, state, decoded)
+	}
+
+	_, err = decodeResumeToken(state.token(), directionPull, "id")
+	assert.Error(t, err)
+	_, err = decodeResumeToken(state.token(), directionPush, "other")
+	assert.Error(t, err)
+	_, err = decodeResumeToken("not a token", directionPush, "id")
+	assert.Error(t, err)
+
+	decoded, err = decodeResumeToken("", directionPull, "id")
+	if assert.NoError(t, err) {
+		assert.Equal(t, &transferState{Direction: directionPull, Commit: "id"}, decoded)
+	}
+}
+
+func TestVerifiedOffset(t *testing.T) {
+	source := strings.Repeat("abcdefgh", 20000)
+	read := func(content string) func(offset int64, length int64) (string, error) {
+		return func(offset int64, length int64) (string, error) {
+			if offset+length > int64(len(content)) {
+				return "", io.ErrUnexpectedEOF
+			}
+			sum, _, err := hashFile(strings.NewReader(content[offset : offset+length]))
+			return sum, err
+		}
+	}
+	size := int64(len(source))
+
+	assert.Equal(t, int64(100000), verifiedOffset(size, 100000, read(source), read(source[:100000])))
+	assert.Equal(t, int64(10), verifiedOffset(size, 10, read(source), read(source[:10])))
+	assert.Equal(t, int64(0), verifiedOffset(size, 100000, read(source), read(source[:99999]+"x")))
+	assert.Equal(t, int64(0), verifiedOffset(size, size+1, read(source), read(source+"x")))
+	assert.Equal(t, int64(0), verifiedOffset(size, 0, read(source), read("")))
+}
+
+/*
+ * A store that fails while writing a file, after writing part of its contents.
+ */
+type failingStore struct {
+	remoteStore
+	fail    string
+	resumed map[string]int64
+	written []string
+}
+
+func (f *failingStore) writeFile(path string, r io.Reader, mode os.FileMode) error {
+	f.written = append(f.written, filepath.Base(path))
+	if filepath.Base(path) == f.fail {
+		f.remoteStore.writeFile(path, io.LimitReader(r, 100000), mode)
+		return errors.New("connection lost")
+	}
+	return f.remoteStore.writeFile(path, r, mode)
+}
+
+func (f *failingStore) resumeFile(path string, r io.Reader, offset int64, mode os.FileMode) error {
+	f.resumed[filepath.Base(path)] = offset
+	return f.remoteStore.resumeFile(path, r, offset, mode)
+}
+
+func TestPushResume(t *testing.T) {
+	big := strings.Repeat("0123456789", 30000)
+	source := writeRepository(t, map[string]string{"a": "first", "b": big, "c": "last"})
+	defer os.RemoveAll(source)
+	repo := writeRepository(t, map[string]string{})
+	defer os.RemoveAll(repo)
+	store, done := localStore(t, repo)
+	defer done()
+
+	failing := &failingStore{remoteStore: store, fail: "b", resumed: map[string]int64{}}
+	state := &transferState{Direction: directionPush, Commit: "id"}
+	err := uploadDir(failing, source, repo, state, nil)
+	if assert.Error(t, err) {
+		assert.Equal(t, []string{"a"}, state.Done)
+		assert.Equal(t, "b", state.Partial.Name)
+	}
+
+	state, err = decodeResumeToken(state.token(), directionPush, "id")
+	if assert.NoError(t, err) {
+		failing = &failingStore{remoteStore: store, resumed: map[string]int64{}}
+		err = uploadDir(failing, source, repo, state, nil)
+		if assert.NoError(t, err) {
+			assert.Equal(t, []string{"c"}, failing.written)
+			assert.Equal(t, map[string]int64{"b": 100000}, failing.resumed)
+			content, _ := ioutil.ReadFile(filepath.Join(repo, "b"))
+			assert.Equal(t, big, string(content))
+		}
+	}
+}
+
+func TestPushResumeCollected(t *testing.T) {
+	repo := writeRepository(t, map[string]string{})
+	defer os.RemoveAll(repo)
+	dir, source := writeSourceData(t)
+	defer os.RemoveAll(dir)
+
+	mockSFTPDial()
+	props := pushProperties(repo)
+	params := map[string]interface{}{"password": "password"}
+	// A token from a push whose directory has since been garbage collected
+	state := &transferState{Direction: directionPush, Commit: "id", Done: []string{"dir/file", "private"}}
+	assert.NoError(t, sshRemote{}.PushCommit(props, params, remote.Commit{Id: "id"}, source, state.token()))
+	_, err := sshRemote{}.VerifyCommit(props, params, "id")
+	assert.NoError(t, err)
+	_, err = os.Lstat(filepath.Join(repo, "id", pushMarker))
+	assert.True(t, os.IsNotExist(err))
+	resetSFTPDial()
+}
+
+func TestPushResumeMismatch(t *testing.T) {
+	big := strings.Repeat("0123456789", 30000)
+	source := writeRepository(t, map[string]string{"b": big})
+	defer os.RemoveAll(source)
+	repo := writeRepository(t, map[string]string{"b": "corrupted"})
+	defer os.RemoveAll(repo)
+	store, done := localStore(t, repo)
+	defer done()
+
+	failing := &failingStore{remoteStore: store, resumed: map[string]int64{}}
+	state := &transferState{Direction: directionPush, Commit: "id", Partial: &partialState{Name: "b"}}
+	if assert.NoError(t, uploadDir(failing, source, repo, state, nil)) {
+		assert.Equal(t, []string{"b"}, failing.written)
+		content, _ := ioutil.ReadFile(filepath.Join(repo, "b"))
+		assert.Equal(t, big, string(content))
+	}
+}
+
+/*
+ * Set up an interrupted pull of the commit written by writeCommitData(), with 'private' done and 'dir/file'
+ * partially received.
+ */
+func interruptedPull(t *testing.T, local string, partial string) string {
+	temp := filepath.Join(local, ".dest"+tempMarker+"x")
+	assert.NoError(t, os.MkdirAll(filepath.Join(temp, "dir"), 0700))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(temp, "private"), []byte("SECRET"), 0600))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(temp, "dir", "file"), []byte(partial), 0600))
+	state := &transferState{Direction: directionPull, Commit: "id", Temp: temp, Done: []string{"private"},
+		Partial: &partialState{Name: "dir/file", Size: 7, Mode: 0644}}
+	return state.token()
+}
+
+func TestPullResume(t *testing.T) {
+	for _, transport := range []string{"sftp", "shell"} {
+		if _, err := exec.LookPath("tar"); err != nil && transport == "shell" {
+			continue
+		}
+		repo := writeCommitData(t)
+		local := writeRepository(t, map[string]string{})
+		dest := filepath.Join(local, "dest")
+
+		mockSFTPDial()
+		run = runLocal
+		stream = streamLocal
+		props := pushProperties(repo)
+		props["transport"] = transport
+		token := interruptedPull(t, local, "cont")
+		_, err := sshRemote{}.PullCommit(props, map[string]interface{}{"password": "password"}, "id", dest, token)
+		if assert.NoError(t, err) {
+			content, _ := ioutil.ReadFile(filepath.Join(dest, "dir", "file"))
+			assert.Equal(t, "content", string(content))
+			// Files that are done are not transferred again
+			content, _ = ioutil.ReadFile(filepath.Join(dest, "private"))
+			assert.Equal(t, "SECRET", string(content))
+			link, _ := os.Readlink(filepath.Join(dest, "link"))
+			assert.Equal(t, "dir/file", link)
+		}
+		run = runCommand
+		stream = streamCommand
+		resetSFTPDial()
+		os.RemoveAll(repo)
+		os.RemoveAll(local)
+	}
+}
+
+func TestPullResumeNoGNUTar(t *testing.T) {
+	repo := writeCommitData(t)
+	defer os.RemoveAll(repo)
+	local := writeRepository(t, map[string]string{})
+	defer os.RemoveAll(local)
+
+	mockSFTPDial()
+	run = func(conn *ssh.Client, command string) ([]byte, error) {
+		if command == "tar --version" {
+			return []byte("bsdtar 3.5.1 - libarchive 3.5.1\n"), nil
+		}
+		return runLocal(conn, command)
+	}
+	stream = streamLocal
+	props := pushProperties(repo)
+	props["transport"] = "shell"
+	token := interruptedPull(t, local, "cont")
+	_, err := sshRemote{}.PullCommit(props, map[string]interface{}{"password": "password"}, "id",
+		filepath.Join(local, "dest"), token)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "requires GNU tar")
+	}
+	run = runCommand
+	stream = streamCommand
+	resetSFTPDial()
+}
+
+func TestPullResumeMismatch(t *testing.T) {
+	repo := writeCommitData(t)
+	defer os.RemoveAll(repo)
+	local := writeRepository(t, map[string]string{})
+	defer os.RemoveAll(local)
+	dest := filepath.Join(local, "dest")
+
+	mockSFTPDial()
+	token := interruptedPull(t, local, "xyz")
+	_, err := sshRemote{}.PullCommit(pushProperties(repo), map[string]interface{}{"password": "password"}, "id",
+		dest, token)
+	if assert.NoError(t, err) {
+		content, _ := ioutil.ReadFile(filepath.Join(dest, "dir", "file"))
+		assert.Equal(t, "content", string(content))
+	}
+	resetSFTPDial()
+}
+
+func TestPullResumeMissingTemp(t *testing.T) {
+	local := writeRepository(t, map[string]string{})
+	defer os.RemoveAll(local)
+	state := &transferState{Direction: directionPull, Commit: "id", Temp: filepath.Join(local, "missing")}
+
+	repo := writeCommitData(t)
+	defer os.RemoveAll(repo)
+	mockSFTPDial()
+	_, err := sshRemote{}.PullCommit(pushProperties(repo), map[string]interface{}{"password": "password"}, "id",
+		filepath.Join(local, "dest"), state.token())
+	assert.Error(t, err)
+	resetSFTPDial()
+}
+
+func TestPullInterrupted(t *testing.T) {
+	repo := writeCommitData(t)
+	defer os.RemoveAll(repo)
+	local := writeRepository(t, map[string]string{})
+	defer os.RemoveAll(local)
+
+	mockSFTPDial()
+	run = runLocal
+	stream = func(conn *ssh.Client, command string, input io.Reader) (io.ReadCloser, error) {
+		return streamLocal(conn, command+" | head -c 2000", input)
+	}
+	props := pushProperties(repo)
+	props["transport"] = "shell"
+	_, err := sshRemote{}.PullCommit(props, map[string]interface{}{"password": "password"}, "id",
+		filepath.Join(local, "dest"), "")
+	var transferErr *TransferError
+	if assert.True(t, errors.As(err, &transferErr)) {
+		stream = streamLocal
+		_, err = sshRemote{}.PullCommit(props, map[string]interface{}{"password": "password"}, "id",
+			filepath.Join(local, "dest"), transferErr.ResumeToken)
+		if assert.NoError(t, err) {
+			checkCommitData(t, filepath.Join(local, "dest"))
+		}
+	}
+	run = runCommand
+	stream = streamCommand
+	resetSFTPDial()
+}
+
+func TestShellResumeFile(t *testing.T) {
+	if _, err := exec.LookPath("truncate"); err != nil {
+		t.Skip("no truncate available")
+	}
+	dir := writeRepository(t, map[string]string{"file": "0123456789"})
+	defer os.RemoveAll(dir)
+	run = runLocal
+	runInput = runLocalInput
+
+	store := &shellStore{}
+	file := filepath.Join(dir, "file")
+	size, err := store.fileSize(file)
+	if assert.NoError(t, err) {
+		assert.Equal(t, int64(10), size)
+	}
+	expected, _, _ := hashFile(strings.NewReader("23456"))
+	sum, err := store.hashRange(file, 2, 5)
+	if assert.NoError(t, err) {
+		assert.Equal(t, expected, sum)
+	}
+	sum, err = store.hashRange(file, 8, 5)
+	if assert.NoError(t, err) {
+		assert.NotEqual(t, expected, sum)
+	}
+	local, err := localHash(file)(2, 5)
+	if assert.NoError(t, err) {
+		assert.Equal(t, expected, local)
+	}
+	_, err = localHash(file)(8, 5)
+	assert.Error(t, err)
+
+	assert.NoError(t, store.resumeFile(file, strings.NewReader("abc"), 4, 0600))
+	content, _ := ioutil.ReadFile(file)
+	assert.Equal(t, "0123abc", string(content))
+	run = runCommand
+	runInput = runCommandInput
+}
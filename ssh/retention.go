@@ -0,0 +1,220 @@
+/*
+ * Copyright The Titan Project Contributors.
+ */
+package ssh
+
+import (
+	"errors"
+	"fmt"
+	"github.com/titan-data/remote-sdk-go/remote"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+/*
+ * Which commits to keep. A commit is kept if any rule selects it: the most recent Last commits, the most recent commit
+ * of each of the last Daily days, Weekly ISO weeks, Monthly months and Yearly years that have commits, and every
+ * commit matching one of the pin tags, such as keep=true. Everything else is deleted.
+ */
+type RetentionPolicy struct {
+	Last    int
+	Daily   int
+	Weekly  int
+	Monthly int
+	Yearly  int
+	Pin     []remote.Tag
+	// Time zone in which days, weeks, months and years begin. Defaults to UTC.
+	Location *time.Location
+}
+
+/*
+ * Whether to keep a commit, along with the rules that selected it.
+ */
+type RetentionDecision struct {
+	Commit  remote.Commit
+	Keep    bool
+	Reasons []string
+}
+
+/*
+ * The outcome of applying a retention policy to the commits of a repository, most recent first.
+ */
+type RetentionPlan struct {
+	Decisions []RetentionDecision
+	// Whether the commits to delete were deleted, rather than only planned
+	Applied bool
+}
+
+/*
+ * Returns the ids of the commits that the plan deletes.
+ */
+func (p *RetentionPlan) Deleted() []string {
+	var ids []string
+	for _, d := range p.Decisions {
+		if !d.Keep {
+			ids = append(ids, d.Commit.Id)
+		}
+	}
+	return ids
+}
+
+/*
+ * Returns a preview of the plan, with one line per commit followed by a summary.
+ */
+func (p *RetentionPlan) String() string {
+	var b strings.Builder
+	w := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+	for _, d := range p.Decisions {
+		action := "delete"
+		if d.Keep {
+			action = "keep"
+		}
+		timestamp, _ := d.Commit.Properties["timestamp"].(string)
+		if timestamp == "" {
+			timestamp = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", action, d.Commit.Id, timestamp, strings.Join(d.Reasons, ", "))
+	}
+	w.Flush()
+	deleted := len(p.Deleted())
+	verb := "to delete"
+	if p.Applied {
+		verb = "deleted"
+	}
+	fmt.Fprintf(&b, "%d commits kept, %d %s\n", len(p.Decisions)-deleted, deleted, verb)
+	return b.String()
+}
+
+/*
+ * A calendar period used to thin out commits, identified by the key of the period a time falls into.
+ */
+type retentionPeriod struct {
+	name  string
+	count int
+	key   func(t time.Time) string
+}
+
+/*
+ * Compute which of the given commits a retention policy keeps. Commits are ordered by their timestamp, as ListCommits
+ * returns them. Commits without a valid timestamp are always kept, since their age is unknown.
+ */
+func PlanRetention(commits []remote.Commit, policy RetentionPolicy) (*RetentionPlan, error) {
+	periods := []retentionPeriod{
+		{"daily", policy.Daily, func(t time.Time) string { return t.Format("2006-01-02") }},
+		{"weekly", policy.Weekly, func(t time.Time) string {
+			year, week := t.ISOWeek()
+			return fmt.Sprintf("%d-W%02d", year, week)
+		}},
+		{"monthly", policy.Monthly, func(t time.Time) string { return t.Format("2006-01") }},
+		{"yearly", policy.Yearly, func(t time.Time) string { return t.Format("2006") }},
+	}
+	keeps := policy.Last > 0 || len(policy.Pin) > 0
+	for _, p := range periods {
+		if p.count < 0 {
+			return nil, fmt.Errorf("invalid %s retention count %d", p.name, p.count)
+		}
+		keeps = keeps || p.count > 0
+	}
+	if policy.Last < 0 {
+		return nil, fmt.Errorf("invalid retention count %d", policy.Last)
+	}
+	if !keeps {
+		return nil, errors.New("retention policy keeps no commits")
+	}
+	location := policy.Location
+	if location == nil {
+		location = time.UTC
+	}
+
+	sorted := make([]remote.Commit, len(commits))
+	copy(sorted, commits)
+	remote.SortCommits(sorted)
+
+	plan := &RetentionPlan{}
+	last := map[string]string{}
+	counts := map[string]int{}
+	for i, c := range sorted {
+		d := RetentionDecision{Commit: c}
+		for _, tag := range policy.Pin {
+			if remote.MatchTags(c.Properties, []remote.Tag{tag}) {
+				d.Reasons = append(d.Reasons, "pinned by "+tagString(tag))
+			}
+		}
+		if i < policy.Last {
+			d.Reasons = append(d.Reasons, fmt.Sprintf("last %d", policy.Last))
+		}
+		timestamp, _ := c.Properties["timestamp"].(string)
+		t, err := time.Parse(time.RFC3339, timestamp)
+		if err != nil {
+			d.Reasons = append(d.Reasons, "no timestamp")
+		} else {
+			for _, p := range periods {
+				key := p.key(t.In(location))
+				if counts[p.name] < p.count && last[p.name] != key {
+					d.Reasons = append(d.Reasons, p.name+" "+key)
+					counts[p.name]++
+				}
+				last[p.name] = key
+			}
+		}
+		d.Keep = len(d.Reasons) > 0
+		plan.Decisions = append(plan.Decisions, d)
+	}
+	return plan, nil
+}
+
+func tagString(tag remote.Tag) string {
+	if tag.Value == nil {
+		return tag.Key
+	}
+	return tag.Key + "=" + *tag.Value
+}
+
+/*
+ * Apply a retention policy to the commits of the repository, returning the plan. Unless this is a dry run, the
+ * commits that the policy doesn't keep are deleted, as with DeleteCommit. The plan is computed and carried out while
+ * holding the repository lock, so it reflects the commits that exist when they are deleted. For commits in the
+ * objects layout, their data is only reclaimed by CollectGarbage().
+ */
+func (s sshRemote) ApplyRetention(properties map[string]interface{}, parameters map[string]interface{},
+	policy RetentionPolicy, dryRun bool) (*RetentionPlan, error) {
+	store, release, err := connectStore(properties, parameters)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	var plan *RetentionPlan
+	err = withLock(store, properties, func() error {
+		commits, err := listCommits(store, properties, newKeyring(store, properties, parameters), []remote.Tag{})
+		if err != nil {
+			return err
+		}
+		if plan, err = PlanRetention(commits, policy); err != nil || dryRun {
+			return err
+		}
+
+		var failed []string
+		var firstErr error
+		for _, id := range plan.Deleted() {
+			if err := deleteCommit(store, properties, id); err != nil {
+				failed = append(failed, id)
+				if firstErr == nil {
+					firstErr = err
+				}
+			}
+		}
+		plan.Applied = true
+		if len(failed) > 0 {
+			sort.Strings(failed)
+			return fmt.Errorf("failed to delete %s: %w", strings.Join(failed, ", "), firstErr)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return plan, nil
+}
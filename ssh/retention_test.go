@@ -0,0 +1,130 @@
+/*
+ * Copyright The Titan Project Contributors.
+ */
+package ssh
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/titan-data/remote-sdk-go/remote"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+/*
+ * Returns a commit every twelve hours for the given number of days, ending on 2019-12-31.
+ */
+func retentionCommits(days int) []remote.Commit {
+	end := time.Date(2019, 12, 31, 18, 0, 0, 0, time.UTC)
+	var commits []remote.Commit
+	for i := 0; i < 2*days; i++ {
+		t := end.Add(time.Duration(-12*i) * time.Hour)
+		commits = append(commits, remote.Commit{Id: t.Format("20060102-15"),
+			Properties: map[string]interface{}{"timestamp": t.Format(time.RFC3339)}})
+	}
+	return commits
+}
+
+func keptIds(plan *RetentionPlan) []string {
+	var ids []string
+	for _, d := range plan.Decisions {
+		if d.Keep {
+			ids = append(ids, d.Commit.Id)
+		}
+	}
+	return ids
+}
+
+func TestPlanRetention(t *testing.T) {
+	plan, err := PlanRetention(retentionCommits(100), RetentionPolicy{Last: 1, Daily: 3, Weekly: 2, Monthly: 3})
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"20191231-18", "20191230-18", "20191229-18", "20191130-18", "20191031-18"},
+			keptIds(plan))
+		assert.Equal(t, []string{"last 1", "daily 2019-12-31", "weekly 2020-W01", "monthly 2019-12"},
+			plan.Decisions[0].Reasons)
+		assert.Equal(t, []string{"daily 2019-12-29", "weekly 2019-W52"}, plan.Decisions[4].Reasons)
+		assert.Len(t, plan.Deleted(), 195)
+		assert.False(t, plan.Applied)
+	}
+}
+
+func TestPlanRetentionPinned(t *testing.T) {
+	commits := retentionCommits(3)
+	commits[3].Properties["tags"] = map[string]interface{}{"keep": "true"}
+	commits[4].Properties["tags"] = map[string]interface{}{"keep": "false"}
+	commits = append(commits, remote.Commit{Id: "undated", Properties: map[string]interface{}{}})
+	value := "true"
+	plan, err := PlanRetention(commits, RetentionPolicy{Daily: 1, Pin: []remote.Tag{{Key: "keep", Value: &value}}})
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"20191231-18", "20191230-06", "undated"}, keptIds(plan))
+		assert.Equal(t, []string{"pinned by keep=true"}, plan.Decisions[3].Reasons)
+		assert.Equal(t, []string{"no timestamp"}, plan.Decisions[6].Reasons)
+	}
+}
+
+func TestPlanRetentionLocation(t *testing.T) {
+	commits := []remote.Commit{
+		{Id: "a", Properties: map[string]interface{}{"timestamp": "2019-12-31T03:00:00Z"}},
+		{Id: "b", Properties: map[string]interface{}{"timestamp": "2019-12-30T23:00:00Z"}},
+	}
+	plan, err := PlanRetention(commits, RetentionPolicy{Daily: 2})
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"a", "b"}, keptIds(plan))
+	}
+	plan, err = PlanRetention(commits, RetentionPolicy{Daily: 2, Location: time.FixedZone("EST", -5*3600)})
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"a"}, keptIds(plan))
+	}
+}
+
+func TestPlanRetentionInvalid(t *testing.T) {
+	_, err := PlanRetention(retentionCommits(1), RetentionPolicy{})
+	assert.Error(t, err)
+	_, err = PlanRetention(retentionCommits(1), RetentionPolicy{Daily: -1, Last: 1})
+	assert.Error(t, err)
+}
+
+func TestRetentionPreview(t *testing.T) {
+	plan, err := PlanRetention(retentionCommits(1), RetentionPolicy{Last: 1})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "keep    20191231-18  2019-12-31T18:00:00Z  last 1\n"+
+			"delete  20191231-06  2019-12-31T06:00:00Z  \n"+
+			"1 commits kept, 1 to delete\n", plan.String())
+	}
+}
+
+func TestApplyRetention(t *testing.T) {
+	files := map[string]string{}
+	for _, c := range retentionCommits(3) {
+		files[c.Id+"/metadata.json"] = fmt.Sprintf("{\"timestamp\": \"%s\"}", c.Properties["timestamp"])
+		files[c.Id+"/data"] = "data"
+	}
+	repo := writeRepository(t, files)
+	defer os.RemoveAll(repo)
+
+	mockSFTPDial()
+	params := map[string]interface{}{"password": "password"}
+	plan, err := sshRemote{}.ApplyRetention(pushProperties(repo), params, RetentionPolicy{Daily: 2}, true)
+	if assert.NoError(t, err) {
+		assert.False(t, plan.Applied)
+		assert.Len(t, plan.Deleted(), 4)
+	}
+	commits, _ := sshRemote{}.ListCommits(pushProperties(repo), params, []remote.Tag{})
+	assert.Len(t, commits, 6)
+
+	plan, err = sshRemote{}.ApplyRetention(pushProperties(repo), params, RetentionPolicy{Daily: 2}, false)
+	if assert.NoError(t, err) {
+		assert.True(t, plan.Applied)
+		assert.Contains(t, plan.String(), "2 commits kept, 4 deleted")
+	}
+	commits, _ = sshRemote{}.ListCommits(pushProperties(repo), params, []remote.Tag{})
+	if assert.Len(t, commits, 2) {
+		assert.Equal(t, "20191231-18", commits[0].Id)
+		assert.Equal(t, "20191230-18", commits[1].Id)
+	}
+	_, err = os.Stat(filepath.Join(repo, "20191229-18"))
+	assert.True(t, os.IsNotExist(err))
+	resetSFTPDial()
+}
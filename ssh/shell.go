@@ -0,0 +1,61 @@
+/*
+ * Copyright The Titan Project Contributors.
+ */
+package ssh
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+/*
+ * Quote a string for use as a single word in a POSIX shell command. Strings made up entirely of characters that
+ * have no special meaning are left as-is, everything else is enclosed in single quotes, within which the shell
+ * interprets nothing. Embedded single quotes are written as '\''.
+ */
+func shellQuote(s string) string {
+	if s == "" {
+		return "''"
+	}
+	safe := true
+	for _, c := range s {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("@%+=:,./_-", c)) {
+			safe = false
+			break
+		}
+	}
+	if safe {
+		return s
+	}
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+/*
+ * Build a remote shell command from a trusted command string and a list of untrusted arguments, each of which is
+ * quoted so that it is passed to the command as a single literal argument.
+ */
+func shellCommand(command string, args ...string) string {
+	var b strings.Builder
+	b.WriteString(command)
+	for _, arg := range args {
+		b.WriteByte(' ')
+		b.WriteString(shellQuote(arg))
+	}
+	return b.String()
+}
+
+/*
+ * Validate that a commit ID names a single entry directly within the repository path, so that it can never be used
+ * to reference files elsewhere on the remote host. Hidden names are reserved for the repository itself, such as its
+ * objects, lock, and key, so they are never commits either.
+ */
+func validateCommitId(commitId string) error {
+	if commitId == "" {
+		return errors.New("missing commit id")
+	}
+	if strings.HasPrefix(commitId, ".") || strings.ContainsAny(commitId, "/\x00\n") {
+		return fmt.Errorf("invalid commit id '%s'", commitId)
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+/*
+ * Copyright The Titan Project Contributors.
+ */
+package ssh
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/titan-data/remote-sdk-go/remote"
+	"golang.org/x/crypto/ssh"
+	"math/rand"
+	"os/exec"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/quick"
+)
+
+func TestShellQuote(t *testing.T) {
+	assert.Equal(t, "''", shellQuote(""))
+	assert.Equal(t, "/path/to/file.json", shellQuote("/path/to/file.json"))
+	assert.Equal(t, "'a b'", shellQuote("a b"))
+	assert.Equal(t, `'it'\''s'`, shellQuote("it's"))
+	assert.Equal(t, "'$(rm -rf /)'", shellQuote("$(rm -rf /)"))
+}
+
+func TestShellCommand(t *testing.T) {
+	assert.Equal(t, "cat -- '/a b/c' /d", shellCommand("cat --", "/a b/c", "/d"))
+}
+
+func TestValidateCommitId(t *testing.T) {
+	assert.NoError(t, validateCommitId("3b6a1f2c-9e2b-4b1e-8a3e-6f1c2d3e4f5a"))
+	assert.NoError(t, validateCommitId("id with spaces"))
+	for _, id := range []string{"", ".", "..", "../etc", "a/b", "/", "a\nb", "a\x00b",
+		".objects", ".lock", ".encryption.json", ".id.tmp"} {
+		assert.Error(t, validateCommitId(id), id)
+	}
+}
+
+func TestGetCommitBadId(t *testing.T) {
+	conn := new(MockConn)
+	conn.On("Close").Return(nil)
+	newSFTPClient = noSFTP
+	dial = func(network string, addr string, cfg *ssh.ClientConfig) (*ssh.Client, error) {
+		return &ssh.Client{Conn: conn}, nil
+	}
+	called := false
+	run = func(conn *ssh.Client, command string) (bytes []byte, err error) {
+		called = true
+		return []byte("{}"), nil
+	}
+	r := remote.Get("ssh")
+	_, err := r.GetCommit(map[string]interface{}{"username": "username", "address": "address", "path": "/path"},
+		map[string]interface{}{"password": "password"}, "../../etc")
+	assert.Error(t, err)
+	assert.False(t, called)
+
+	run = runCommand
+	newSFTPClient = startSFTP
+	dial = ssh.Dial
+	connections.closeAll()
+}
+
+/*
+ * A string drawn mostly from shell metacharacters, to give quick.Check a good chance of finding quoting bugs.
+ */
+type shellString string
+
+const shellAlphabet = "abc \t\n'\"`$(){}[]<>|&;*?~!#%^=\\-/.,:@é"
+
+func (shellString) Generate(rand *rand.Rand, size int) reflect.Value {
+	alphabet := []rune(shellAlphabet)
+	runes := make([]rune, rand.Intn(size+1))
+	for i := range runes {
+		runes[i] = alphabet[rand.Intn(len(alphabet))]
+	}
+	return reflect.ValueOf(shellString(runes))
+}
+
+/*
+ * Execute a generated command with a local POSIX shell, substituting the remote program with printf so that the
+ * output is exactly the arguments the program would have received, one per line.
+ */
+func runLocally(t *testing.T, command string, program string) (string, bool) {
+	if !strings.HasPrefix(command, program+" ") {
+		return "", false
+	}
+	script := "printf '%s\\n'" + command[len(program):]
+	output, err := exec.Command("sh", "-c", script).Output()
+	if err != nil {
+		t.Logf("failed to run %q: %v", script, err)
+		return "", false
+	}
+	return string(output), true
+}
+
+func TestShellQuoteFuzz(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("no POSIX shell available")
+	}
+
+	var command string
+	run = func(conn *ssh.Client, cmd string) (bytes []byte, err error) {
+		command = cmd
+		return []byte("{}"), nil
+	}
+	defer func() { run = runCommand }()
+
+	check := func(path shellString, commitId shellString) bool {
+		_, err := readCommit(&shellStore{}, map[string]interface{}{"path": string(path)}, nil, string(commitId))
+		if validateCommitId(string(commitId)) != nil {
+			return err != nil
+		}
+		output, ok := runLocally(t, command, "cat")
+		expected := "--\n" + string(path) + "/" + string(commitId) + "/metadata.json\n"
+		return ok && output == expected
+	}
+	err := quick.Check(check, &quick.Config{MaxCount: 500})
+	assert.NoError(t, err)
+
+	checkArgs := func(args []shellString) bool {
+		var expected string
+		var raw []string
+		for _, a := range args {
+			raw = append(raw, string(a))
+			expected += string(a) + "\n"
+		}
+		output, ok := runLocally(t, shellCommand("cmd", raw...)+" ", "cmd")
+		return (len(args) == 0 && output == "\n") || (ok && output == expected)
+	}
+	err = quick.Check(checkArgs, &quick.Config{MaxCount: 200})
+	assert.NoError(t, err)
+}
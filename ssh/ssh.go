@@ -4,15 +4,19 @@
 package ssh
 
 import (
-	"bufio"
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/titan-data/remote-sdk-go/remote"
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/terminal"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/url"
+	"os"
+	"os/user"
 	"strconv"
 	"strings"
 )
@@ -20,6 +24,40 @@ import (
 type sshRemote struct {
 }
 
+/*
+ * The operations of the SSH remote beyond those of remote.Remote, which the plugin protocol has no way to carry. They
+ * are available to callers that link this package, either through New() or by asserting the remote registered as
+ * "ssh" to a Repository.
+ */
+type Repository interface {
+	remote.Remote
+
+	PushCommit(properties map[string]interface{}, parameters map[string]interface{}, commit remote.Commit,
+		source string, resumeToken string) error
+	PullCommit(properties map[string]interface{}, parameters map[string]interface{}, commitId string, dest string,
+		resumeToken string) (*remote.Commit, error)
+	DeleteCommit(properties map[string]interface{}, parameters map[string]interface{}, commitId string) error
+	UpdateTags(properties map[string]interface{}, parameters map[string]interface{}, commitId string,
+		add map[string]string, remove []string) (*remote.Commit, error)
+	VerifyCommit(properties map[string]interface{}, parameters map[string]interface{}, commitId string) (string, error)
+	CollectGarbage(properties map[string]interface{}, parameters map[string]interface{},
+		options GCOptions) (*GCReport, error)
+	ApplyRetention(properties map[string]interface{}, parameters map[string]interface{}, policy RetentionPolicy,
+		dryRun bool) (*RetentionPlan, error)
+	PinHostKey(properties map[string]interface{}, parameters map[string]interface{}, fingerprint string) (string, error)
+	GetLock(properties map[string]interface{}, parameters map[string]interface{}) (*LockOwner, error)
+	BreakLock(properties map[string]interface{}, parameters map[string]interface{}) (string, error)
+}
+
+/*
+ * Returns the SSH remote.
+ */
+func New() Repository {
+	return sshRemote{}
+}
+
+var currentUser = user.Current
+
 func (s sshRemote) Type() (string, error) {
 	return "ssh", nil
 }
@@ -42,10 +80,31 @@ func (s sshRemote) FromURL(rawUrl string, additionalProperties map[string]string
 		return nil, errors.New("missing remote host")
 	}
 
-	if url.User == nil || url.User.Username() == "" {
+	// Anything not spelled out in the URL is taken from ~/.ssh/config, as it would be for 'ssh <host>'
+	config, err := lookupSSHConfig(url.Hostname(), url.User.Username())
+	if err != nil {
+		return nil, err
+	}
+
+	username := url.User.Username()
+	if username == "" {
+		username = config.user
+	}
+	if username == "" {
+		// As with ssh, the local user is the default
+		if u, err := currentUser(); err == nil {
+			username = u.Username
+		}
+	}
+	if username == "" {
 		return nil, errors.New("missing remote username")
 	}
 
+	address := url.Hostname()
+	if config.hostName != "" {
+		address = config.hostName
+	}
+
 	path := url.Path
 	if strings.Index(path, "/~/") == 0 {
 		path = path[3:]
@@ -57,15 +116,94 @@ func (s sshRemote) FromURL(rawUrl string, additionalProperties map[string]string
 		return nil, errors.New("both remote password and key file cannot be specified")
 	}
 
+	agentAuth := false
+	if a, ok := additionalProperties["agent"]; ok {
+		agentAuth, err = strconv.ParseBool(a)
+		if err != nil {
+			return nil, fmt.Errorf("invalid agent property '%s': %w", a, err)
+		}
+	}
+	if agentAuth && (keyFile != "" || passwordSet) {
+		return nil, errors.New("ssh-agent cannot be combined with a remote password or key file")
+	}
+
+	if keyFile == "" && !passwordSet && !agentAuth && config.identityFile != "" {
+		if _, err := os.Stat(config.identityFile); err == nil {
+			keyFile = config.identityFile
+		}
+	}
+
+	knownHostsFile := additionalProperties["knownHostsFile"]
+	if knownHostsFile == "" {
+		knownHostsFile = config.userKnownHostsFile
+	}
+
+	proxyJump := additionalProperties["proxyJump"]
+	if proxyJump == "" {
+		proxyJump = config.proxyJump
+	}
+	if proxyJump != "" {
+		proxyJump, err = resolveProxyJump(proxyJump)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := parseProxyJump(proxyJump, username); err != nil {
+			return nil, err
+		}
+	}
+
+	if transport, ok := additionalProperties["transport"]; ok {
+		if err := validateTransport(transport); err != nil {
+			return nil, err
+		}
+	}
+	if mode, ok := additionalProperties["transferMode"]; ok {
+		if err := validateTransferMode(mode, additionalProperties["transport"]); err != nil {
+			return nil, err
+		}
+	}
+	if layout, ok := additionalProperties["layout"]; ok {
+		if err := validateLayout(layout, additionalProperties["transferMode"]); err != nil {
+			return nil, err
+		}
+	}
+	if encryption, ok := additionalProperties["encryption"]; ok {
+		if err := validateEncryption(encryption, additionalProperties["layout"]); err != nil {
+			return nil, err
+		}
+	}
+	if fields, ok := additionalProperties["cleartextFields"]; ok {
+		if err := validateCleartextFields(fields); err != nil {
+			return nil, err
+		}
+	}
+	if compression, ok := additionalProperties["compression"]; ok {
+		if err := validateCompression(compression, additionalProperties["layout"]); err != nil {
+			return nil, err
+		}
+	}
+	if c, ok := additionalProperties["sshCompression"]; ok {
+		enabled, err := strconv.ParseBool(c)
+		if err != nil {
+			return nil, fmt.Errorf("invalid sshCompression property '%s': %w", c, err)
+		}
+		if err := validateSSHCompression(enabled); err != nil {
+			return nil, err
+		}
+	}
+
 	for k := range additionalProperties {
-		if k != "keyFile" {
+		if k != "keyFile" && k != "knownHostsFile" && k != "hostKey" && k != "agent" && k != "proxyJump" &&
+			k != "transport" && k != "maxSessions" && k != "transferMode" &&
+			k != "layout" && k != "encryption" && k != "cleartextFields" && k != "compression" &&
+			k != "sshCompression" {
 			return nil, errors.New(fmt.Sprintf("invalid rmeote property '%s'", k))
 		}
 	}
 
 	result := map[string]interface{}{
-		"username": url.User.Username(),
-		"address":  url.Hostname(),
+		"username": username,
+		"address":  address,
 		"path":     path,
 	}
 
@@ -78,10 +216,59 @@ func (s sshRemote) FromURL(rawUrl string, additionalProperties map[string]string
 			return nil, fmt.Errorf("invalid port '%s': %w", url.Port(), err)
 		}
 		result["port"] = port
+	} else if config.port != 0 {
+		result["port"] = config.port
 	}
 	if keyFile != "" {
 		result["keyFile"] = keyFile
 	}
+	if knownHostsFile != "" {
+		result["knownHostsFile"] = knownHostsFile
+	}
+	if hostKey := additionalProperties["hostKey"]; hostKey != "" && hostKey != hostKeyFirstUse {
+		if err := validateHostKey(hostKey); err != nil {
+			return nil, err
+		}
+		result["hostKey"] = hostKey
+	}
+	if agentAuth {
+		result["agent"] = true
+	}
+	if proxyJump != "" {
+		result["proxyJump"] = proxyJump
+	}
+	if transport := additionalProperties["transport"]; transport != "" {
+		result["transport"] = transport
+	}
+	if mode := additionalProperties["transferMode"]; mode != "" {
+		result["transferMode"] = mode
+	}
+	if layout := additionalProperties["layout"]; layout != "" {
+		result["layout"] = layout
+	}
+	if encryption := additionalProperties["encryption"]; encryption != "" {
+		result["encryption"] = encryption
+	}
+	if fields := additionalProperties["cleartextFields"]; fields != "" {
+		result["cleartextFields"] = fields
+	}
+	if compression := additionalProperties["compression"]; compression != "" {
+		result["compression"] = compression
+	}
+	if maxSessions, ok := additionalProperties["maxSessions"]; ok {
+		max, err := strconv.Atoi(maxSessions)
+		if err != nil || max <= 0 {
+			return nil, fmt.Errorf("invalid maxSessions '%s', must be a positive integer", maxSessions)
+		}
+		result["maxSessions"] = max
+	}
+
+	// Pin the key the host presents now, so that the stored remote refuses any other key later on
+	if additionalProperties["hostKey"] == hostKeyFirstUse {
+		if result["hostKey"], err = scanHostKey(result); err != nil {
+			return nil, err
+		}
+	}
 
 	return result, nil
 }
@@ -103,12 +290,36 @@ func getPort(port interface{}) (int, error) {
 	return portval, nil
 }
 
+/*
+ * Returns the host:port address to dial for the given remote, defaulting to port 22. IPv6 literals are enclosed in
+ * brackets.
+ */
+func getAddress(properties map[string]interface{}) (string, error) {
+	address, ok := properties["address"].(string)
+	if !ok || address == "" {
+		return "", errors.New("missing remote address")
+	}
+	port := 22
+	if p, ok := properties["port"]; ok {
+		var err error
+		port, err = getPort(p)
+		if err != nil {
+			return "", err
+		}
+	}
+	return net.JoinHostPort(address, strconv.Itoa(port)), nil
+}
+
 func (s sshRemote) ToURL(properties map[string]interface{}) (string, map[string]string, error) {
 	u := fmt.Sprintf("ssh://%s", properties["username"])
 	if properties["password"] != nil {
 		u += ":*****"
 	}
-	u += fmt.Sprintf("@%s", properties["address"])
+	if address, ok := properties["address"].(string); ok && strings.Contains(address, ":") {
+		u += fmt.Sprintf("@[%s]", address)
+	} else {
+		u += fmt.Sprintf("@%s", properties["address"])
+	}
 	if port, ok := properties["port"]; ok {
 		portval, err := getPort(port)
 		if err != nil {
@@ -125,6 +336,43 @@ func (s sshRemote) ToURL(properties map[string]interface{}) (string, map[string]
 	if properties["keyFile"] != nil {
 		retProps["keyFile"] = properties["keyFile"].(string)
 	}
+	if properties["knownHostsFile"] != nil {
+		retProps["knownHostsFile"] = properties["knownHostsFile"].(string)
+	}
+	if properties["hostKey"] != nil {
+		retProps["hostKey"] = properties["hostKey"].(string)
+	}
+	if useAgent(properties) {
+		retProps["agent"] = "true"
+	}
+	if properties["proxyJump"] != nil {
+		retProps["proxyJump"] = properties["proxyJump"].(string)
+	}
+	if properties["transport"] != nil {
+		retProps["transport"] = properties["transport"].(string)
+	}
+	if properties["transferMode"] != nil {
+		retProps["transferMode"] = properties["transferMode"].(string)
+	}
+	if properties["layout"] != nil {
+		retProps["layout"] = properties["layout"].(string)
+	}
+	if properties["encryption"] != nil {
+		retProps["encryption"] = properties["encryption"].(string)
+	}
+	if properties["cleartextFields"] != nil {
+		retProps["cleartextFields"] = properties["cleartextFields"].(string)
+	}
+	if properties["compression"] != nil {
+		retProps["compression"] = properties["compression"].(string)
+	}
+	if properties["maxSessions"] != nil {
+		maxSessions, err := getMaxSessions(properties)
+		if err != nil {
+			return "", nil, err
+		}
+		retProps["maxSessions"] = strconv.Itoa(maxSessions)
+	}
 
 	return u, retProps, nil
 }
@@ -132,6 +380,28 @@ func (s sshRemote) ToURL(properties map[string]interface{}) (string, map[string]
 var readPassword = terminal.ReadPassword
 var fmtPrintf = fmt.Printf
 
+/*
+ * If the given private key is passphrase protected, prompt for the passphrase and verify that it decrypts the key.
+ * Returns an empty string for keys that are not encrypted.
+ */
+func getPassphrase(keyFile string, key []byte) (string, error) {
+	_, err := ssh.ParsePrivateKey(key)
+	var missing *ssh.PassphraseMissingError
+	if !errors.As(err, &missing) {
+		return "", nil
+	}
+
+	fmtPrintf("passphrase for %s: ", keyFile)
+	passphrase, err := readPassword(0)
+	if err != nil {
+		return "", fmt.Errorf("failed to read passphrase: %w", err)
+	}
+	if _, err := ssh.ParsePrivateKeyWithPassphrase(key, passphrase); err != nil {
+		return "", fmt.Errorf("failed to decrypt key file %s: %w", keyFile, err)
+	}
+	return string(passphrase), nil
+}
+
 func (s sshRemote) GetParameters(remoteProperties map[string]interface{}) (map[string]interface{}, error) {
 	result := map[string]interface{}{}
 
@@ -141,9 +411,17 @@ func (s sshRemote) GetParameters(remoteProperties map[string]interface{}) (map[s
 			return nil, fmt.Errorf("failed to read key file %s: %w", remoteProperties["keyFile"], err)
 		}
 		result["key"] = string(content)
+
+		passphrase, err := getPassphrase(remoteProperties["keyFile"].(string), content)
+		if err != nil {
+			return nil, err
+		}
+		if passphrase != "" {
+			result["passphrase"] = passphrase
+		}
 	}
 
-	if remoteProperties["password"] == nil && remoteProperties["keyFile"] == nil {
+	if remoteProperties["password"] == nil && remoteProperties["keyFile"] == nil && !useAgent(remoteProperties) {
 		fmtPrintf("password: ")
 		pw, err := readPassword(0)
 		if err != nil {
@@ -156,10 +434,84 @@ func (s sshRemote) GetParameters(remoteProperties map[string]interface{}) (map[s
 }
 
 func (s sshRemote) ValidateRemote(properties map[string]interface{}) error {
-	err := remote.ValidateFields(properties, []string{"username", "address", "path"}, []string{"password", "port", "keyFile"})
+	err := remote.ValidateFields(properties, []string{"username", "address", "path"}, []string{"password", "port", "keyFile",
+		"knownHostsFile", "hostKey", "agent", "proxyJump", "transport", "maxSessions",
+		"transferMode", "layout", "encryption", "cleartextFields",
+		"compression", "sshCompression"})
 	if err != nil {
 		return err
 	}
+	if a, ok := properties["agent"]; ok {
+		if _, ok := a.(bool); !ok {
+			return errors.New("invalid agent property, must be a boolean")
+		}
+	}
+	if hostKey, ok := properties["hostKey"]; ok {
+		if s, ok := hostKey.(string); !ok {
+			return errors.New("invalid host key")
+		} else if err := validateHostKey(s); err != nil {
+			return err
+		}
+	}
+	if proxyJump, ok := properties["proxyJump"]; ok {
+		if s, ok := proxyJump.(string); !ok {
+			return errors.New("invalid proxy jump")
+		} else if _, err := parseProxyJump(s, ""); err != nil {
+			return err
+		}
+	}
+	if transport, ok := properties["transport"]; ok {
+		if s, ok := transport.(string); !ok {
+			return errors.New("invalid transport")
+		} else if err := validateTransport(s); err != nil {
+			return err
+		}
+	}
+	if mode, ok := properties["transferMode"]; ok {
+		if s, ok := mode.(string); !ok {
+			return errors.New("invalid transfer mode")
+		} else if err := validateTransferMode(s, getTransport(properties)); err != nil {
+			return err
+		}
+	}
+	if layout, ok := properties["layout"]; ok {
+		if s, ok := layout.(string); !ok {
+			return errors.New("invalid layout")
+		} else if err := validateLayout(s, getTransferMode(properties)); err != nil {
+			return err
+		}
+	}
+	if encryption, ok := properties["encryption"]; ok {
+		if s, ok := encryption.(string); !ok {
+			return errors.New("invalid encryption")
+		} else if err := validateEncryption(s, getLayout(properties)); err != nil {
+			return err
+		}
+	}
+	if fields, ok := properties["cleartextFields"]; ok {
+		if s, ok := fields.(string); !ok {
+			return errors.New("invalid cleartext fields")
+		} else if err := validateCleartextFields(s); err != nil {
+			return err
+		}
+	}
+	if compression, ok := properties["compression"]; ok {
+		if s, ok := compression.(string); !ok {
+			return errors.New("invalid compression")
+		} else if err := validateCompression(s, getLayout(properties)); err != nil {
+			return err
+		}
+	}
+	if c, ok := properties["sshCompression"]; ok {
+		if b, ok := c.(bool); !ok {
+			return errors.New("invalid sshCompression property, must be a boolean")
+		} else if err := validateSSHCompression(b); err != nil {
+			return err
+		}
+	}
+	if _, err := getMaxSessions(properties); err != nil {
+		return err
+	}
 	if port, ok := properties["port"]; ok {
 		_, err := getPort(port)
 		return err
@@ -168,7 +520,8 @@ func (s sshRemote) ValidateRemote(properties map[string]interface{}) error {
 }
 
 func (s sshRemote) ValidateParameters(parameters map[string]interface{}) error {
-	return remote.ValidateFields(parameters, []string{}, []string{"password", "key"})
+	return remote.ValidateFields(parameters, []string{}, []string{"password", "key", "passphrase",
+		"encryptionPassphrase"})
 }
 
 /*
@@ -197,27 +550,78 @@ func getAuth(properties map[string]interface{}, parameters map[string]interface{
 
 var dial = ssh.Dial
 
-func getConnection(properties map[string]interface{}, parameters map[string]interface{}) (*ssh.Client, error) {
+/*
+ * Parse a private key, decrypting it with the passphrase parameter if one was supplied.
+ */
+func parsePrivateKey(key string, passphrase interface{}) (ssh.Signer, error) {
+	if passphrase != nil {
+		return ssh.ParsePrivateKeyWithPassphrase([]byte(key), []byte(passphrase.(string)))
+	}
+	signer, err := ssh.ParsePrivateKey([]byte(key))
+	var missing *ssh.PassphraseMissingError
+	if errors.As(err, &missing) {
+		return nil, errors.New("private key is passphrase protected, but no passphrase was specified")
+	}
+	return signer, err
+}
+
+/*
+ * Returns the authentication methods for the remote. This uses ssh-agent if the remote is configured for it and no
+ * password or key was supplied in the parameters, otherwise the password or key from getAuth(). The returned
+ * function must be called to release any resources once authentication has completed.
+ */
+func getAuthMethods(properties map[string]interface{}, parameters map[string]interface{}) ([]ssh.AuthMethod, func(), error) {
+	if useAgent(properties) && parameters["password"] == nil && parameters["key"] == nil {
+		auth, closer, err := getAgentAuth()
+		if err != nil {
+			return nil, nil, err
+		}
+		return []ssh.AuthMethod{auth}, func() { closer.Close() }, nil
+	}
+
 	password, key, err := getAuth(properties, parameters)
+	if err != nil {
+		return nil, nil, err
+	}
+	if key != "" {
+		parsed, err := parsePrivateKey(key, parameters["passphrase"])
+		if err != nil {
+			return nil, nil, err
+		}
+		return []ssh.AuthMethod{ssh.PublicKeys(parsed)}, func() {}, nil
+	}
+	return []ssh.AuthMethod{ssh.Password(password)}, func() {}, nil
+}
+
+func getConnection(properties map[string]interface{}, parameters map[string]interface{}) (*ssh.Client, error) {
+	auth, release, err := getAuthMethods(properties, parameters)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	address, err := getAddress(properties)
+	if err != nil {
+		return nil, err
+	}
+	hostKeyCallback, err := getHostKeyCallback(properties)
 	if err != nil {
 		return nil, err
 	}
 	config := &ssh.ClientConfig{
 		User:            properties["username"].(string),
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Auth:            auth,
+		HostKeyCallback: hostKeyCallback,
 	}
 
-	if key != "" {
-		parsed, err := ssh.ParsePrivateKey([]byte(key))
+	if proxyJump, ok := properties["proxyJump"].(string); ok && proxyJump != "" {
+		hosts, err := parseProxyJump(proxyJump, config.User)
 		if err != nil {
 			return nil, err
 		}
-		config.Auth = []ssh.AuthMethod{ssh.PublicKeys(parsed)}
-	} else {
-		config.Auth = []ssh.AuthMethod{ssh.Password(password)}
+		return dialJumpHosts(hosts, properties, parameters, address, config)
 	}
 
-	return dial("tcp", properties["address"].(string), config)
+	return dial("tcp", address, config)
 }
 
 func runCommand(conn *ssh.Client, command string) ([]byte, error) {
@@ -236,14 +640,101 @@ func runCommand(conn *ssh.Client, command string) ([]byte, error) {
 
 var run = runCommand
 
-func readCommit(conn *ssh.Client, properties map[string]interface{}, commitId string) (*remote.Commit, error) {
-	output, err := run(conn, fmt.Sprintf("cat \"%s/%s/metadata.json\"", properties["path"], commitId))
+func runCommandInput(conn *ssh.Client, command string, input io.Reader) ([]byte, error) {
+	sess, err := conn.NewSession()
 	if err != nil {
 		return nil, err
 	}
+	defer sess.Close()
+
+	sess.Stdin = input
+	output, err := sess.CombinedOutput(command)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute '%s': %w\n%s", command, err, string(output))
+	}
+	return output, nil
+}
+
+var runInput = runCommandInput
+
+/*
+ * Output of a command that is read as it is produced. Closing the stream waits for the command to exit and reports
+ * its failure, or aborts the command if its output was not read to the end.
+ */
+type commandStream struct {
+	stdout  io.Reader
+	stderr  bytes.Buffer
+	sess    *ssh.Session
+	command string
+	eof     bool
+}
+
+func (c *commandStream) Read(p []byte) (int, error) {
+	n, err := c.stdout.Read(p)
+	if err == io.EOF {
+		c.eof = true
+	}
+	return n, err
+}
+
+func (c *commandStream) Close() error {
+	defer c.sess.Close()
+	if !c.eof {
+		return fmt.Errorf("aborted '%s' before reading all of its output", c.command)
+	}
+	if err := c.sess.Wait(); err != nil {
+		return fmt.Errorf("failed to execute '%s': %w\n%s", c.command, err, c.stderr.String())
+	}
+	return nil
+}
 
+func streamCommand(conn *ssh.Client, command string, input io.Reader) (io.ReadCloser, error) {
+	sess, err := conn.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	stream := &commandStream{sess: sess, command: command}
+	sess.Stdin = input
+	sess.Stderr = &stream.stderr
+	stream.stdout, err = sess.StdoutPipe()
+	if err == nil {
+		err = sess.Start(command)
+	}
+	if err != nil {
+		sess.Close()
+		return nil, fmt.Errorf("failed to execute '%s': %w", command, err)
+	}
+	return stream, nil
+}
+
+var stream = streamCommand
+
+/*
+ * Read a commit, decrypting its metadata if it is encrypted and the keyring has a passphrase.
+ */
+func readCommit(store remoteStore, properties map[string]interface{}, keys *keyring,
+	commitId string) (*remote.Commit, error) {
+	if err := validateCommitId(commitId); err != nil {
+		return nil, err
+	}
+	output, err := store.readFile(fmt.Sprintf("%s/%s/metadata.json", properties["path"], commitId))
+	if err != nil {
+		return nil, err
+	}
+
+	commit, err := parseCommit(commitId, output)
+	if err != nil {
+		return nil, err
+	}
+	if err := openMetadata(keys, commit); err != nil {
+		return nil, err
+	}
+	return commit, nil
+}
+
+func parseCommit(commitId string, metadata []byte) (*remote.Commit, error) {
 	commit := map[string]interface{}{}
-	err = json.Unmarshal(output, &commit)
+	err := json.Unmarshal(metadata, &commit)
 	if err != nil {
 		return nil, err
 	}
@@ -252,23 +743,40 @@ func readCommit(conn *ssh.Client, properties map[string]interface{}, commitId st
 }
 
 func (s sshRemote) ListCommits(properties map[string]interface{}, parameters map[string]interface{}, tags []remote.Tag) ([]remote.Commit, error) {
-	conn, err := getConnection(properties, parameters)
+	store, release, err := connectStore(properties, parameters)
 	if err != nil {
 		return nil, err
 	}
-	defer conn.Close()
+	defer release()
 
-	output, err := run(conn, fmt.Sprintf("ls -1 \"%s\"", properties["path"]))
+	return listCommits(store, properties, newKeyring(store, properties, parameters), tags)
+}
+
+/*
+ * List the commits in the repository that match the given tags, most recent first. Encrypted metadata is decrypted
+ * if the keyring has a passphrase, and otherwise only its cleartext fields are matched and returned, without being
+ * checked against the sealed data.
+ */
+func listCommits(store remoteStore, properties map[string]interface{}, keys *keyring,
+	tags []remote.Tag) ([]remote.Commit, error) {
+	metadata, err := store.listMetadata(properties["path"].(string))
 	if err != nil {
 		return nil, err
 	}
 
 	var ret []remote.Commit
-	scanner := bufio.NewScanner(strings.NewReader(string(output)))
-	for scanner.Scan() {
-		commitId := strings.TrimSpace(scanner.Text())
-		commit, err := readCommit(conn, properties, commitId)
-		if err == nil && remote.MatchTags(commit.Properties, tags) {
+	for _, m := range metadata {
+		if validateCommitId(m.id) != nil {
+			continue
+		}
+		commit, err := parseCommit(m.id, m.content)
+		if err != nil {
+			continue
+		}
+		if err := openMetadata(keys, commit); err != nil {
+			return nil, err
+		}
+		if remote.MatchTags(commit.Properties, tags) {
 			ret = append(ret, remote.Commit{Id: commit.Id, Properties: commit.Properties})
 		}
 	}
@@ -279,13 +787,13 @@ func (s sshRemote) ListCommits(properties map[string]interface{}, parameters map
 }
 
 func (s sshRemote) GetCommit(properties map[string]interface{}, parameters map[string]interface{}, commitId string) (*remote.Commit, error) {
-	conn, err := getConnection(properties, parameters)
+	store, release, err := connectStore(properties, parameters)
 	if err != nil {
 		return nil, err
 	}
-	defer conn.Close()
+	defer release()
 
-	return readCommit(conn, properties, commitId)
+	return readCommit(store, properties, newKeyring(store, properties, parameters), commitId)
 }
 
 func init() {
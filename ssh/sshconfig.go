@@ -0,0 +1,367 @@
+/*
+ * Copyright The Titan Project Contributors.
+ */
+package ssh
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+/*
+ * The subset of OpenSSH client configuration that applies to titan remotes, resolved for a single host alias.
+ */
+type sshHostConfig struct {
+	hostName           string
+	user               string
+	port               int
+	identityFile       string
+	proxyJump          string
+	userKnownHostsFile string
+}
+
+/*
+ * Evaluates ~/.ssh/config for a host alias. As with OpenSSH, the first value obtained for each option wins, and
+ * Include directives are processed in place with the enclosing Host / Match state restored afterwards.
+ */
+type sshConfigResolver struct {
+	home   string
+	alias  string
+	user   string
+	config sshHostConfig
+	seen   map[string]bool
+}
+
+const maxIncludeDepth = 16
+
+/*
+ * Resolve the OpenSSH configuration for the given host alias from ~/.ssh/config. The user, if known, is used when
+ * evaluating 'Match user' criteria. A missing configuration file is not an error.
+ */
+func lookupSSHConfig(alias string, user string) (sshHostConfig, error) {
+	home, err := userHomeDir()
+	if err != nil {
+		return sshHostConfig{}, nil
+	}
+	r := &sshConfigResolver{home: home, alias: alias, user: user, seen: map[string]bool{}}
+	err = r.readFile(filepath.Join(home, ".ssh", "config"), 0, true)
+	if err != nil && !os.IsNotExist(err) {
+		return sshHostConfig{}, err
+	}
+	return r.config, nil
+}
+
+func (r *sshConfigResolver) readFile(file string, depth int, active bool) error {
+	if depth > maxIncludeDepth {
+		return fmt.Errorf("ssh config: too many nested includes at %s", file)
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		keyword, args, err := parseConfigLine(scanner.Text())
+		if err != nil {
+			return fmt.Errorf("ssh config: %s:%d: %w", file, lineNum, err)
+		}
+		if keyword == "" {
+			continue
+		}
+
+		switch keyword {
+		case "host":
+			active = matchPatternList(args, r.alias)
+		case "match":
+			active, err = r.match(args)
+			if err != nil {
+				return fmt.Errorf("ssh config: %s:%d: %w", file, lineNum, err)
+			}
+		case "include":
+			if !active {
+				continue
+			}
+			for _, pattern := range args {
+				if err := r.include(pattern, depth); err != nil {
+					return fmt.Errorf("ssh config: %s:%d: %w", file, lineNum, err)
+				}
+			}
+		default:
+			if active {
+				if err := r.set(keyword, args); err != nil {
+					return fmt.Errorf("ssh config: %s:%d: %w", file, lineNum, err)
+				}
+			}
+		}
+	}
+	return scanner.Err()
+}
+
+func (r *sshConfigResolver) include(pattern string, depth int) error {
+	pattern = r.expandPath(pattern)
+	if !filepath.IsAbs(pattern) {
+		pattern = filepath.Join(r.home, ".ssh", pattern)
+	}
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return err
+	}
+	sort.Strings(matches)
+	for _, m := range matches {
+		// Included files are evaluated with the enclosing block active, and the state is restored afterwards
+		if err := r.readFile(m, depth+1, true); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+ * Evaluate the criteria of a Match line. Supported criteria are 'all', 'host', 'originalhost' and 'user', each of
+ * which may be negated with '!'. Criteria that cannot be evaluated here, such as 'exec', never match.
+ */
+func (r *sshConfigResolver) match(args []string) (bool, error) {
+	if len(args) == 0 {
+		return false, errors.New("missing Match criteria")
+	}
+	result := true
+	for i := 0; i < len(args); i++ {
+		criterion := strings.ToLower(args[i])
+		negate := strings.HasPrefix(criterion, "!")
+		criterion = strings.TrimPrefix(criterion, "!")
+
+		var matched bool
+		switch criterion {
+		case "all":
+			matched = true
+		case "canonical", "final":
+			matched = !negate
+		case "host", "originalhost", "user", "localuser", "localnetwork", "exec", "tagged":
+			if i+1 >= len(args) {
+				return false, fmt.Errorf("missing argument for Match %s", criterion)
+			}
+			i++
+			patterns := strings.Split(args[i], ",")
+			switch criterion {
+			case "host":
+				matched = matchPatternList(patterns, r.hostName())
+			case "originalhost":
+				matched = matchPatternList(patterns, r.alias)
+			case "user":
+				matched = r.currentUser() != "" && matchPatternList(patterns, r.currentUser())
+			default:
+				matched = negate
+			}
+		default:
+			return false, fmt.Errorf("unsupported Match criteria '%s'", args[i])
+		}
+		if negate {
+			matched = !matched
+		}
+		result = result && matched
+	}
+	return result, nil
+}
+
+func (r *sshConfigResolver) hostName() string {
+	if r.config.hostName != "" {
+		return r.config.hostName
+	}
+	return r.alias
+}
+
+func (r *sshConfigResolver) currentUser() string {
+	if r.user != "" {
+		return r.user
+	}
+	return r.config.user
+}
+
+func (r *sshConfigResolver) set(keyword string, args []string) error {
+	if r.seen[keyword] {
+		return nil
+	}
+	if len(args) == 0 {
+		return fmt.Errorf("missing argument for %s", keyword)
+	}
+
+	switch keyword {
+	case "hostname":
+		r.config.hostName = strings.Replace(strings.Replace(args[0], "%h", r.alias, -1), "%%", "%", -1)
+	case "user":
+		r.config.user = args[0]
+	case "port":
+		port, err := strconv.Atoi(args[0])
+		if err != nil || port <= 0 || port > 65535 {
+			return fmt.Errorf("invalid port '%s'", args[0])
+		}
+		r.config.port = port
+	case "identityfile":
+		r.config.identityFile = r.expandPath(args[0])
+	case "proxyjump":
+		if strings.ToLower(args[0]) != "none" {
+			r.config.proxyJump = args[0]
+		}
+	case "userknownhostsfile":
+		if strings.ToLower(args[0]) != "none" {
+			r.config.userKnownHostsFile = r.expandPath(args[0])
+		}
+	default:
+		return nil
+	}
+	r.seen[keyword] = true
+	return nil
+}
+
+/*
+ * Expand a leading '~' and the %d (home), %h (host), %r (user) and %% tokens in a path.
+ */
+func (r *sshConfigResolver) expandPath(p string) string {
+	if p == "~" || strings.HasPrefix(p, "~/") {
+		p = r.home + p[1:]
+	}
+	var b strings.Builder
+	for i := 0; i < len(p); i++ {
+		if p[i] != '%' || i+1 == len(p) {
+			b.WriteByte(p[i])
+			continue
+		}
+		i++
+		switch p[i] {
+		case 'd':
+			b.WriteString(r.home)
+		case 'h':
+			b.WriteString(r.hostName())
+		case 'r':
+			b.WriteString(r.currentUser())
+		case '%':
+			b.WriteByte('%')
+		default:
+			b.WriteByte('%')
+			b.WriteByte(p[i])
+		}
+	}
+	return b.String()
+}
+
+/*
+ * Split a configuration line into a lowercase keyword and its arguments. Both "Keyword value" and "Keyword=value"
+ * forms are accepted, and arguments may be enclosed in double quotes. Returns an empty keyword for blank lines and
+ * comments.
+ */
+func parseConfigLine(line string) (string, []string, error) {
+	line = strings.TrimSpace(line)
+	if line == "" || line[0] == '#' {
+		return "", nil, nil
+	}
+
+	end := strings.IndexFunc(line, func(r rune) bool { return unicode.IsSpace(r) || r == '=' })
+	if end == -1 {
+		return strings.ToLower(line), nil, nil
+	}
+	keyword := strings.ToLower(line[:end])
+	rest := strings.TrimLeftFunc(line[end:], unicode.IsSpace)
+	if strings.HasPrefix(rest, "=") {
+		rest = rest[1:]
+	}
+
+	var args []string
+	for {
+		rest = strings.TrimLeftFunc(rest, unicode.IsSpace)
+		if rest == "" || rest[0] == '#' {
+			break
+		}
+		if rest[0] == '"' {
+			closing := strings.IndexByte(rest[1:], '"')
+			if closing == -1 {
+				return "", nil, errors.New("unterminated quoted string")
+			}
+			args = append(args, rest[1:closing+1])
+			rest = rest[closing+2:]
+			continue
+		}
+		next := strings.IndexFunc(rest, unicode.IsSpace)
+		if next == -1 {
+			next = len(rest)
+		}
+		args = append(args, rest[:next])
+		rest = rest[next:]
+	}
+	return keyword, args, nil
+}
+
+/*
+ * Match a host against a list of patterns, as used by Host and Match lines. The list matches if any pattern matches
+ * and no negated ('!') pattern matches. Patterns support the '*' and '?' wildcards and are case-insensitive.
+ */
+func matchPatternList(patterns []string, host string) bool {
+	host = strings.ToLower(host)
+	matched := false
+	for _, p := range patterns {
+		p = strings.ToLower(p)
+		if strings.HasPrefix(p, "!") {
+			if ok, _ := path.Match(p[1:], host); ok {
+				return false
+			}
+		} else if ok, _ := path.Match(p, host); ok {
+			matched = true
+		}
+	}
+	return matched
+}
+
+/*
+ * Resolve each hop of a ProxyJump specification through the ssh config, so that aliases like 'bastion' are stored
+ * as explicit user@host:port entries usable without access to the config file.
+ */
+func resolveProxyJump(spec string) (string, error) {
+	var hops []string
+	for _, hop := range strings.Split(spec, ",") {
+		parsed, err := parseProxyJump(hop, "")
+		if err != nil {
+			return "", err
+		}
+		host := parsed[0]
+		explicitUser := strings.Contains(hop, "@")
+		explicitPort := strings.HasSuffix(hop, fmt.Sprintf(":%d", host.port))
+
+		config, err := lookupSSHConfig(host.address, host.username)
+		if err != nil {
+			return "", err
+		}
+		if config.hostName != "" {
+			host.address = config.hostName
+		}
+		if !explicitUser && config.user != "" {
+			host.username = config.user
+		}
+		if !explicitPort && config.port != 0 {
+			host.port = config.port
+		}
+
+		resolved := host.address
+		if strings.Contains(resolved, ":") {
+			resolved = "[" + resolved + "]"
+		}
+		if host.username != "" {
+			resolved = host.username + "@" + resolved
+		}
+		if host.port != 22 {
+			resolved += fmt.Sprintf(":%d", host.port)
+		}
+		hops = append(hops, resolved)
+	}
+	return strings.Join(hops, ","), nil
+}
@@ -0,0 +1,1117 @@
+/*
+ * Copyright The Titan Project Contributors.
+ */
+package ssh
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+ * Access to files within the remote repository. This is implemented both by running shell commands and over SFTP,
+ * so that the provider works with restricted or non-POSIX login shells as well as sftp-only accounts.
+ */
+type remoteStore interface {
+	/*
+	 * List the names of the entries within a directory, excluding hidden entries.
+	 */
+	listDir(path string) ([]string, error)
+
+	/*
+	 * Read the full contents of a file. If the file does not exist, the error wraps os.ErrNotExist.
+	 */
+	readFile(path string) ([]byte, error)
+
+	/*
+	 * Read the metadata.json of every commit within the repository. Commits without readable metadata are omitted.
+	 */
+	listMetadata(path string) ([]commitMetadata, error)
+
+	/*
+	 * Returns the size of a file.
+	 */
+	fileSize(path string) (int64, error)
+
+	/*
+	 * Compute the SHA-256 of length bytes of a file, starting at offset.
+	 */
+	hashRange(path string, offset int64, length int64) (string, error)
+
+	/*
+	 * Walk the tree below a directory, calling fn for each entry with the contents of regular files. Entries are
+	 * visited parents first, and names are slash-separated paths relative to the root. When resuming, files already
+	 * done are not visited, and the contents of the partial file start at its offset.
+	 */
+	readTree(root string, resume *treeResume, fn func(entry treeEntry, r io.Reader) error) error
+
+	/*
+	 * List the entries below a directory, including hidden ones, down to the given depth. Names are slash-separated
+	 * paths relative to the directory, and symbolic links are not followed. Returns nothing if the directory does not
+	 * exist.
+	 */
+	listFiles(root string, depth int) ([]treeEntry, error)
+
+	/*
+	 * Compute the SHA-256 of every regular file below a directory, keyed by slash-separated path relative to it.
+	 */
+	hashFiles(root string) (map[string]string, error)
+
+	/*
+	 * Compute the SHA-256 of the given regular files below a directory, keyed by their slash-separated paths relative
+	 * to it. Files that don't exist are omitted. The names must not contain whitespace, as is the case for objects.
+	 */
+	hashFileList(root string, names []string) (map[string]string, error)
+
+	/*
+	 * Create a single directory, failing if it already exists.
+	 */
+	mkdir(path string) error
+
+	/*
+	 * Create a directory along with any missing parents.
+	 */
+	mkdirAll(path string) error
+
+	/*
+	 * Create or replace a file with the given contents and permissions.
+	 */
+	writeFile(path string, r io.Reader, mode os.FileMode) error
+
+	/*
+	 * Write the contents of a file starting at offset, keeping what precedes it and discarding anything beyond.
+	 */
+	resumeFile(path string, r io.Reader, offset int64, mode os.FileMode) error
+
+	/*
+	 * Create or replace a file by applying a delta, as written by writeDelta(), to a basis file with the given block
+	 * size. Returns errNoDelta if the store cannot apply deltas.
+	 */
+	patchFile(basis string, path string, delta io.Reader, blockSize int, mode os.FileMode) error
+
+	/*
+	 * Create a symbolic link at path pointing to target.
+	 */
+	symlink(target string, path string) error
+
+	/*
+	 * Atomically rename a file, replacing any existing file at the destination.
+	 */
+	rename(from string, to string) error
+
+	/*
+	 * Remove a file or empty directory.
+	 */
+	remove(path string) error
+
+	/*
+	 * Remove a directory and everything below it, attempting every entry even if some cannot be removed.
+	 */
+	removeAll(path string) error
+
+	close() error
+}
+
+/*
+ * The raw metadata.json contents of a commit.
+ */
+type commitMetadata struct {
+	id      string
+	content []byte
+}
+
+/*
+ * An entry within a tree read by remoteStore.readTree(). The link is only set for symbolic links, and the offset
+ * only for a resumed file, whose contents start at that offset.
+ */
+type treeEntry struct {
+	name    string
+	mode    os.FileMode
+	size    int64
+	modTime time.Time
+	link    string
+	offset  int64
+}
+
+/*
+ * Files to skip or resume when reading a tree. The partial entry is the file to resume, with its offset set.
+ */
+type treeResume struct {
+	done    map[string]bool
+	partial *treeEntry
+}
+
+/*
+ * Store that runs POSIX shell commands in a session per operation. With gzip compression, file data is compressed
+ * while it is sent, and decompressed on the other end.
+ */
+type shellStore struct {
+	conn        *ssh.Client
+	maxSessions int
+	compression string
+	headOnce    sync.Once
+	gnuHead     bool
+}
+
+func (s *shellStore) listDir(path string) ([]string, error) {
+	output, err := run(s.conn, shellCommand("ls -1 --", path))
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	scanner := bufio.NewScanner(strings.NewReader(string(output)))
+	for scanner.Scan() {
+		if name := strings.TrimSpace(scanner.Text()); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+func (s *shellStore) readFile(path string) ([]byte, error) {
+	output, err := run(s.conn, shellCommand("cat --", path))
+	if err != nil {
+		// Tell a missing file from other failures, which the exit status of cat doesn't
+		if _, missingErr := run(s.conn, shellCommand("[ ! -e", path, "]")); missingErr == nil {
+			return nil, fmt.Errorf("failed to read %s: %w", path, os.ErrNotExist)
+		}
+		return nil, err
+	}
+	return output, nil
+}
+
+/*
+ * Read all commit metadata in a single remote invocation. Each metadata file is written out preceded by a header
+ * line of the form "<boundary> <commitId>", and the listing ends with "<boundary>--". The boundary is random, so it
+ * cannot collide with file contents, and a missing end marker indicates truncated output. If the server cannot run
+ * the script, the directory is listed and each file read in its own session instead.
+ */
+func (s *shellStore) listMetadata(path string) ([]commitMetadata, error) {
+	metadata, err := listFramedMetadata(s.conn, path)
+	if err == nil {
+		return metadata, nil
+	}
+	entries, listErr := s.listDir(path)
+	if listErr != nil {
+		return nil, err
+	}
+	return fetchMetadata(validCommitIds(entries), s.maxSessions, func(id string) ([]byte, error) {
+		return s.readFile(fmt.Sprintf("%s/%s/metadata.json", path, id))
+	}), nil
+}
+
+/*
+ * Read every metadata.json in the repository with a single shell command, framed by a random boundary.
+ */
+func listFramedMetadata(conn *ssh.Client, path string) ([]commitMetadata, error) {
+	boundary := newBoundary()
+	script := shellCommand("cd --", path) + " || exit 1\n" +
+		"exec 2>/dev/null\n" +
+		"for d in *; do\n" +
+		"  [ -f \"$d/metadata.json\" ] || continue\n" +
+		"  printf '%s %s\\n' " + shellQuote(boundary) + " \"$d\"\n" +
+		"  cat -- \"$d/metadata.json\"\n" +
+		"  printf '\\n'\n" +
+		"done\n" +
+		"printf '%s--\\n' " + shellQuote(boundary) + "\n"
+	output, err := run(conn, script)
+	if err != nil {
+		return nil, err
+	}
+	return parseFramedMetadata(output, boundary)
+}
+
+/*
+ * Stream the tree as a tar archive. Sparse files are detected by tar (-S), so holes are not sent over the wire. When
+ * resuming, files that are done and the partial file are excluded from the archive, and the rest of the partial file
+ * is then streamed on its own. Excluding a list of exact names needs GNU tar, so resuming fails up front on hosts with
+ * another tar, rather than sending everything again.
+ */
+func (s *shellStore) readTree(root string, resume *treeResume, fn func(entry treeEntry, r io.Reader) error) error {
+	flags := "-cSf"
+	if s.compression == compressionGzip {
+		flags = "-czSf"
+	}
+	command := shellCommand("tar "+flags+" - -C", root, ".")
+	var excludes bytes.Buffer
+	if resume != nil {
+		if err := s.requireGNUTar(); err != nil {
+			return err
+		}
+		command = shellCommand("tar "+flags+" - --anchored --no-wildcards --exclude-from=- -C", root, ".")
+		for name := range resume.done {
+			excludes.WriteString("./" + name + "\n")
+		}
+		if resume.partial != nil {
+			excludes.WriteString("./" + resume.partial.name + "\n")
+		}
+	}
+
+	output, err := stream(s.conn, command, &excludes)
+	if err != nil {
+		return err
+	}
+	if err := s.readArchive(output, fn); err != nil {
+		output.Close()
+		return err
+	}
+	if err := output.Close(); err != nil {
+		return err
+	}
+
+	if resume != nil && resume.partial != nil {
+		output, err := stream(s.conn, shellCommand("tail -c", fmt.Sprintf("+%d", resume.partial.offset+1), "--",
+			root+"/"+resume.partial.name), nil)
+		if err != nil {
+			return err
+		}
+		if err := fn(*resume.partial, output); err != nil {
+			output.Close()
+			return err
+		}
+		return output.Close()
+	}
+	return nil
+}
+
+/*
+ * Fail unless the tar on the remote host is GNU tar.
+ */
+func (s *shellStore) requireGNUTar() error {
+	output, err := run(s.conn, "tar --version")
+	if err != nil || !bytes.Contains(output, []byte("GNU tar")) {
+		return errors.New("resuming a pull over the shell transport requires GNU tar on the remote host, retry " +
+			"without the resume token or use the sftp transport")
+	}
+	return nil
+}
+
+func (s *shellStore) readArchive(r io.Reader, fn func(entry treeEntry, r io.Reader) error) error {
+	if s.compression != compressionGzip {
+		return readTar(r, fn)
+	}
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return fmt.Errorf("failed to read archive: %w", err)
+	}
+	if err := readTar(gz, fn); err != nil {
+		return err
+	}
+	// Read up to the end of the stream, which checks it against its checksum
+	if _, err := io.Copy(ioutil.Discard, gz); err != nil {
+		return fmt.Errorf("failed to read archive: %w", err)
+	}
+	return nil
+}
+
+func readTar(r io.Reader, fn func(entry treeEntry, r io.Reader) error) error {
+	archive := tar.NewReader(r)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read archive: %w", err)
+		}
+		name := strings.TrimSuffix(strings.TrimPrefix(header.Name, "./"), "/")
+		if name == "." || name == "" {
+			continue
+		}
+		entry := treeEntry{name: name, mode: header.FileInfo().Mode(), size: header.Size, modTime: header.ModTime,
+			link: header.Linkname}
+		switch header.Typeflag {
+		case tar.TypeDir, tar.TypeSymlink:
+			entry.size = 0
+		case tar.TypeReg, tar.TypeGNUSparse:
+		default:
+			return fmt.Errorf("unsupported file type for %s", name)
+		}
+		if err := fn(entry, archive); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *shellStore) fileSize(path string) (int64, error) {
+	output, err := run(s.conn, shellCommand("wc -c <", path))
+	if err != nil {
+		return 0, err
+	}
+	size, err := strconv.ParseInt(strings.TrimSpace(string(output)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size of %s: %w", path, err)
+	}
+	return size, nil
+}
+
+func (s *shellStore) hashRange(path string, offset int64, length int64) (string, error) {
+	return hashRemoteRange(s.conn, path, offset, length)
+}
+
+/*
+ * Hash a range of a remote file on the remote host. A file shorter than the range is hashed as far as it goes, which
+ * never matches the hash of the full range.
+ */
+func hashRemoteRange(conn *ssh.Client, path string, offset int64, length int64) (string, error) {
+	output, err := run(conn, shellCommand("tail -c", fmt.Sprintf("+%d", offset+1), "--", path)+" | "+
+		shellCommand("head -c", strconv.FormatInt(length, 10))+" | sha256sum")
+	if err != nil {
+		return "", err
+	}
+	fields := strings.Fields(string(output))
+	if len(fields) == 0 || len(fields[0]) != 64 {
+		return "", fmt.Errorf("invalid checksum output '%s'", output)
+	}
+	return fields[0], nil
+}
+
+/*
+ * List the entries with GNU find, which prints everything needed about them in one pass. The finds of BSD and busybox
+ * have no -printf, so if the command fails, the entries are listed with ls instead.
+ */
+func (s *shellStore) listFiles(root string, depth int) ([]treeEntry, error) {
+	output, err := run(s.conn, shellCommand("if [ -d", root)+" ]; then "+shellCommand("cd --", root)+" || exit 1; "+
+		fmt.Sprintf("find . -mindepth 1 -maxdepth %d -printf '%%y %%s %%T@ %%P\\0'; fi", depth))
+	if err == nil {
+		return parseFileList(output)
+	}
+	// Only POSIX options: -path limits the depth, ls -q prints each entry on one line and TZ fixes the time zone
+	output, lsErr := run(s.conn, shellCommand("if [ -d", root)+" ]; then "+shellCommand("cd --", root)+" || exit 1; "+
+		shellCommand("TZ=UTC LC_ALL=C find . -path", "./*"+strings.Repeat("/*", depth))+
+		" -prune -o ! -path . -exec ls -ldq {} +; fi")
+	if lsErr != nil {
+		return nil, fmt.Errorf("failed to list %s: %w", root, lsErr)
+	}
+	return parseLongList(output, time.Now())
+}
+
+/*
+ * Parse the output of GNU find -printf '%y %s %T@ %P\0', which separates entries with NUL bytes since names may contain
+ * newlines.
+ */
+func parseFileList(output []byte) ([]treeEntry, error) {
+	var entries []treeEntry
+	for _, record := range strings.Split(string(output), "\x00") {
+		if record == "" {
+			continue
+		}
+		fields := strings.SplitN(record, " ", 4)
+		if len(fields) != 4 {
+			return nil, fmt.Errorf("invalid file list entry '%s'", record)
+		}
+		size, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid file list entry '%s'", record)
+		}
+		seconds, err := strconv.ParseFloat(fields[2], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid file list entry '%s'", record)
+		}
+		entry := treeEntry{name: fields[3], size: size, modTime: time.Unix(0, int64(seconds*1e9))}
+		switch fields[0] {
+		case "f":
+		case "d":
+			entry.mode = os.ModeDir
+		case "l":
+			entry.mode = os.ModeSymlink
+		default:
+			entry.mode = os.ModeIrregular
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+/*
+ * Parse the output of ls -ldq for every entry of a find. The modification times only have a resolution of a minute, or
+ * of a day for entries more than six months old, and are rounded up so that entries never appear older than they are.
+ * Names are lossy, as ls -q prints unprintable characters as '?', but the names that matter to callers never contain
+ * them.
+ */
+func parseLongList(output []byte, now time.Time) ([]treeEntry, error) {
+	var entries []treeEntry
+	for _, line := range strings.Split(string(output), "\n") {
+		if line == "" {
+			continue
+		}
+		// Every name starts with ./ as find printed it, and is preceded by the mode, size and three date fields
+		i := strings.Index(line, " ./")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid file list entry '%s'", line)
+		}
+		fields, name := strings.Fields(line[:i]), line[i+1:]
+		if len(fields) < 5 {
+			return nil, fmt.Errorf("invalid file list entry '%s'", line)
+		}
+		entry := treeEntry{name: strings.TrimPrefix(name, "./")}
+		switch line[0] {
+		case '-':
+		case 'd':
+			entry.mode = os.ModeDir
+		case 'l':
+			entry.mode = os.ModeSymlink
+			if i := strings.Index(entry.name, " -> "); i >= 0 {
+				entry.name = entry.name[:i]
+			}
+		default:
+			entry.mode = os.ModeIrregular
+		}
+		if entry.mode&os.ModeIrregular == 0 {
+			size, err := strconv.ParseInt(fields[len(fields)-4], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid file list entry '%s'", line)
+			}
+			entry.size = size
+		}
+		date := fields[len(fields)-3:]
+		if strings.Contains(date[2], ":") {
+			modTime, err := time.Parse("Jan 2 15:04 2006", strings.Join(date, " ")+fmt.Sprintf(" %d", now.Year()))
+			if err != nil {
+				return nil, fmt.Errorf("invalid file list entry '%s'", line)
+			}
+			// Recent entries are shown without their year, which is the last year if the date is more than a month ahead
+			if modTime.After(now.AddDate(0, 1, 0)) {
+				modTime = modTime.AddDate(-1, 0, 0)
+			}
+			entry.modTime = modTime.Add(time.Minute - time.Nanosecond)
+		} else {
+			modTime, err := time.Parse("Jan 2 2006", strings.Join(date, " "))
+			if err != nil {
+				return nil, fmt.Errorf("invalid file list entry '%s'", line)
+			}
+			entry.modTime = modTime.AddDate(0, 0, 1).Add(-time.Nanosecond)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func (s *shellStore) hashFiles(root string) (map[string]string, error) {
+	return hashRemoteFiles(s.conn, root)
+}
+
+/*
+ * Hash every regular file below a directory on the remote host.
+ */
+func hashRemoteFiles(conn *ssh.Client, root string) (map[string]string, error) {
+	output, err := run(conn, shellCommand("cd --", root)+" || exit 1\n"+
+		"find . -type f -exec sha256sum -- {} +\n")
+	if err != nil {
+		return nil, err
+	}
+	return parseChecksums(output)
+}
+
+func (s *shellStore) hashFileList(root string, names []string) (map[string]string, error) {
+	return hashRemoteFileList(s.conn, root, names)
+}
+
+/*
+ * Hash a list of files on the remote host. The names are sent on standard input, so that there is no limit on how
+ * many there are, and those that don't exist are skipped.
+ */
+func hashRemoteFileList(conn *ssh.Client, root string, names []string) (map[string]string, error) {
+	if len(names) == 0 {
+		return map[string]string{}, nil
+	}
+	output, err := runInput(conn, shellCommand("cd --", root)+" || exit 1\n"+
+		"while read -r f; do [ -f \"$f\" ] && printf '%s\\n' \"$f\"; done | xargs sha256sum --\n",
+		strings.NewReader(strings.Join(names, "\n")+"\n"))
+	if err != nil {
+		return nil, err
+	}
+	return parseChecksums(output)
+}
+
+/*
+ * Parse the output of sha256sum. Lines for names containing a backslash or newline start with a backslash, and have
+ * those characters escaped within the name.
+ */
+func parseChecksums(output []byte) (map[string]string, error) {
+	files := map[string]string{}
+	for _, line := range strings.Split(strings.TrimSuffix(string(output), "\n"), "\n") {
+		if line == "" {
+			continue
+		}
+		escaped := strings.HasPrefix(line, "\\")
+		if escaped {
+			line = line[1:]
+		}
+		if len(line) < 67 || (line[64:66] != "  " && line[64:66] != " *") {
+			return nil, fmt.Errorf("invalid checksum output '%s'", line)
+		}
+		name := line[66:]
+		if escaped {
+			name = strings.NewReplacer("\\\\", "\\", "\\n", "\n", "\\r", "\r").Replace(name)
+		}
+		files[strings.TrimPrefix(name, "./")] = line[:64]
+	}
+	return files, nil
+}
+
+func (s *shellStore) mkdir(path string) error {
+	_, err := run(s.conn, shellCommand("mkdir --", path))
+	return err
+}
+
+func (s *shellStore) mkdirAll(path string) error {
+	_, err := run(s.conn, shellCommand("mkdir -p --", path))
+	return err
+}
+
+func (s *shellStore) writeFile(path string, r io.Reader, mode os.FileMode) error {
+	input, write := s.compress(r)
+	defer input.Close()
+	_, err := runInput(s.conn, shellCommand(write+" >", path)+" && "+
+		shellCommand(fmt.Sprintf("chmod %o --", mode.Perm()), path), input)
+	return err
+}
+
+func (s *shellStore) resumeFile(path string, r io.Reader, offset int64, mode os.FileMode) error {
+	input, write := s.compress(r)
+	defer input.Close()
+	_, err := runInput(s.conn, shellCommand("truncate -s", strconv.FormatInt(offset, 10), "--", path)+" && "+
+		shellCommand(write+" >>", path)+" && "+shellCommand(fmt.Sprintf("chmod %o --", mode.Perm()), path), input)
+	return err
+}
+
+/*
+ * Returns the input to send for file data, along with the command that writes it out on the remote host.
+ */
+func (s *shellStore) compress(r io.Reader) (io.ReadCloser, string) {
+	if s.compression == compressionGzip {
+		return compressStream(r), "gzip -dc"
+	}
+	return ioutil.NopCloser(r), "cat"
+}
+
+/*
+ * Deltas are applied by a script that relies on GNU head, see deltaScript. Other hosts get whole files instead.
+ */
+func (s *shellStore) patchFile(basis string, path string, delta io.Reader, blockSize int, mode os.FileMode) error {
+	s.headOnce.Do(func() {
+		output, err := run(s.conn, "head --version")
+		s.gnuHead = err == nil && bytes.Contains(output, []byte("GNU coreutils"))
+	})
+	if !s.gnuHead {
+		return errNoDelta
+	}
+	_, err := runInput(s.conn, deltaScript(basis, path, blockSize, mode), delta)
+	return err
+}
+
+func (s *shellStore) symlink(target string, path string) error {
+	_, err := run(s.conn, shellCommand("ln -sf --", target, path))
+	return err
+}
+
+func (s *shellStore) rename(from string, to string) error {
+	_, err := run(s.conn, shellCommand("mv -f --", from, to))
+	return err
+}
+
+func (s *shellStore) remove(path string) error {
+	_, err := run(s.conn, shellCommand("if [ -d", path)+" ]; then "+shellCommand("rmdir --", path)+"; else "+
+		shellCommand("rm -f --", path)+"; fi")
+	return err
+}
+
+func (s *shellStore) removeAll(path string) error {
+	_, err := run(s.conn, shellCommand("rm -rf --", path))
+	return err
+}
+
+func (s *shellStore) close() error {
+	return nil
+}
+
+/*
+ * Store that uses the SFTP subsystem, which works even for accounts restricted to internal-sftp. When the transport
+ * is chosen automatically, the connection is kept so that commits can still be listed with a single shell command
+ * where the account allows it.
+ */
+type sftpStore struct {
+	client      *sftp.Client
+	conn        *ssh.Client
+	maxSessions int
+}
+
+func (s *sftpStore) listDir(path string) ([]string, error) {
+	entries, err := s.client.ReadDir(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %s: %w", path, err)
+	}
+	var names []string
+	for _, e := range entries {
+		if !strings.HasPrefix(e.Name(), ".") {
+			names = append(names, e.Name())
+		}
+	}
+	return names, nil
+}
+
+func (s *sftpStore) readFile(path string) ([]byte, error) {
+	f, err := s.client.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	defer f.Close()
+	return ioutil.ReadAll(f)
+}
+
+/*
+ * List metadata with a single shell command if possible, as shellStore does. Otherwise, each metadata.json is read
+ * over SFTP, with up to maxSessions reads in flight at once.
+ */
+func (s *sftpStore) listMetadata(path string) ([]commitMetadata, error) {
+	if s.conn != nil {
+		if metadata, err := listFramedMetadata(s.conn, path); err == nil {
+			return metadata, nil
+		}
+	}
+	entries, err := s.listDir(path)
+	if err != nil {
+		return nil, err
+	}
+	return fetchMetadata(validCommitIds(entries), s.maxSessions, func(id string) ([]byte, error) {
+		return s.readFile(fmt.Sprintf("%s/%s/metadata.json", path, id))
+	}), nil
+}
+
+func (s *sftpStore) readTree(root string, resume *treeResume, fn func(entry treeEntry, r io.Reader) error) error {
+	walker := s.client.Walk(root)
+	for walker.Step() {
+		if err := walker.Err(); err != nil {
+			return fmt.Errorf("failed to read %s: %w", walker.Path(), err)
+		}
+		name := strings.TrimPrefix(strings.TrimPrefix(walker.Path(), root), "/")
+		if name == "" {
+			continue
+		}
+		info := walker.Stat()
+		entry := treeEntry{name: name, mode: info.Mode(), modTime: info.ModTime()}
+
+		switch {
+		case info.IsDir():
+			err := fn(entry, nil)
+			if err != nil {
+				return err
+			}
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := s.client.ReadLink(walker.Path())
+			if err != nil {
+				return fmt.Errorf("failed to read %s: %w", walker.Path(), err)
+			}
+			entry.link = link
+			if err := fn(entry, nil); err != nil {
+				return err
+			}
+		case info.Mode().IsRegular():
+			entry.size = info.Size()
+			if resume != nil && resume.done[name] {
+				continue
+			}
+			if resume != nil && resume.partial != nil && resume.partial.name == name {
+				entry.offset = resume.partial.offset
+			}
+			if err := s.readTreeFile(walker.Path(), entry, fn); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unsupported file type for %s", walker.Path())
+		}
+	}
+	return nil
+}
+
+func (s *sftpStore) readTreeFile(path string, entry treeEntry, fn func(entry treeEntry, r io.Reader) error) error {
+	f, err := s.client.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	defer f.Close()
+	if _, err := f.Seek(entry.offset, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	return fn(entry, f)
+}
+
+func (s *sftpStore) fileSize(path string) (int64, error) {
+	info, err := s.client.Lstat(path)
+	if err != nil {
+		return 0, fmt.Errorf("failed to stat %s: %w", path, err)
+	}
+	return info.Size(), nil
+}
+
+/*
+ * Hash a range of a file on the remote host if commands can be run there, as with the shell transport. Otherwise the
+ * range is read and hashed locally.
+ */
+func (s *sftpStore) hashRange(path string, offset int64, length int64) (string, error) {
+	if s.conn != nil {
+		if sum, err := hashRemoteRange(s.conn, path, offset, length); err == nil {
+			return sum, nil
+		}
+	}
+	f, err := s.client.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	defer f.Close()
+	sum, size, err := hashFile(io.NewSectionReader(f, offset, length))
+	if err == nil && size != length {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	return sum, nil
+}
+
+func (s *sftpStore) listFiles(root string, depth int) ([]treeEntry, error) {
+	if _, err := s.client.Lstat(root); os.IsNotExist(err) {
+		return nil, nil
+	}
+	var entries []treeEntry
+	walker := s.client.Walk(root)
+	for walker.Step() {
+		if err := walker.Err(); err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", walker.Path(), err)
+		}
+		name := strings.TrimPrefix(strings.TrimPrefix(walker.Path(), root), "/")
+		if name == "" {
+			continue
+		}
+		info := walker.Stat()
+		entries = append(entries, treeEntry{name: name, mode: info.Mode(), size: info.Size(), modTime: info.ModTime()})
+		if info.IsDir() && strings.Count(name, "/")+1 >= depth {
+			walker.SkipDir()
+		}
+	}
+	return entries, nil
+}
+
+/*
+ * Hash the files on the remote host if commands can be run there, as with the shell transport. Otherwise they are read
+ * over SFTP and hashed locally, since the SFTP protocol has no way to compute hashes on the server.
+ */
+func (s *sftpStore) hashFiles(root string) (map[string]string, error) {
+	if s.conn != nil {
+		if files, err := hashRemoteFiles(s.conn, root); err == nil {
+			return files, nil
+		}
+	}
+	files := map[string]string{}
+	err := s.readTree(root, nil, func(entry treeEntry, r io.Reader) error {
+		if !entry.mode.IsRegular() {
+			return nil
+		}
+		sum, _, err := hashFile(r)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", entry.name, err)
+		}
+		files[entry.name] = sum
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+/*
+ * Hash the files on the remote host if commands can be run there, as with the shell transport. Otherwise each file is
+ * read and hashed locally.
+ */
+func (s *sftpStore) hashFileList(root string, names []string) (map[string]string, error) {
+	if s.conn != nil {
+		if files, err := hashRemoteFileList(s.conn, root, names); err == nil {
+			return files, nil
+		}
+	}
+	files := map[string]string{}
+	for _, name := range names {
+		f, err := s.client.Open(root + "/" + name)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to open %s: %w", name, err)
+		}
+		sum, _, err := hashFile(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", name, err)
+		}
+		files[name] = sum
+	}
+	return files, nil
+}
+
+func (s *sftpStore) mkdir(path string) error {
+	if err := s.client.Mkdir(path); err != nil {
+		return fmt.Errorf("failed to create %s: %w", path, err)
+	}
+	return nil
+}
+
+func (s *sftpStore) mkdirAll(path string) error {
+	if err := s.client.MkdirAll(path); err != nil {
+		return fmt.Errorf("failed to create %s: %w", path, err)
+	}
+	return nil
+}
+
+func (s *sftpStore) writeFile(path string, r io.Reader, mode os.FileMode) error {
+	f, err := s.client.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", path, err)
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	return s.client.Chmod(path, mode.Perm())
+}
+
+func (s *sftpStore) resumeFile(path string, r io.Reader, offset int64, mode os.FileMode) error {
+	f, err := s.client.OpenFile(path, os.O_WRONLY|os.O_CREATE)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	err = f.Truncate(offset)
+	if err == nil {
+		_, err = f.Seek(offset, io.SeekStart)
+	}
+	if err == nil {
+		_, err = io.Copy(f, r)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	return s.client.Chmod(path, mode.Perm())
+}
+
+func (s *sftpStore) patchFile(basis string, path string, delta io.Reader, blockSize int, mode os.FileMode) error {
+	return errNoDelta
+}
+
+func (s *sftpStore) symlink(target string, path string) error {
+	s.client.Remove(path)
+	if err := s.client.Symlink(target, path); err != nil {
+		return fmt.Errorf("failed to create symlink %s: %w", path, err)
+	}
+	return nil
+}
+
+/*
+ * Rename using the posix-rename@openssh.com extension, which replaces the destination atomically. Plain SFTP rename
+ * fails if the destination exists, so it is only used for servers without the extension.
+ */
+func (s *sftpStore) rename(from string, to string) error {
+	err := s.client.PosixRename(from, to)
+	if err != nil {
+		if err = s.client.Rename(from, to); err != nil {
+			return fmt.Errorf("failed to rename %s to %s: %w", from, to, err)
+		}
+	}
+	return nil
+}
+
+func (s *sftpStore) remove(path string) error {
+	if err := s.client.Remove(path); err != nil {
+		return fmt.Errorf("failed to remove %s: %w", path, err)
+	}
+	return nil
+}
+
+func (s *sftpStore) removeAll(path string) error {
+	var failed []string
+	s.removeTree(path, &failed)
+	if len(failed) != 0 {
+		return fmt.Errorf("failed to remove %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+func (s *sftpStore) removeTree(path string, failed *[]string) {
+	info, err := s.client.Lstat(path)
+	if err != nil {
+		*failed = append(*failed, fmt.Sprintf("%s (%s)", path, err))
+		return
+	}
+	if info.IsDir() {
+		entries, err := s.client.ReadDir(path)
+		if err != nil {
+			*failed = append(*failed, fmt.Sprintf("%s (%s)", path, err))
+			return
+		}
+		for _, e := range entries {
+			s.removeTree(path+"/"+e.Name(), failed)
+		}
+		err = s.client.RemoveDirectory(path)
+	} else {
+		err = s.client.Remove(path)
+	}
+	if err != nil {
+		*failed = append(*failed, fmt.Sprintf("%s (%s)", path, err))
+	}
+}
+
+func validCommitIds(entries []string) []string {
+	var ids []string
+	for _, e := range entries {
+		if validateCommitId(e) == nil {
+			ids = append(ids, e)
+		}
+	}
+	return ids
+}
+
+func (s *sftpStore) close() error {
+	return s.client.Close()
+}
+
+func startSFTP(conn *ssh.Client) (*sftp.Client, error) {
+	return sftp.NewClient(conn)
+}
+
+var newSFTPClient = startSFTP
+
+func randomBoundary() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return "titan-" + hex.EncodeToString(b)
+}
+
+var newBoundary = randomBoundary
+
+/*
+ * Parse the output of listFramedMetadata(). The content of each file is everything between its header line and
+ * the newline preceding the next boundary.
+ */
+func parseFramedMetadata(output []byte, boundary string) ([]commitMetadata, error) {
+	var ret []commitMetadata
+	header := []byte(boundary + " ")
+	end := []byte(boundary + "--\n")
+	separator := []byte("\n" + boundary)
+	for {
+		if bytes.Equal(output, end) {
+			return ret, nil
+		}
+		if !bytes.HasPrefix(output, header) {
+			return nil, errors.New("malformed commit listing from remote")
+		}
+		lineEnd := bytes.IndexByte(output, '\n')
+		if lineEnd == -1 {
+			return nil, errors.New("truncated commit listing from remote")
+		}
+		id := string(output[len(header):lineEnd])
+		output = output[lineEnd+1:]
+
+		next := bytes.Index(output, separator)
+		if next == -1 {
+			return nil, errors.New("truncated commit listing from remote")
+		}
+		ret = append(ret, commitMetadata{id: id, content: output[:next]})
+		output = output[next+1:]
+	}
+}
+
+const (
+	transportAuto  = "auto"
+	transportSFTP  = "sftp"
+	transportShell = "shell"
+)
+
+/*
+ * Returns the configured 'transport' property, defaulting to automatic selection.
+ */
+func getTransport(properties map[string]interface{}) string {
+	if transport, ok := properties["transport"].(string); ok && transport != "" {
+		return transport
+	}
+	return transportAuto
+}
+
+func validateTransport(transport string) error {
+	if transport != transportAuto && transport != transportSFTP && transport != transportShell {
+		return fmt.Errorf("invalid transport '%s', must be one of '%s', '%s', or '%s'", transport, transportAuto,
+			transportSFTP, transportShell)
+	}
+	return nil
+}
+
+/*
+ * Open the store for the configured transport. In automatic mode, SFTP is preferred and shell commands are used if
+ * the server does not offer the SFTP subsystem, except in delta transfer mode, which needs shell commands.
+ */
+func openStore(conn *ssh.Client, properties map[string]interface{}) (remoteStore, error) {
+	maxSessions, err := getMaxSessions(properties)
+	if err != nil {
+		return nil, err
+	}
+	compression := streamCompression(properties)
+	transport := getTransport(properties)
+	if transport == transportShell || transport == transportAuto && getTransferMode(properties) == transferDelta {
+		return &shellStore{conn: conn, maxSessions: maxSessions, compression: compression}, nil
+	}
+
+	client, err := newSFTPClient(conn)
+	if err != nil {
+		if transport == transportSFTP {
+			return nil, fmt.Errorf("failed to start sftp subsystem: %w", err)
+		}
+		return &shellStore{conn: conn, maxSessions: maxSessions, compression: compression}, nil
+	}
+	store := &sftpStore{client: client, maxSessions: maxSessions}
+	if transport == transportAuto {
+		store.conn = conn
+	}
+	return store, nil
+}
+
+/*
+ * Get a connection for the remote and open its store. The returned function closes the store and releases the
+ * connection.
+ */
+func connectStore(properties map[string]interface{}, parameters map[string]interface{}) (remoteStore, func(), error) {
+	conn, release, err := connections.get(properties, parameters)
+	if err != nil {
+		return nil, nil, err
+	}
+	store, err := openStore(conn, properties)
+	if err != nil {
+		release()
+		return nil, nil, err
+	}
+	return store, func() {
+		store.close()
+		release()
+	}, nil
+}
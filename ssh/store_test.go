@@ -0,0 +1,301 @@
+/*
+ * Copyright The Titan Project Contributors.
+ */
+package ssh
+
+import (
+	"errors"
+	"fmt"
+	"github.com/pkg/sftp"
+	"github.com/stretchr/testify/assert"
+	"github.com/titan-data/remote-sdk-go/remote"
+	"golang.org/x/crypto/ssh"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+/*
+ * Connect to an in-process SFTP server backed by the local filesystem.
+ */
+func localSFTP(conn *ssh.Client) (*sftp.Client, error) {
+	client, server := net.Pipe()
+	s, err := sftp.NewServer(server)
+	if err != nil {
+		return nil, err
+	}
+	go s.Serve()
+	return sftp.NewClientPipe(client, client)
+}
+
+/*
+ * Create a temporary repository with the given files, relative to the repository root.
+ */
+func writeRepository(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "ssh.test")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		err = os.MkdirAll(filepath.Dir(path), 0755)
+		if assert.NoError(t, err) {
+			err = ioutil.WriteFile(path, []byte(content), 0644)
+		}
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+	}
+	return dir
+}
+
+func TestListCommitsSFTP(t *testing.T) {
+	dir := writeRepository(t, map[string]string{
+		"one/metadata.json":     "{\"timestamp\": \"2019-09-20T13:45:36Z\"}",
+		"two/metadata.json":     "{\"timestamp\": \"2019-09-20T13:45:37Z\", \"tags\": {\"a\": \"b\"}}",
+		"three/data":            "no metadata",
+		".hidden/metadata.json": "{}",
+	})
+	defer os.RemoveAll(dir)
+
+	conn := new(MockConn)
+	conn.On("Close").Return(nil)
+	conn.On("SendRequest", "keepalive@openssh.com", true, []byte(nil)).Return(true, []byte(nil), nil)
+	dial = func(network string, addr string, cfg *ssh.ClientConfig) (*ssh.Client, error) {
+		return &ssh.Client{Conn: conn}, nil
+	}
+	newSFTPClient = localSFTP
+	run = func(conn *ssh.Client, command string) (bytes []byte, err error) {
+		return nil, errors.New("shell unavailable")
+	}
+	r := remote.Get("ssh")
+	commits, err := r.ListCommits(map[string]interface{}{"username": "username", "address": "address", "path": dir,
+		"transport": "sftp"}, map[string]interface{}{"password": "password"}, []remote.Tag{})
+	if assert.NoError(t, err) {
+		assert.Len(t, commits, 2)
+		assert.Equal(t, "two", commits[0].Id)
+		assert.Equal(t, "one", commits[1].Id)
+	}
+	commits, err = r.ListCommits(map[string]interface{}{"username": "username", "address": "address", "path": dir},
+		map[string]interface{}{"password": "password"}, []remote.Tag{{Key: "a"}})
+	if assert.NoError(t, err) {
+		assert.Len(t, commits, 1)
+		assert.Equal(t, "two", commits[0].Id)
+	}
+	run = runCommand
+	newSFTPClient = startSFTP
+	dial = ssh.Dial
+	connections.closeAll()
+}
+
+func TestListCommitsAutoFramed(t *testing.T) {
+	dir := writeRepository(t, map[string]string{
+		"one/metadata.json": "{\"timestamp\": \"2019-09-20T13:45:36Z\"}",
+		"two/metadata.json": "{\"timestamp\": \"2019-09-20T13:45:37Z\"}",
+	})
+	defer os.RemoveAll(dir)
+
+	mockSFTPDial()
+	var commands []string
+	run = func(conn *ssh.Client, command string) ([]byte, error) {
+		commands = append(commands, command)
+		return runLocal(conn, command)
+	}
+	commits, err := remote.Get("ssh").ListCommits(map[string]interface{}{"username": "username",
+		"address": "address", "path": dir}, map[string]interface{}{"password": "password"}, []remote.Tag{})
+	if assert.NoError(t, err) {
+		assert.Len(t, commits, 2)
+		assert.Len(t, commands, 1)
+	}
+	run = runCommand
+	resetSFTPDial()
+}
+
+func TestGetCommitSFTP(t *testing.T) {
+	dir := writeRepository(t, map[string]string{
+		"id/metadata.json": "{\"a\": \"b\"}",
+	})
+	defer os.RemoveAll(dir)
+
+	conn := new(MockConn)
+	conn.On("Close").Return(nil)
+	conn.On("SendRequest", "keepalive@openssh.com", true, []byte(nil)).Return(true, []byte(nil), nil)
+	dial = func(network string, addr string, cfg *ssh.ClientConfig) (*ssh.Client, error) {
+		return &ssh.Client{Conn: conn}, nil
+	}
+	newSFTPClient = localSFTP
+	r := remote.Get("ssh")
+	commit, err := r.GetCommit(map[string]interface{}{"username": "username", "address": "address", "path": dir},
+		map[string]interface{}{"password": "password"}, "id")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "b", commit.Properties["a"])
+	}
+	_, err = r.GetCommit(map[string]interface{}{"username": "username", "address": "address", "path": dir},
+		map[string]interface{}{"password": "password"}, "missing")
+	assert.Error(t, err)
+	newSFTPClient = startSFTP
+	dial = ssh.Dial
+	connections.closeAll()
+}
+
+func TestTransportSFTPUnavailable(t *testing.T) {
+	conn := new(MockConn)
+	conn.On("Close").Return(nil)
+	dial = func(network string, addr string, cfg *ssh.ClientConfig) (*ssh.Client, error) {
+		return &ssh.Client{Conn: conn}, nil
+	}
+	newSFTPClient = noSFTP
+	r := remote.Get("ssh")
+	_, err := r.GetCommit(map[string]interface{}{"username": "username", "address": "address", "path": "/path",
+		"transport": "sftp"}, map[string]interface{}{"password": "password"}, "id")
+	assert.Error(t, err)
+	newSFTPClient = startSFTP
+	dial = ssh.Dial
+	connections.closeAll()
+}
+
+func TestTransportShell(t *testing.T) {
+	conn := new(MockConn)
+	conn.On("Close").Return(nil)
+	dial = func(network string, addr string, cfg *ssh.ClientConfig) (*ssh.Client, error) {
+		return &ssh.Client{Conn: conn}, nil
+	}
+	newSFTPClient = func(conn *ssh.Client) (*sftp.Client, error) {
+		t.Error("sftp should not be used")
+		return nil, errors.New("error")
+	}
+	run = func(conn *ssh.Client, command string) (bytes []byte, err error) {
+		return []byte("{\"a\": \"b\"}"), nil
+	}
+	r := remote.Get("ssh")
+	commit, err := r.GetCommit(map[string]interface{}{"username": "username", "address": "address", "path": "/path",
+		"transport": "shell"}, map[string]interface{}{"password": "password"}, "id")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "b", commit.Properties["a"])
+	}
+	run = runCommand
+	newSFTPClient = startSFTP
+	dial = ssh.Dial
+	connections.closeAll()
+}
+
+func TestTransportProperty(t *testing.T) {
+	r := remote.Get("ssh")
+	props, err := r.FromURL("ssh://user@host/path", map[string]string{"transport": "sftp"})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "sftp", props["transport"])
+		assert.NoError(t, r.ValidateRemote(props))
+		_, extra, err := r.ToURL(props)
+		if assert.NoError(t, err) {
+			assert.Equal(t, "sftp", extra["transport"])
+		}
+	}
+}
+
+func TestTransportBadProperty(t *testing.T) {
+	r := remote.Get("ssh")
+	_, err := r.FromURL("ssh://user@host/path", map[string]string{"transport": "ftp"})
+	assert.Error(t, err)
+	err = r.ValidateRemote(map[string]interface{}{"username": "username", "address": "host", "path": "/path",
+		"transport": "ftp"})
+	assert.Error(t, err)
+}
+
+/*
+ * Run shell store commands against the local machine, to test the scripts themselves.
+ */
+func runLocal(conn *ssh.Client, command string) ([]byte, error) {
+	output, err := exec.Command("sh", "-c", command).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute '%s': %w\n%s", command, err, string(output))
+	}
+	return output, nil
+}
+
+func TestShellListMetadata(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("no POSIX shell available")
+	}
+	dir := writeRepository(t, map[string]string{
+		"one/metadata.json":            "{\"a\": \"b\"}\n",
+		"two words/metadata.json":      "{\"c\":\n\"d\"}",
+		"-dash/metadata.json":          "{}",
+		"missing/data":                 "no metadata",
+		".hidden/metadata.json":        "{}",
+		"titan-boundary/metadata.json": "titan-boundary--\n",
+	})
+	defer os.RemoveAll(dir)
+	run = runLocal
+
+	metadata, err := (&shellStore{}).listMetadata(dir)
+	if assert.NoError(t, err) {
+		found := map[string]string{}
+		for _, m := range metadata {
+			found[m.id] = string(m.content)
+		}
+		assert.Equal(t, map[string]string{
+			"one":            "{\"a\": \"b\"}\n",
+			"two words":      "{\"c\":\n\"d\"}",
+			"-dash":          "{}",
+			"titan-boundary": "titan-boundary--\n",
+		}, found)
+	}
+
+	_, err = (&shellStore{}).listMetadata(filepath.Join(dir, "nonexistent"))
+	assert.Error(t, err)
+	run = runCommand
+}
+
+func TestShellListMetadataEmpty(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("no POSIX shell available")
+	}
+	dir := writeRepository(t, map[string]string{})
+	defer os.RemoveAll(dir)
+	run = runLocal
+
+	metadata, err := (&shellStore{}).listMetadata(dir)
+	if assert.NoError(t, err) {
+		assert.Empty(t, metadata)
+	}
+	run = runCommand
+}
+
+func TestReadFileMissing(t *testing.T) {
+	repo := writeRepository(t, map[string]string{"file": "content"})
+	defer os.RemoveAll(repo)
+	store, done := localStore(t, repo)
+	defer done()
+	run = runLocal
+	defer func() {
+		run = runCommand
+	}()
+
+	for _, s := range []remoteStore{store, &shellStore{}} {
+		content, err := s.readFile(filepath.Join(repo, "file"))
+		if assert.NoError(t, err) {
+			assert.Equal(t, "content", string(content))
+		}
+		_, err = s.readFile(filepath.Join(repo, "missing"))
+		assert.True(t, errors.Is(err, os.ErrNotExist), err)
+		_, err = s.readFile(repo)
+		if assert.Error(t, err) {
+			assert.False(t, errors.Is(err, os.ErrNotExist))
+		}
+	}
+}
+
+func TestParseFramedMetadata(t *testing.T) {
+	metadata, err := parseFramedMetadata([]byte("B one\n{}\nB two\n\nB--\n"), "B")
+	if assert.NoError(t, err) {
+		assert.Equal(t, []commitMetadata{{id: "one", content: []byte("{}")}, {id: "two", content: []byte{}}},
+			metadata)
+	}
+	for _, output := range []string{"", "B one\n{}\n", "B one\n{}", "garbage\nB--\n", "B one"} {
+		_, err = parseFramedMetadata([]byte(output), "B")
+		assert.Error(t, err, output)
+	}
+}
@@ -0,0 +1,110 @@
+/*
+ * Copyright The Titan Project Contributors.
+ */
+package ssh
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/titan-data/remote-sdk-go/remote"
+)
+
+/*
+ * Apply tag changes to the raw contents of metadata.json. Numbers are preserved exactly as written, since the rest of
+ * the metadata is rewritten as is.
+ */
+func applyTags(content []byte, add map[string]string, remove []string) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.UseNumber()
+	metadata := map[string]interface{}{}
+	if err := decoder.Decode(&metadata); err != nil {
+		return nil, fmt.Errorf("failed to parse metadata: %w", err)
+	}
+	if metadata == nil {
+		metadata = map[string]interface{}{}
+	}
+
+	tags := map[string]interface{}{}
+	if existing, ok := metadata["tags"]; ok && existing != nil {
+		if tags, ok = existing.(map[string]interface{}); !ok {
+			return nil, fmt.Errorf("invalid tags in metadata, expected an object")
+		}
+	}
+	for _, key := range remove {
+		delete(tags, key)
+	}
+	for key, value := range add {
+		tags[key] = value
+	}
+	metadata["tags"] = tags
+
+	return json.Marshal(metadata)
+}
+
+/*
+ * How many times a tag update is attempted while the metadata keeps being changed by others.
+ */
+const maxTagAttempts = 5
+
+/*
+ * Add and remove tags on an existing commit. Removals are applied before additions. This is a read-modify-write of
+ * metadata.json with optimistic concurrency: the new contents are computed without holding the repository lock, which
+ * is then only taken to check that metadata.json still has the contents they were computed from, and to rename them
+ * into place. If it has changed, the update is retried on top of the change, so concurrent tag updates never clobber
+ * each other, and readers see either the old or the new tags. Hand edits made between the check and the rename can
+ * still be overwritten. Returns the updated commit.
+ *
+ * The tags of commits whose metadata is encrypted can only be updated with the encryptionPassphrase parameter, even
+ * if tags are one of the fields left in cleartext, since those fields are sealed along with the rest.
+ */
+func (s sshRemote) UpdateTags(properties map[string]interface{}, parameters map[string]interface{}, commitId string,
+	add map[string]string, remove []string) (*remote.Commit, error) {
+	if err := validateCommitId(commitId); err != nil {
+		return nil, err
+	}
+
+	store, release, err := connectStore(properties, parameters)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	return updateTags(store, properties, newKeyring(store, properties, parameters), commitId, add, remove)
+}
+
+func updateTags(store remoteStore, properties map[string]interface{}, keys *keyring, commitId string,
+	add map[string]string, remove []string) (*remote.Commit, error) {
+	file := fmt.Sprintf("%s/%s/metadata.json", properties["path"], commitId)
+	for attempt := 0; attempt < maxTagAttempts; attempt++ {
+		previous, err := store.readFile(file)
+		if err != nil {
+			return nil, err
+		}
+		updated, err := applySealedTags(keys, commitId, previous, add, remove)
+		if err != nil {
+			return nil, fmt.Errorf("failed to update tags of commit %s: %w", commitId, err)
+		}
+
+		swapped := false
+		err = withLock(store, properties, func() error {
+			current, err := store.readFile(file)
+			if err != nil || !bytes.Equal(current, previous) {
+				return err
+			}
+			swapped = true
+			return writeFileAtomic(store, file, updated, 0644)
+		})
+		if err != nil {
+			return nil, err
+		}
+		if swapped {
+			commit, err := parseCommit(commitId, updated)
+			if err != nil {
+				return nil, err
+			}
+			return commit, openMetadata(keys, commit)
+		}
+	}
+	return nil, fmt.Errorf("failed to update tags of commit %s, its metadata kept changing", commitId)
+}
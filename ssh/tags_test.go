@@ -0,0 +1,140 @@
+/*
+ * Copyright The Titan Project Contributors.
+ */
+package ssh
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestApplyTags(t *testing.T) {
+	content, err := applyTags([]byte("{\"size\": 12345678901234567890, \"tags\": {\"a\": \"b\", \"c\": \"d\"}}"),
+		map[string]string{"e": "f", "a": "g"}, []string{"c"})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "{\"size\":12345678901234567890,\"tags\":{\"a\":\"g\",\"e\":\"f\"}}", string(content))
+	}
+}
+
+func TestApplyTagsNoTags(t *testing.T) {
+	content, err := applyTags([]byte("{}"), map[string]string{"a": "b"}, []string{"c"})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "{\"tags\":{\"a\":\"b\"}}", string(content))
+	}
+}
+
+func TestApplyTagsNullMetadata(t *testing.T) {
+	content, err := applyTags([]byte("null"), map[string]string{"a": "b"}, nil)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "{\"tags\":{\"a\":\"b\"}}", string(content))
+	}
+}
+
+func TestApplyTagsBadTags(t *testing.T) {
+	_, err := applyTags([]byte("{\"tags\": [\"a\"]}"), map[string]string{"a": "b"}, nil)
+	assert.Error(t, err)
+}
+
+func TestUpdateTags(t *testing.T) {
+	repo := writeRepository(t, map[string]string{"id/metadata.json": "{\"tags\": {\"a\": \"b\"}}"})
+	defer os.RemoveAll(repo)
+
+	mockSFTPDial()
+	commit, err := sshRemote{}.UpdateTags(pushProperties(repo), map[string]interface{}{"password": "password"},
+		"id", map[string]string{"c": "d"}, []string{"a"})
+	if assert.NoError(t, err) {
+		assert.Equal(t, map[string]interface{}{"c": "d"}, commit.Properties["tags"])
+		content, err := ioutil.ReadFile(filepath.Join(repo, "id", "metadata.json"))
+		if assert.NoError(t, err) {
+			assert.Equal(t, "{\"tags\":{\"c\":\"d\"}}", string(content))
+		}
+		entries, err := ioutil.ReadDir(filepath.Join(repo, "id"))
+		if assert.NoError(t, err) {
+			assert.Len(t, entries, 1)
+		}
+	}
+	resetSFTPDial()
+}
+
+func TestUpdateTagsConcurrent(t *testing.T) {
+	repo := writeRepository(t, map[string]string{"id/metadata.json": "{}"})
+	defer os.RemoveAll(repo)
+	defer withLockTimings(time.Minute, time.Minute, time.Minute)()
+
+	mockSFTPDial()
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(key string) {
+			defer wg.Done()
+			_, err := sshRemote{}.UpdateTags(pushProperties(repo), map[string]interface{}{"password": "password"},
+				"id", map[string]string{key: "v"}, nil)
+			assert.NoError(t, err)
+		}(fmt.Sprint(i))
+	}
+	wg.Wait()
+	content, err := ioutil.ReadFile(filepath.Join(repo, "id", "metadata.json"))
+	if assert.NoError(t, err) {
+		assert.Equal(t, "{\"tags\":{\"0\":\"v\",\"1\":\"v\",\"2\":\"v\",\"3\":\"v\"}}", string(content))
+	}
+	resetSFTPDial()
+}
+
+/*
+ * A store that simulates other clients changing metadata.json just after it is read.
+ */
+type changingStore struct {
+	remoteStore
+	changes []string
+}
+
+func (c *changingStore) readFile(path string) ([]byte, error) {
+	content, err := c.remoteStore.readFile(path)
+	if err == nil && len(c.changes) > 0 && filepath.Base(path) == "metadata.json" {
+		err = ioutil.WriteFile(path, []byte(c.changes[0]), 0644)
+		c.changes = c.changes[1:]
+	}
+	return content, err
+}
+
+func TestUpdateTagsChanged(t *testing.T) {
+	repo := writeRepository(t, map[string]string{"id/metadata.json": "{}"})
+	defer os.RemoveAll(repo)
+	store, done := localStore(t, repo)
+	defer done()
+
+	changing := &changingStore{remoteStore: store, changes: []string{"{\"tags\":{\"a\":\"b\"}}"}}
+	commit, err := updateTags(changing, pushProperties(repo), newKeyring(changing, pushProperties(repo), nil), "id",
+		map[string]string{"c": "d"}, nil)
+	if assert.NoError(t, err) {
+		assert.Equal(t, map[string]interface{}{"a": "b", "c": "d"}, commit.Properties["tags"])
+	}
+
+	var changes []string
+	for i := 0; i < 2*maxTagAttempts; i++ {
+		changes = append(changes, fmt.Sprintf("{\"tags\":{\"n\":\"%d\"}}", i))
+	}
+	changing = &changingStore{remoteStore: store, changes: changes}
+	_, err = updateTags(changing, pushProperties(repo), newKeyring(changing, pushProperties(repo), nil), "id",
+		map[string]string{"c": "d"}, nil)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "kept changing")
+	}
+}
+
+func TestUpdateTagsMissing(t *testing.T) {
+	repo := writeRepository(t, map[string]string{})
+	defer os.RemoveAll(repo)
+
+	mockSFTPDial()
+	_, err := sshRemote{}.UpdateTags(pushProperties(repo), map[string]interface{}{"password": "password"},
+		"id", map[string]string{"c": "d"}, nil)
+	assert.Error(t, err)
+	resetSFTPDial()
+}